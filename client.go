@@ -1,14 +1,20 @@
 package amq
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aluka-7/amq/message"
 	"github.com/aluka-7/amq/node"
 	"github.com/aluka-7/amq/provider"
 	"github.com/aluka-7/configuration"
-	"github.com/aluka-7/utils"
 	"github.com/rs/zerolog/log"
 ) /**
  * 提供给业务系统使用和AMQ进行交互的接口，允许业务系统发送消息到AMQ和处理从AMQ中收到的消息。每个AMQ客户端
@@ -20,7 +26,10 @@ import (
  *     "key1" : "value1",
  *     "key2" : "value2"
  *   },
- *   "partitions" : 2         // 节点的分区数(默认1，可选配置)
+ *   "partitions" : 2,        // 节点的分区数(默认1，可选配置)
+ *   "systemPartitions" : {   // 其他系统在节点上的分区数(可选配置)，未配置的系统与当前系统相同
+ *     "1002" : 4
+ *   }
  * }
  * </pre>
  * <p>
@@ -43,15 +52,140 @@ type Client struct {
 	node             node.Node
 	queueNamePattern *regexp.Regexp
 	partitions       int
+	systemPartitions map[string]int // 其他系统的分区数量
 	provider         provider.Provider
 	processorMap     map[string]Processor
 	started          bool
+	repliesMu        sync.Mutex
+	replies          map[string]chan *message.MsgBody // 同步请求等待中的应答，key为消息ID
+	idGenerator      message.IdGenerator
+	txTimeout        time.Duration
+	txRetention      time.Duration
+	txStore          TransactionStore
+	tracker          *transactionTracker
+	quarantineQueue  string
+	signer           message.Signer
+	compressor       message.Compressor
+	compressMinSize  int
+	encryptor        *encryptor
+	replayConfig     *ReplayConfig
+	nonceStore       NonceStore
+	replay           *replayGuard
+	dedupConfig      *DedupConfig
+	dedupStore       DedupStore
+	outboxConfig     *OutboxConfig
+	outbox           *outbox
+	deadLetterConfig *DeadLetterConfig
+	deadLetterStore  DeadLetterStore
+	deadLetters      *deadLetterQueue
+	retryPolicies    map[string]*RetryPolicy // 各消息类型未填充默认值的重试策略，key为空字符串的策略为节点默认的策略
+	scheduleConfig   *ScheduleConfig
+	scheduleStore    ScheduleStore
+	scheduler        *scheduler
+	concurrency      *ConcurrencyConfig
+	partitioner      Partitioner
+	groupConfig      *GroupConfig
+	coordinator      Coordinator
+	rebalancer       RebalanceListener
+	group            *groupMember
+	listenersMu      sync.Mutex
+	listeners        map[string]*queueListener // 已监听的队列，key为队列名称
+	inflightMu       sync.Mutex
+	inflight         map[string]int // 处理中的消息，key为消息ID
+	abandoned        chan struct{}  // 关闭超时后关闭，通知处理中的重试不再等待
+	abandonOnce      sync.Once
+	shutdownOnce     sync.Once
+	closed           int32 // 关闭后为1，不再发送消息
 }
 
 type ClientConfig struct {
 	Provider   string            `json:"provider"`
 	Parameter  map[string]string `json:"parameter"`
 	Partitions int               `json:"partitions"` // 分区数量
+	// 其他系统在当前节点上的分区数量(可选)，key为系统ID，发送消息时按照目标系统的分区数量选择分区，未配置的系统与当前系统相同
+	SystemPartitions map[string]int `json:"systemPartitions"`
+	// 多分区节点的分区选择器(可选)，hash(默认)、roundRobin或sticky
+	Partitioner string `json:"partitioner"`
+	// 消费组配置(可选)，配置后多分区节点的实例之间自动分配分区
+	Group *GroupConfig `json:"group"`
+	// 事务消息等待对方应答的超时时间(秒)，超时后回调{@link TransactionTimeoutProcessor}，默认0表示不检查
+	TransactionTimeout int `json:"transactionTimeout"`
+	// 已完成或已超时的事务记录保留的时间(秒)，默认保留一天
+	TransactionRetention int `json:"transactionRetention"`
+	// 签名校验失败的消息转发到的隔离队列(可选)，未配置时直接丢弃
+	QuarantineQueue string `json:"quarantineQueue"`
+	// 消息签名配置(可选)，未配置时使用兼容旧版本的MD5签名
+	Signature *SignatureConfig `json:"signature"`
+	// 发送消息时使用的编码(可选)，json(默认)、msgpack或protobuf，接收时根据消息的内容类型标记自动识别
+	Codec string `json:"codec"`
+	// 消息体压缩配置(可选)，未配置时不压缩
+	Compression *CompressionConfig `json:"compression"`
+	// 消息体加密配置(可选)，未配置时不加密
+	Encryption *EncryptionConfig `json:"encryption"`
+	// 重放攻击防护配置(可选)，未配置时不检查
+	Replay *ReplayConfig `json:"replay"`
+	// 消息去重配置(可选)，未配置时不去重
+	Dedup *DedupConfig `json:"dedup"`
+	// 事务发件箱配置(可选)，需要同时通过{@link Client#SetOutbox}指定数据库连接
+	Outbox *OutboxConfig `json:"outbox"`
+	// 死信队列配置(可选)，未配置时处理失败的消息不重试也不转发
+	DeadLetter *DeadLetterConfig `json:"deadLetter"`
+	// 发送和处理消息失败时的重试配置(可选)，未配置时发送失败不重试，处理失败按照死信队列的配置重试
+	Retry *RetryConfig `json:"retry"`
+	// 延迟投递调度器配置(可选)，仅在provider不支持延迟投递时使用
+	Schedule *ScheduleConfig `json:"schedule"`
+	// 并发处理配置(可选)，未配置时由provider逐条同步处理
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+}
+
+/**
+ * 消息体压缩配置，消息体序列化后的长度达到阈值时使用指定的算法压缩，接收方根据消息中记录的算法自动解压，格式如下：
+ * <pre>
+ * {
+ *   "algorithm" : "zstd", // 压缩算法，gzip(默认)、zstd或snappy
+ *   "threshold" : 4096    // 压缩阈值(字节，默认4096)
+ * }
+ * </pre>
+ */
+type CompressionConfig struct {
+	Algorithm string `json:"algorithm"`
+	Threshold int    `json:"threshold"`
+}
+
+const defaultCompressThreshold = 4096
+
+/**
+ * 消息签名配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "algorithm" : "hmac-sha256",              // 签名算法，hmac-sha256或md5(旧版本)
+ *   "activeKey" : "k2",                       // 当前用于签名的密钥ID
+ *   "keys" : {"k1":"secret1","k2":"secret2"}, // 所有有效的密钥，轮换期间新旧密钥同时保留
+ *   "acceptLegacy" : true                     // 是否接受旧版本MD5签名的消息
+ * }
+ * </pre>
+ */
+type SignatureConfig struct {
+	Algorithm    string            `json:"algorithm"`
+	ActiveKey    string            `json:"activeKey"`
+	Keys         map[string]string `json:"keys"`
+	AcceptLegacy bool              `json:"acceptLegacy"`
+}
+
+/**
+ * 根据签名配置创建签名器。
+ */
+func newSigner(cfg *SignatureConfig) (message.Signer, error) {
+	if cfg == nil {
+		return message.NewMD5Signer(), nil
+	}
+	switch strings.ToLower(cfg.Algorithm) {
+	case "", "hmac-sha256":
+		return message.NewHMACSigner(cfg.ActiveKey, cfg.Keys, cfg.AcceptLegacy)
+	case "md5":
+		return message.NewMD5Signer(), nil
+	}
+	return nil, fmt.Errorf("不支持的签名算法:%s", cfg.Algorithm)
 }
 
 /**
@@ -63,7 +197,7 @@ type ClientConfig struct {
  */
 // {"provider":"Rabbit","parameter":{"username":"guest","password":"guest","brokerURL":"localhost:5672"},"partitions":1}
 func newClient(conf configuration.Configuration, systemId string, node node.Node) *Client {
-	client := &Client{conf: conf, node: node, systemId: systemId}
+	client := &Client{conf: conf, node: node, systemId: systemId, listeners: make(map[string]*queueListener), inflight: make(map[string]int), abandoned: make(chan struct{})}
 	cfg := &ClientConfig{}
 	err := conf.Clazz("base", "amq", "", node.String(), cfg)
 	if err != nil {
@@ -71,12 +205,55 @@ func newClient(conf configuration.Configuration, systemId string, node node.Node
 	}
 
 	client.partitions = cfg.Partitions
-
-	if client.partitions == 1 {
-		client.queueNamePattern, _ = regexp.Compile("(sys_amq_\\d{4})_(.+)")
-	} else {
-		client.queueNamePattern, _ = regexp.Compile("(sys_amq_\\d{4})_(.+)_p\\d+")
+	if client.partitions <= 0 {
+		client.partitions = 1
+	}
+	client.systemPartitions = cfg.SystemPartitions
+	// 使用所属系统的ID生成消息ID
+	if client.idGenerator, err = message.NewIdGenerator(systemId); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]初始化消息ID生成器失败，使用默认的消息ID生成器", node.String())
+	}
+	client.txTimeout = time.Duration(cfg.TransactionTimeout) * time.Second
+	client.txRetention = time.Duration(cfg.TransactionRetention) * time.Second
+	client.quarantineQueue = cfg.QuarantineQueue
+	if client.signer, err = newSigner(cfg.Signature); err != nil {
+		log.Fatal().Err(err).Msgf("[AMQ-Client-%s]签名配置错误", node.String())
+		return nil
+	}
+	if cc := cfg.Compression; cc != nil {
+		algorithm := cc.Algorithm
+		if len(algorithm) == 0 {
+			algorithm = "gzip"
+		}
+		if client.compressor, err = message.GetCompressor(algorithm); err != nil {
+			log.Fatal().Err(err).Msgf("[AMQ-Client-%s]压缩配置错误", node.String())
+			return nil
+		}
+		client.compressMinSize = cc.Threshold
+		if client.compressMinSize <= 0 {
+			client.compressMinSize = defaultCompressThreshold
+		}
 	}
+	client.replayConfig = cfg.Replay
+	client.dedupConfig = cfg.Dedup
+	client.outboxConfig = cfg.Outbox
+	client.deadLetterConfig = cfg.DeadLetter
+	client.retryPolicies = newRetryPolicies(cfg.Retry)
+	client.scheduleConfig = cfg.Schedule
+	client.concurrency = newConcurrency(cfg.Concurrency)
+	client.groupConfig = cfg.Group
+	if client.partitioner, err = NewPartitioner(cfg.Partitioner); err != nil {
+		log.Fatal().Err(err).Msgf("[AMQ-Client-%s]分区选择器配置错误", node.String())
+		return nil
+	}
+	if cfg.Encryption != nil {
+		if client.encryptor, err = newEncryptor(systemId, cfg.Encryption); err != nil {
+			log.Fatal().Err(err).Msgf("[AMQ-Client-%s]加密配置错误", node.String())
+			return nil
+		}
+	}
+
+	client.queueNamePattern = queueNamePattern(client.partitions)
 
 	if len(cfg.Provider) > 0 {
 		read := provider.Read(cfg.Provider)
@@ -84,10 +261,22 @@ func newClient(conf configuration.Configuration, systemId string, node node.Node
 			log.Fatal().Msgf("[AMQ-Client-%s]不支持的provider类型:%s", node.String(), cfg.Provider)
 			return nil
 		}
-		client.provider = read.New(node, cfg.Parameter)
+		if _, err = message.GetCodec(cfg.Codec); err != nil {
+			log.Fatal().Err(err).Msgf("[AMQ-Client-%s]消息编码配置错误", node.String())
+			return nil
+		}
+		parameter := make(map[string]string, len(cfg.Parameter)+1)
+		for k, v := range cfg.Parameter {
+			parameter[k] = v
+		}
+		if _, ok := parameter["codec"]; !ok && len(cfg.Codec) > 0 {
+			parameter["codec"] = cfg.Codec
+		}
+		client.provider = read.New(node, parameter)
 	}
 
 	client.processorMap = make(map[string]Processor, 0)
+	client.replies = make(map[string]chan *message.MsgBody)
 	fmt.Printf("[AMQ-Client-%s]客户端初始化完成:config=%v\n", node.String(), cfg)
 	return client
 }
@@ -109,6 +298,177 @@ func (c *Client) AddProcessor(processors ...Processor) {
 	}
 }
 
+/**
+ * 替换当前客户端使用的消息ID生成器，需要确保该方法在{@link #start()}方法之前调用。
+ *
+ * @param generator
+ */
+func (c *Client) SetIdGenerator(generator message.IdGenerator) {
+	if !c.started {
+		c.idGenerator = generator
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置消息ID生成器\n", c.node.String())
+	}
+}
+
+/**
+ * 生成一个新的消息ID，默认的ID中嵌入了当前客户端所属的系统ID，参看{@link message.ParseMsgId}。
+ */
+func (c *Client) NewMsgId() string {
+	if c.idGenerator == nil {
+		return message.NewMsgId().Id()
+	}
+	return c.idGenerator.NextId()
+}
+
+/**
+ * 设置事务消息状态的存储，默认使用内存存储，需要确保该方法在{@link #start()}方法之前调用，并且仅在配置了transactionTimeout时生效。
+ *
+ * @param store
+ */
+func (c *Client) SetTransactionStore(store TransactionStore) {
+	if !c.started {
+		c.txStore = store
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置事务存储\n", c.node.String())
+	}
+}
+
+/**
+ * 查询事务消息在本方的记录，包括等待中、已完成和已超时的记录，未配置transactionTimeout或记录已超过保留时间被清理时返回空。
+ *
+ * @param msgId 事务消息的唯一ID
+ */
+func (c *Client) Transactions(msgId string) ([]*Transaction, error) {
+	if c.txStore == nil {
+		return nil, nil
+	}
+	txs := make([]*Transaction, 0, 2)
+	for _, phase := range []string{string(message.ReceiverAck), string(message.SenderAck)} {
+		tx, err := c.txStore.Get(msgId + "@" + phase)
+		if err != nil {
+			return nil, err
+		}
+		if tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+/**
+ * 设置已处理消息的记录存储，默认使用内存存储，需要确保该方法在{@link #start()}方法之前调用，并且仅在配置了replay时生效。
+ *
+ * @param store
+ */
+func (c *Client) SetNonceStore(store NonceStore) {
+	if !c.started {
+		c.nonceStore = store
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置消息记录存储\n", c.node.String())
+	}
+}
+
+/**
+ * 设置已处理消息的去重存储，设置后重复投递的消息不会再次交给处理器，事务消息直接使用之前的应答消息体应答，
+ * 需要确保该方法在{@link #start()}方法之前调用。
+ *
+ * @param store
+ */
+func (c *Client) SetDedupStore(store DedupStore) {
+	if !c.started {
+		c.dedupStore = store
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置去重存储\n", c.node.String())
+	}
+}
+
+/**
+ * 设置死信的存储，默认使用内存存储，需要确保该方法在{@link #start()}方法之前调用，并且仅在配置了deadLetter时生效。
+ *
+ * @param store
+ */
+func (c *Client) SetDeadLetterStore(store DeadLetterStore) {
+	if !c.started {
+		c.deadLetterStore = store
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置死信存储\n", c.node.String())
+	}
+}
+
+/**
+ * 设置延迟投递消息的存储，未设置时使用配置的本地文件，都未配置时无法发送延迟投递的消息，需要确保该方法在{@link #start()}方法之前调用，
+ * 并且仅在provider不支持延迟投递时生效。使用{@link NewMemoryScheduleStore}时未到期的消息会随进程退出而丢失。
+ *
+ * @param store
+ */
+func (c *Client) SetScheduleStore(store ScheduleStore) {
+	if !c.started {
+		c.scheduleStore = store
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置延迟消息存储\n", c.node.String())
+	}
+}
+
+/**
+ * 设置消费组协调器，设置后多分区节点在启动时未指定分区的情况下加入消费组，默认使用基于本地文件的协调器，
+ * 需要确保该方法在{@link #start()}方法之前调用。
+ *
+ * @param coordinator
+ */
+func (c *Client) SetCoordinator(coordinator Coordinator) {
+	if !c.started {
+		c.coordinator = coordinator
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置消费组协调器\n", c.node.String())
+	}
+}
+
+/**
+ * 设置消费组分区重新分配的监听接口，需要确保该方法在{@link #start()}方法之前调用。
+ *
+ * @param listener
+ */
+func (c *Client) SetRebalanceListener(listener RebalanceListener) {
+	if !c.started {
+		c.rebalancer = listener
+	} else {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置分区分配监听接口\n", c.node.String())
+	}
+}
+
+/**
+ * 获取消费组当前分配给本实例并且正在监听的分区编号，未加入消费组时返回nil。
+ *
+ * @return
+ */
+func (c *Client) AssignedPartitions() []int {
+	if c.group == nil {
+		return nil
+	}
+	return c.group.partitions()
+}
+
+/**
+ * 使用业务系统的数据库作为事务发件箱，设置后{@link #SendInTx}将消息写入发件箱表，客户端启动后由后台任务转发到AMQ，
+ * 发件箱表不存在时自动创建，需要确保该方法在{@link #start()}方法之前调用。
+ *
+ * @param db
+ * @param dialect SQL方言，postgres、mysql或sqlite
+ * @return
+ */
+func (c *Client) SetOutbox(db *sql.DB, dialect string) error {
+	if c.started {
+		return fmt.Errorf("[AMQ-Client-%s]该客户端已启动，无法设置发件箱", c.node.String())
+	}
+	o, err := newOutbox(c, db, dialect, c.outboxConfig)
+	if err != nil {
+		return err
+	}
+	c.outbox = o
+	return nil
+}
+
 /**
  * 使用当前客户端构建一个amq消息的目标队列名称，目标队列名称满足格式：sys_amq_{systemId}_{node}，
  * 其中{systemId}为目标系统的四位数数字ID，{node}为目标系统监听的amq节点标示(参考{@link AMQNode}。
@@ -118,7 +478,7 @@ func (c *Client) AddProcessor(processors ...Processor) {
  * @return
  */
 func (c *Client) BuildQueueName(systemId string) string {
-	if c.partitions > 1 {
+	if c.partitionsOf(systemId) > 1 {
 		log.Info().Msg("多分区节点请构建分区的队列名称")
 	}
 	return fmt.Sprintf("sys_amq_%s_%s", systemId, c.node.String())
@@ -134,10 +494,11 @@ func (c *Client) BuildQueueName(systemId string) string {
  * @return
  */
 func (c *Client) BuildQueueNameByPartition(systemId string, partition int) string {
-	if c.partitions > 1 {
+	partitions := c.partitionsOf(systemId)
+	if partitions <= 1 {
 		log.Error().Msg("单分区节点请构建单分区的队列名称")
 	}
-	if partition >= 0 && partition < c.partitions {
+	if partition < 0 || partition >= partitions {
 		log.Error().Msg("分区编号指定错误")
 	}
 	return fmt.Sprintf("sys_amq_%s_%s_p%d", systemId, c.node.String(), partition)
@@ -146,8 +507,11 @@ func (c *Client) BuildQueueNameByPartition(systemId string, partition int) strin
 /**
  * 在当前节点上启动进行本地系统的队列监听，该方法请务必在{@link #AddProcessor(...Processor)}方法之后调用，否则可能会导致部分消息
  * 由于没有对应的消息处理器而丢失。<font color="red">特别注意：如果收到的消息类型没有对应的消息处理器，系统只会简单的丢弃并打印告警信息！</font>
- * 同时注意，该方法只能被调用一次，如果多次调用则后续的调用会抛出异常。
+ * 同时注意，该方法只能成功调用一次，如果多次调用则后续的调用会抛出异常。
+ * 返回的closer会停止监听所有已监听的队列，任何一个队列监听失败时已经监听的队列会被关闭，并返回所有队列的监听错误，
+ * 各队列的监听状态可通过{@link #PartitionStatus}查看。启动失败时已经启动的组件都会被撤销，排除问题后可以再次调用该方法。
  *
+ * @param partitions 多分区节点需要监听的分区编号，为空时监听所有分区(配置了消费组时由消费组分配)
  * @throws error
  */
 func (c *Client) Start(partitions []int) (closer func(), err error) {
@@ -155,14 +519,88 @@ func (c *Client) Start(partitions []int) (closer func(), err error) {
 	if c.started {
 		return nil, fmt.Errorf("[AMQ-Client-%s]该客户端已启动，无法多次启动", c.node.String())
 	}
-	c.started = true
+	if err = c.checkOpen(); err != nil {
+		return nil, err
+	}
 	// 获取当前系统对当前节点的分区配置(可选)，如果配置了则只监听指定的分区，需要在/system/base/amq/{systemId}中按照如下格式配置:{"partitions":"1,2,3"}
 	for _, v := range partitions {
-		if v == 0 {
-			continue
+		if v < 0 || v >= c.partitions {
+			return nil, fmt.Errorf("[AMQ-Client-%s]本地节点监听的分区编号错误:%d", c.node.String(), v)
+		}
+	}
+	// 并发处理需要provider在处理完成时异步确认消息
+	if c.concurrency != nil {
+		if ad, ok := c.provider.(provider.AsyncDispatcher); !ok || !ad.SupportsAsync() {
+			return nil, fmt.Errorf("[AMQ-Client-%s]当前provider逐条同步确认消息，不支持并发处理配置(concurrency)", c.node.String())
+		}
+	}
+	c.started = true
+	// 任何一步失败时撤销已经启动的组件，客户端可以重新启动
+	defer func() {
+		if err != nil {
+			c.rollback()
+		}
+	}()
+	// 配置了事务超时时间则启动事务消息的超时检查
+	if c.txTimeout > 0 {
+		if c.txStore == nil {
+			c.txStore = NewMemoryTransactionStore()
+		}
+		c.tracker = newTransactionTracker(c, c.txStore, c.txTimeout, c.txRetention)
+		c.tracker.start()
+	}
+	// 配置了重放攻击防护则检查收到的每条消息
+	if rc := c.replayConfig; rc != nil {
+		window := rc.Window
+		if window <= 0 {
+			window = defaultReplayWindow
+		}
+		if c.nonceStore == nil {
+			c.nonceStore = NewMemoryNonceStore(rc.CacheSize)
+		}
+		capacity := rc.CacheSize
+		if capacity <= 0 {
+			capacity = defaultNonceCacheSize
+		}
+		c.replay = &replayGuard{client: c, window: time.Duration(window) * time.Second, store: c.nonceStore, capacity: capacity}
+	}
+	if c.dedupStore == nil && c.dedupConfig != nil {
+		c.dedupStore = NewMemoryDedupStore(c.dedupConfig.CacheSize)
+	}
+	// provider不支持延迟投递时启动调度器，未配置延迟消息存储时不启动，延迟投递的消息发送失败，避免进程退出后丢失
+	if ds, ok := c.provider.(provider.DelaySender); !ok || !ds.SupportsDelay() {
+		store := c.scheduleStore
+		if store == nil && c.scheduleConfig != nil && len(c.scheduleConfig.Path) > 0 {
+			if store, err = NewFileScheduleStore(c.scheduleConfig.Path); err != nil {
+				return nil, err
+			}
+		}
+		if store != nil {
+			c.scheduler = newScheduler(c, store, c.scheduleConfig)
+			c.scheduler.start()
+		} else {
+			log.Info().Msgf("[AMQ-Client-%s]provider不支持延迟投递并且未配置延迟消息存储，无法发送延迟投递的消息", c.node.String())
+		}
+	}
+	if c.outbox != nil {
+		c.outbox.start()
+	}
+	// 配置了死信队列则同时监听死信队列，保存收到的死信
+	if dc := c.deadLetterConfig; dc != nil {
+		dlq := &deadLetterQueue{client: c, queue: dc.Queue, maxAttempts: dc.MaxAttempts, expired: dc.Expired, store: c.deadLetterStore}
+		if len(dlq.queue) == 0 {
+			dlq.queue = c.defaultDeadLetterQueueName()
 		}
-		if v <= 0 && c.partitions > v {
-			panic("本地节点监听的分区编号错误：" + utils.ToStr(v))
+		if dlq.maxAttempts <= 0 {
+			dlq.maxAttempts = defaultDeadLetterMaxAttempts
+		}
+		if dlq.store == nil {
+			dlq.store = NewMemoryDeadLetterStore(dc.CacheSize)
+		}
+		c.deadLetters = dlq
+		log.Info().Msgf("[AMQ-Client-%s]启动监听AMQ死信队列:queue=%s", c.node.String(), dlq.queue)
+		if err = c.listen(dlq.queue, -1, &deadLetterListener{queue: dlq}); err != nil {
+			return nil, err
 		}
 	}
 	listener := &defaultMessageListener{
@@ -173,30 +611,75 @@ func (c *Client) Start(partitions []int) (closer func(), err error) {
 			}
 			return processor
 		},
-		node: c.node,
+		node:   c.node,
+		client: c,
 	}
 
 	// 监听当前系统在AMQ节点上的队列，如果有分区则按照分区分队列控制，另外，如果本地配置了启动分区编号则只监听指定的分区队列
 	if c.partitions == 1 {
 		queueName := c.BuildQueueName(c.systemId)
 		log.Info().Msgf("[AMQ-Client-%s]启动监听AMQ单分区消息队列:queue=%s", c.node.String(), queueName)
-		closer, err = c.provider.Listen(queueName, listener)
-	} else {
-		if len(partitions) == 0 {
-			for i := 0; i < c.partitions; i++ {
-				queueName := c.BuildQueueNameByPartition(c.systemId, i)
-				log.Info().Msgf("[AMQ-Client-%s]启动监听AMQ多分区消息队列:partition=%d,queue=%s", c.node.String(), i, queueName)
-				closer, err = c.provider.Listen(queueName, listener)
+		err = c.listen(queueName, -1, listener)
+	} else if len(partitions) == 0 && (c.groupConfig != nil || c.coordinator != nil) {
+		// 加入消费组，由存活的实例自动分配分区
+		cfg := c.groupConfig
+		if cfg == nil {
+			cfg = &GroupConfig{}
+		}
+		coordinator := c.coordinator
+		if coordinator == nil {
+			path := cfg.Path
+			if len(path) == 0 {
+				path = filepath.Join(os.TempDir(), "amq", "group")
 			}
-		} else {
-			for _, v := range partitions {
-				queueName := c.BuildQueueNameByPartition(c.systemId, v)
-				log.Info().Msgf("[AMQ-Client-%s]启动监听AMQ多分区消息队列:partition=%d,queue=%s", c.node.String(), v, queueName)
-				closer, err = c.provider.Listen(queueName, listener)
+			if coordinator, err = NewFileCoordinator(path); err != nil {
+				return nil, err
+			}
+		}
+		c.group = newGroupMember(c, coordinator, cfg, listener)
+		err = c.group.start()
+	} else if len(partitions) == 0 {
+		all := make([]int, c.partitions)
+		for i := range all {
+			all[i] = i
+		}
+		err = c.listenPartitions(all, listener)
+	} else {
+		err = c.listenPartitions(partitions, listener)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.unlistenAll, nil
+}
+
+/**
+ * 撤销{@link #Start}中已经启动的组件并恢复到未启动的状态，通过Set*方法设置的存储保持打开，以便重新启动时继续使用。
+ */
+func (c *Client) rollback() {
+	// 保留各队列的监听状态，以便通过PartitionStatus查看失败的原因
+	c.unlistenAll()
+	c.group = nil
+	if c.tracker != nil {
+		c.tracker.halt()
+		c.tracker = nil
+	}
+	c.replay = nil
+	if c.scheduler != nil {
+		c.scheduler.halt()
+		// 根据配置的路径打开的文件存储在重新启动时会再次打开
+		if c.scheduler.store != c.scheduleStore {
+			if err := c.scheduler.store.Close(); err != nil {
+				log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭延迟消息存储失败", c.node.String())
 			}
 		}
+		c.scheduler = nil
+	}
+	if c.outbox != nil {
+		c.outbox.close()
 	}
-	return
+	c.deadLetters = nil
+	c.started = false
 }
 
 /**
@@ -216,23 +699,34 @@ func (c *Client) IsMultiplePartition() bool {
 
 func (c *Client) messageCheck(msg interface{}) (interface{}, error) {
 	nameList := make([]string, 0)
-	switch msg.(type) {
+	// 在消息的副本上选择分区，不修改调用方的消息，同一条消息再次发送时重新选择分区
+	switch m := msg.(type) {
 	case *message.NoticeMessage:
-		msg := msg.(*message.NoticeMessage)
-		nameList = append(nameList, msg.Destination)
+		routed := *m
+		c.route(routed.PartitionKey, &routed.Destination)
+		nameList = append(nameList, routed.Destination)
+		msg = &routed
 	case *message.SimplexMessage:
-		msg := msg.(*message.SimplexMessage)
-		nameList = append(nameList, msg.Source)
-		nameList = append(nameList, msg.Destination)
+		routed := *m
+		c.route(routed.PartitionKey, &routed.Destination)
+		nameList = append(nameList, routed.Source)
+		nameList = append(nameList, routed.Destination)
+		msg = &routed
 	case *message.DuplexMessage:
-		msg := msg.(*message.DuplexMessage)
-		nameList = append(nameList, msg.Source)
-		nameList = append(nameList, msg.DestinationNew)
-		nameList = append(nameList, msg.DestinationAck)
+		routed := *m
+		c.route(routed.PartitionKey, &routed.DestinationNew, &routed.DestinationAck)
+		nameList = append(nameList, routed.Source)
+		nameList = append(nameList, routed.DestinationNew)
+		nameList = append(nameList, routed.DestinationAck)
+		msg = &routed
 	}
-	// 检查名称规范
+	// 检查名称规范，按照队列所属系统的分区数量检查
 	for _, name := range nameList {
-		m := c.queueNamePattern.FindStringSubmatch(name)
+		pattern := c.queueNamePattern
+		if m := queueSystemPattern.FindStringSubmatch(name); m != nil {
+			pattern = queueNamePattern(c.partitionsOf(m[1]))
+		}
+		m := pattern.FindStringSubmatch(name)
 		if len(m) == 0 {
 			return nil, fmt.Errorf("AMQ消息队列名称不符合规范:%s", name)
 		} else {
@@ -245,6 +739,43 @@ func (c *Client) messageCheck(msg interface{}) (interface{}, error) {
 	return msg, nil
 }
 
+/**
+ * 将消息转换为{@link message.MsgPayload}并封装。
+ */
+func (c *Client) payload(msg interface{}) (*message.MsgPayload, error) {
+	mpl, err := message.ToPayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.seal(mpl); err != nil {
+		return nil, err
+	}
+	return mpl, nil
+}
+
+/**
+ * 按照当前节点的配置依次压缩和加密消息体，然后签名，使签名覆盖实际传输的内容。
+ */
+func (c *Client) seal(mpl *message.MsgPayload) error {
+	if err := message.Compress(mpl, c.compressor, c.compressMinSize); err != nil {
+		return err
+	}
+	if err := c.encryptor.encrypt(mpl); err != nil {
+		return err
+	}
+	return c.signer.Sign(mpl)
+}
+
+/**
+ * {@link #seal}的逆操作，签名校验通过后依次解密和解压消息体。
+ */
+func (c *Client) open(mpl *message.MsgPayload) error {
+	if err := c.encryptor.decrypt(mpl); err != nil {
+		return err
+	}
+	return message.Decompress(mpl)
+}
+
 /**
  * 发送新消息到AMQ中，这里是所有新消息的发送入口，如果发送失败则会抛出异常。请注意，消息的目标队列名称请使用
  * 方法 {@link #buildQueueName(long, String, int)} 来构建并设置，不满足格式的目标队列名称会导致消息发送失败。
@@ -253,22 +784,94 @@ func (c *Client) messageCheck(msg interface{}) (interface{}, error) {
  * @throws AMQException
  */
 func (c *Client) Send(msg interface{}) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
 	msg, err := c.messageCheck(msg)
 	if err != nil {
 		return err
 	}
-	// 发送消息
-	if err = c.provider.Send(msg); err == nil {
+	mpl, err := c.payload(msg)
+	if err != nil {
+		return err
+	}
+	if scheduled, err := c.schedule(mpl); scheduled {
+		return err
+	}
+	// 先记录事务消息再发送，避免应答消息先于记录到达
+	if c.tracker != nil {
+		if err = c.tracker.begin(mpl); err != nil {
+			return err
+		}
+	}
+	// 发送消息，失败时按照重试策略重试
+	if err = c.sendWithRetry(mpl); err == nil {
 		log.Debug().Msgf("[AMQ-Client-%s]消息发送成功:%+v", c.node.String(), msg)
+	} else {
+		c.tracker.cancel(mpl.MsgId)
+	}
+	return err
+}
+
+/**
+ * 在业务系统的数据库事务中发送新消息，消息和业务数据一起提交或回滚。如果通过{@link #SetOutbox}设置了发件箱则将消息写入发件箱表，
+ * 事务提交后由后台任务转发；否则要求当前节点的provider实现了{@link provider.TxSender}接口，并且该事务和provider连接的是同一个数据库。
+ * 通过发件箱发送的事务消息在转发时开始等待应答，通过provider发送的事务消息在写入后立即开始等待应答，如果业务事务随后回滚，
+ * 该消息会在等待超时后回调{@link TransactionTimeoutProcessor}，处理器可根据业务数据忽略不存在的消息。
+ *
+ * @param tx
+ * @param message
+ * @throws AMQException
+ */
+func (c *Client) SendInTx(tx *sql.Tx, msg interface{}) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	if c.outbox != nil {
+		msg, err := c.messageCheck(msg)
+		if err != nil {
+			return err
+		}
+		mpl, err := message.ToPayload(msg)
+		if err != nil {
+			return err
+		}
+		if err = c.outbox.add(tx, mpl); err == nil {
+			log.Debug().Msgf("[AMQ-Client-%s]消息已写入发件箱:%+v", c.node.String(), msg)
+		}
+		return err
+	}
+	ts, ok := c.provider.(provider.TxSender)
+	if !ok {
+		return fmt.Errorf("[AMQ-Client-%s]当前provider不支持事务消息发送，请设置发件箱", c.node.String())
+	}
+	msg, err := c.messageCheck(msg)
+	if err != nil {
+		return err
+	}
+	mpl, err := c.payload(msg)
+	if err != nil {
+		return err
+	}
+	if err = c.tracker.begin(mpl); err != nil {
+		return err
+	}
+	if err = ts.SendTx(tx, mpl); err == nil {
+		log.Debug().Msgf("[AMQ-Client-%s]事务内消息发送成功:%+v", c.node.String(), msg)
+	} else {
+		c.tracker.cancel(mpl.MsgId)
 	}
 	return err
 }
 
 /**
- * 关闭所有的资源，该方法不会抛出任何异常。
+ * 关闭所有的资源，该方法不会抛出任何异常，最多等待{@link defaultCloseTimeout}让处理中的消息完成，需要指定等待时间时请使用{@link #Shutdown}。
+ * 不要在处理器的回调中同步调用该方法，参看{@link #Shutdown}。
  */
 func (c *Client) Close() {
-	c.provider.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	_, _ = c.Shutdown(ctx)
 }
 
 /**
@@ -311,34 +914,97 @@ type Processor interface {
 
 type defaultMessageListener struct {
 	node      node.Node
+	client    *Client
 	processor func(genre string) Processor
+	pool      *workerPool // 配置了并发处理时为当前队列的协程池
 }
 
 func (l *defaultMessageListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
 	log.Debug().Msgf("[AMQ-Client-%s]收到新消息:%v", l.node.String(), msg)
+	received := nowMillis()
+	msgId := message.GetMsgId(msg)
+	if record, ok := l.processed(msgId, string(message.SenderReq)); ok {
+		return record.Ack, nil
+	}
 	processor := l.processor(message.GetGenre(msg))
 	if processor != nil {
-		return processor.OnReceived(msg)
+		rsp, err := processor.OnReceived(msg)
+		if err == nil {
+			l.remember(msgId, string(message.SenderReq), rsp)
+		}
+		// 双向事务的接收方应答后开始等待发送方的确认应答
+		if _, ok := msg.(*message.DuplexMessage); ok && rsp != nil && l.client.tracker != nil {
+			if terr := l.client.tracker.awaitSenderAck(message.GetGenre(msg), msgId, received); terr != nil {
+				log.Error().Err(terr).Msgf("[AMQ-Client-%s]保存事务记录失败:msgId=%s", l.node.String(), message.GetMsgId(msg))
+			}
+		}
+		return rsp, err
 	} else {
-		return nil, fmt.Errorf("此类型AMQ消息的处理器接口定义:无")
+		return nil, errNoProcessor
 	}
 }
 
 func (l *defaultMessageListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
 	log.Debug().Msgf("[AMQ-Client-%s]收到接收方应答消息：type=%s,msgId=%s,rsp=%v", l.node.String(), genre, msgId, rsp)
+	l.client.tracker.complete(msgId, string(message.ReceiverAck))
+	if record, ok := l.processed(msgId, string(message.ReceiverAck)); ok {
+		return record.Ack, nil
+	}
+	if reply := l.client.takeReply(msgId); reply != nil {
+		// 同步请求的应答，如果定义了处理器则仍然回调以便业务系统记录
+		var (
+			ack *message.MsgBody
+			err error
+		)
+		if processor := l.client.processorMap[genre]; processor != nil {
+			ack, err = processor.OnRecipientAckReceived(msgId, rsp)
+		}
+		reply <- rsp
+		if err == nil {
+			l.remember(msgId, string(message.ReceiverAck), ack)
+		}
+		return ack, err
+	}
 	processor := l.processor(genre)
 	if processor != nil {
-		return processor.OnRecipientAckReceived(msgId, rsp)
+		ack, err := processor.OnRecipientAckReceived(msgId, rsp)
+		if err == nil {
+			l.remember(msgId, string(message.ReceiverAck), ack)
+		}
+		return ack, err
 	} else {
-		return nil, fmt.Errorf("此类型AMQ消息的处理器接口定义:无")
+		return nil, errNoProcessor
 	}
 }
 func (l *defaultMessageListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
 	log.Debug().Msgf("[AMQ-Client-%s]收到发送方应答消息:type=%s,msgId=%s,rsp=%v", l.node.String(), genre, msgId, rsp)
+	l.client.tracker.complete(msgId, string(message.SenderAck))
+	if _, ok := l.processed(msgId, string(message.SenderAck)); ok {
+		return nil
+	}
 	processor := l.processor(genre)
 	if processor != nil {
-		return processor.OnSenderAckReceived(msgId, rsp)
+		err := processor.OnSenderAckReceived(msgId, rsp)
+		if err == nil {
+			l.remember(msgId, string(message.SenderAck), nil)
+		}
+		return err
 	} else {
 		return nil
 	}
 }
+
+/**
+ * 将签名校验失败或发送时间超出重放窗口的消息原样转发到隔离队列，便于后续排查。
+ */
+func (c *Client) quarantine(mpl *message.MsgPayload, cause error) {
+	log.Error().Err(cause).Msgf("[AMQ-Client-%s]拒绝无法校验的消息:type=%s,msgId=%s", c.node.String(), mpl.Genre, mpl.MsgId)
+	if len(c.quarantineQueue) == 0 || mpl.Forward == c.quarantineQueue {
+		return
+	}
+	forward := *mpl
+	forward.Forward = c.quarantineQueue
+	if err := c.provider.Send(&forward); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]转发消息到隔离队列失败:queue=%s,msgId=%s", c.node.String(), c.quarantineQueue, mpl.MsgId)
+	}
+}
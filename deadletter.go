@@ -0,0 +1,654 @@
+package amq
+
+import (
+	"bufio"
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq/internal/sqldialect"
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 死信队列配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "maxAttempts" : 3,   // 未配置重试策略时每条消息最多处理的次数(默认3)，按默认的重试间隔退避，仍然失败时转发到死信队列
+ *   "queue" : "",        // 死信队列名称(可选)，默认为sys_amq_{systemId}_{node}_dlq
+ *   "cacheSize" : 10000, // 内存中最多保存的死信数量(默认10000)
+ *   "expired" : false    // 是否将过期的消息转发到死信队列(默认false，直接丢弃)
+ * }
+ * </pre>
+ * 客户端启动后会同时监听死信队列，收到的死信保存在{@link DeadLetterStore}中，可通过{@link Client#ListDeadLetters}等方法查看和重新投递。
+ */
+type DeadLetterConfig struct {
+	MaxAttempts int    `json:"maxAttempts"`
+	Queue       string `json:"queue"`
+	CacheSize   int    `json:"cacheSize"`
+	Expired     bool   `json:"expired"`
+}
+
+const (
+	defaultDeadLetterMaxAttempts = 3
+	defaultDeadLetterCacheSize   = 10000
+	defaultDeadLetterTable       = "amq_dead_letter"
+	deadLetterCompactThreshold   = 1024
+)
+
+var errNoProcessor = errors.New("此类型AMQ消息的处理器接口定义:无")
+
+/**
+ * 死信队列中的一条消息，Payload为收到时的原始消息(保持压缩、加密和签名)，{@link MsgPayload#Failure}中记录了处理失败的信息。
+ */
+type DeadLetter struct {
+	Id      string              `json:"id"` // 消息ID和阶段，格式为{msgId}@{phase}
+	Payload *message.MsgPayload `json:"payload,omitempty"`
+	Time    int64               `json:"time"` // 进入死信队列的时间(毫秒)
+}
+
+/**
+ * 死信的存储接口，内置了内存、本地文件和数据库三种实现，也可自行实现后通过{@link Client#SetDeadLetterStore}设置。
+ */
+type DeadLetterStore interface {
+	/**
+	 * 保存死信，相同ID的死信会被替换。
+	 */
+	Save(letter *DeadLetter) error
+
+	/**
+	 * 按照进入死信队列的先后顺序分页列出死信。
+	 */
+	List(offset, limit int) ([]*DeadLetter, error)
+
+	/**
+	 * 获取指定ID的死信，不存在时返回nil。
+	 */
+	Get(id string) (*DeadLetter, error)
+
+	Remove(id string) error
+
+	Close() error
+}
+
+/**
+ * 基于内存的死信存储，最多保存capacity条死信，超出时丢弃最早的死信。
+ */
+type memoryDeadLetterStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // 按照进入死信队列的顺序排列
+	letters  map[string]*list.Element
+}
+
+func NewMemoryDeadLetterStore(capacity int) DeadLetterStore {
+	return newMemoryDeadLetterStore(capacity)
+}
+
+func newMemoryDeadLetterStore(capacity int) *memoryDeadLetterStore {
+	if capacity <= 0 {
+		capacity = defaultDeadLetterCacheSize
+	}
+	return &memoryDeadLetterStore{capacity: capacity, order: list.New(), letters: make(map[string]*list.Element)}
+}
+
+func (s *memoryDeadLetterStore) Save(letter *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(letter)
+	return nil
+}
+
+/**
+ * 调用方需持有s.mu。
+ */
+func (s *memoryDeadLetterStore) put(letter *DeadLetter) {
+	s.remove(letter.Id)
+	s.letters[letter.Id] = s.order.PushBack(letter)
+	for s.order.Len() > s.capacity {
+		front := s.order.Front()
+		dropped := front.Value.(*DeadLetter)
+		s.order.Remove(front)
+		delete(s.letters, dropped.Id)
+		log.Warn().Msgf("[AMQ]死信数量超过上限，丢弃最早的死信:id=%s", dropped.Id)
+	}
+}
+
+/**
+ * 调用方需持有s.mu。
+ */
+func (s *memoryDeadLetterStore) remove(id string) bool {
+	e, ok := s.letters[id]
+	if ok {
+		s.order.Remove(e)
+		delete(s.letters, id)
+	}
+	return ok
+}
+
+func (s *memoryDeadLetterStore) List(offset, limit int) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letters := make([]*DeadLetter, 0)
+	i := 0
+	for e := s.order.Front(); e != nil && (limit <= 0 || len(letters) < limit); e = e.Next() {
+		if i >= offset {
+			letters = append(letters, e.Value.(*DeadLetter))
+		}
+		i++
+	}
+	return letters, nil
+}
+
+func (s *memoryDeadLetterStore) Get(id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.letters[id]; ok {
+		return e.Value.(*DeadLetter), nil
+	}
+	return nil, nil
+}
+
+func (s *memoryDeadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	return nil
+}
+
+func (s *memoryDeadLetterStore) Close() error {
+	return nil
+}
+
+/**
+ * 基于本地文件的死信存储，每次变更以一行JSON追加写入文件(删除时只记录ID)，进程重启后重新加载，变更增长到一定程度后自动压缩文件。
+ */
+type fileDeadLetterStore struct {
+	*memoryDeadLetterStore
+	path    string
+	file    *os.File
+	written int
+}
+
+/**
+ * 打开指定路径的死信存储文件，文件不存在时自动创建。
+ *
+ * @param path
+ * @param capacity 最多保存的死信数量，小于等于0时使用默认值
+ * @return
+ */
+func NewFileDeadLetterStore(path string, capacity int) (DeadLetterStore, error) {
+	s := &fileDeadLetterStore{memoryDeadLetterStore: newMemoryDeadLetterStore(capacity), path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileDeadLetterStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		letter := new(DeadLetter)
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			// 忽略进程异常退出时未写完整的记录
+			continue
+		}
+		if letter.Payload == nil {
+			s.remove(letter.Id)
+		} else {
+			s.put(letter)
+		}
+	}
+	return scanner.Err()
+}
+
+/**
+ * 将当前所有死信写入临时文件后原子替换，调用方需持有s.mu。
+ */
+func (s *fileDeadLetterStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		data, err := json.Marshal(e.Value)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	s.written = s.order.Len()
+	return nil
+}
+
+/**
+ * 追加一条变更，调用方需持有s.mu。
+ */
+func (s *fileDeadLetterStore) append(letter *DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.written++
+	if s.written > 2*s.order.Len()+deadLetterCompactThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *fileDeadLetterStore) Save(letter *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(letter)
+	return s.append(letter)
+}
+
+func (s *fileDeadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.remove(id) {
+		return nil
+	}
+	return s.append(&DeadLetter{Id: id})
+}
+
+func (s *fileDeadLetterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+/**
+ * 基于关系型数据库的死信存储，适用于多个实例共享死信的场景。
+ */
+type sqlDeadLetterStore struct {
+	db      *sql.DB
+	dialect *sqldialect.Dialect
+	table   string
+}
+
+/**
+ * 使用给定的数据库连接创建死信存储，死信表不存在时自动创建。
+ *
+ * @param db
+ * @param dialect SQL方言，postgres、mysql或sqlite
+ * @param table   死信表名，为空时使用amq_dead_letter
+ * @return
+ */
+func NewSQLDeadLetterStore(db *sql.DB, dialect, table string) (DeadLetterStore, error) {
+	if len(table) == 0 {
+		table = defaultDeadLetterTable
+	}
+	if !sqlTablePattern.MatchString(table) {
+		return nil, fmt.Errorf("无效的死信表名:%s", table)
+	}
+	d, err := sqldialect.Get(dialect, "")
+	if err != nil {
+		return nil, err
+	}
+	schema := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(128) NOT NULL PRIMARY KEY, payload %s NOT NULL, created_at BIGINT NOT NULL)%s",
+		table, d.Text, d.TableOptions)
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("创建死信表失败:%v", err)
+	}
+	return &sqlDeadLetterStore{db: db, dialect: d, table: table}, nil
+}
+
+func (s *sqlDeadLetterStore) Save(letter *DeadLetter) error {
+	data, err := message.Marshal(message.JSONCodec, letter.Payload)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(s.dialect.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table)), letter.Id); err != nil {
+		return err
+	}
+	query := s.dialect.Rebind(fmt.Sprintf("INSERT INTO %s (id, payload, created_at) VALUES (?, ?, ?)", s.table))
+	if _, err = tx.Exec(query, letter.Id, string(data), letter.Time); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlDeadLetterStore) List(offset, limit int) ([]*DeadLetter, error) {
+	if limit <= 0 {
+		limit = defaultDeadLetterCacheSize
+	}
+	query := s.dialect.Rebind(fmt.Sprintf("SELECT id, payload, created_at FROM %s ORDER BY created_at, id LIMIT ? OFFSET ?", s.table))
+	rows, err := s.db.Query(query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	letters := make([]*DeadLetter, 0)
+	for rows.Next() {
+		letter, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (s *sqlDeadLetterStore) Get(id string) (*DeadLetter, error) {
+	query := s.dialect.Rebind(fmt.Sprintf("SELECT id, payload, created_at FROM %s WHERE id = ?", s.table))
+	letter, err := s.scan(s.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return letter, err
+}
+
+func (s *sqlDeadLetterStore) scan(row interface{ Scan(...interface{}) error }) (*DeadLetter, error) {
+	var (
+		letter  DeadLetter
+		payload string
+		err     error
+	)
+	if err = row.Scan(&letter.Id, &payload, &letter.Time); err != nil {
+		return nil, err
+	}
+	if letter.Payload, err = message.Unmarshal([]byte(payload)); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func (s *sqlDeadLetterStore) Remove(id string) error {
+	_, err := s.db.Exec(s.dialect.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table)), id)
+	return err
+}
+
+func (s *sqlDeadLetterStore) Close() error {
+	return nil
+}
+
+/**
+ * 当前节点的死信队列，负责转发处理失败的消息以及保存从死信队列中收到的消息。
+ */
+type deadLetterQueue struct {
+	client      *Client
+	queue       string
+	maxAttempts int
+	expired     bool // 是否转发过期的消息
+	store       DeadLetterStore
+}
+
+/**
+ * 将处理失败的原始消息连同失败信息转发到死信队列，转发失败时返回原来的错误。
+ */
+func (q *deadLetterQueue) send(sealed *message.MsgPayload, failure *message.Failure, cause error) error {
+	if q == nil {
+		return cause
+	}
+	forward := *sealed
+	forward.Failure = failure
+	forward.Forward = q.queue
+	failure.Queue, _ = sealed.SendQueueName()
+	if err := q.client.provider.Send(&forward); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]转发消息到死信队列失败:queue=%s,msgId=%s", q.client.node.String(), q.queue, sealed.MsgId)
+		return cause
+	}
+	log.Warn().Err(cause).Msgf("[AMQ-Client-%s]消息处理失败，已转发到死信队列:type=%s,msgId=%s,attempts=%d", q.client.node.String(), sealed.Genre, sealed.MsgId, failure.Attempts)
+	return nil
+}
+
+/**
+ * 校验从死信队列中收到的消息的原始签名后保存，签名校验失败的消息不保存，配置了隔离队列时转发到隔离队列，
+ * 避免能够向死信队列写入消息的第三方占满死信存储或者伪造死信后经{@link Client#RequeueDeadLetter}以本系统的密钥重新签名发出。
+ */
+func (q *deadLetterQueue) receive(mpl *message.MsgPayload) error {
+	if err := q.client.signer.Verify(mpl); err != nil {
+		q.client.quarantine(mpl, err)
+		return err
+	}
+	return q.store.Save(&DeadLetter{Id: nonceOf(mpl), Payload: mpl, Time: nowMillis()})
+}
+
+func (q *deadLetterQueue) close() {
+	if err := q.store.Close(); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭死信存储失败", q.client.node.String())
+	}
+}
+
+/**
+ * 死信队列的监听器，收到的消息由{@link Dispatch}直接交给{@link deadLetterQueue#receive}校验后保存。
+ */
+type deadLetterListener struct {
+	queue *deadLetterQueue
+}
+
+func (l *deadLetterListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	return nil, fmt.Errorf("死信队列不处理消息")
+}
+
+func (l *deadLetterListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, fmt.Errorf("死信队列不处理消息")
+}
+
+func (l *deadLetterListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
+	return fmt.Errorf("死信队列不处理消息")
+}
+
+/**
+ * 处理消息，失败时按照消息类型的重试策略重试，没有配置重试策略时按照死信队列配置的次数和默认的重试间隔重试，仍然失败则将原始消息转发到死信队列。
+ * 重试期间会阻塞当前队列的后续消息，以保证消息的处理顺序；客户端关闭超时后不再等待重试间隔，再次失败即转发到死信队列。
+ *
+ * @param msg    已解密和解压的消息
+ * @param sealed 收到时的原始消息
+ * @return
+ */
+func (l *defaultMessageListener) handle(msg, sealed *message.MsgPayload) (*message.MsgPayload, error) {
+	dlq := l.client.deadLetters
+	policy := l.client.retryPolicy(msg.Genre)
+	maxAttempts := 1
+	if policy != nil {
+		maxAttempts = policy.MaxAttempts
+	} else if dlq != nil {
+		maxAttempts = dlq.maxAttempts
+	}
+	var failure *message.Failure
+	for {
+		var (
+			rsp *message.MsgPayload
+			err error
+		)
+		if msg.Phase == message.SenderReq {
+			rsp, err = HandleNew(msg, l)
+		} else {
+			rsp, err = HandleAck(msg, l)
+		}
+		if err == nil {
+			return rsp, nil
+		}
+		now := nowMillis()
+		if failure == nil {
+			failure = &message.Failure{FirstFailedAt: now}
+		}
+		failure.Attempts++
+		failure.LastFailedAt = now
+		failure.Error = err.Error()
+		if failure.Attempts >= maxAttempts || errors.Is(err, errNoProcessor) || (policy != nil && !policy.retryable(err)) || l.client.isAbandoned() {
+			// 处理失败的消息允许重新投递或从死信队列重新投递后再次处理
+			l.client.replay.forget(msg)
+			if err = dlq.send(sealed, failure, err); err == nil {
+				return nil, nil
+			}
+			return rsp, err
+		}
+		// 没有配置重试策略时按照默认的重试间隔退避，避免立即重新处理
+		backoff := policy
+		if backoff == nil {
+			backoff = RetryPolicy{}.normalize()
+		}
+		delay := backoff.delay(failure.Attempts)
+		log.Warn().Err(err).Msgf("[AMQ-Client-%s]消息处理失败，%v后重新处理:type=%s,msgId=%s,attempts=%d", l.node.String(), delay, msg.Genre, msg.MsgId, failure.Attempts)
+		l.client.wait(delay)
+	}
+}
+
+/**
+ * 获取当前节点的死信队列名称。
+ *
+ * @return
+ */
+func (c *Client) DeadLetterQueueName() string {
+	if c.deadLetters != nil {
+		return c.deadLetters.queue
+	}
+	return c.defaultDeadLetterQueueName()
+}
+
+func (c *Client) defaultDeadLetterQueueName() string {
+	return fmt.Sprintf("sys_amq_%s_%s_dlq", c.systemId, c.node.String())
+}
+
+func (c *Client) deadLetterQueueStore() (DeadLetterStore, error) {
+	if c.deadLetters == nil {
+		return nil, fmt.Errorf("[AMQ-Client-%s]未配置死信队列或客户端未启动", c.node.String())
+	}
+	return c.deadLetters.store, nil
+}
+
+/**
+ * 按照进入死信队列的先后顺序分页列出死信，消息体保持收到时的状态(可能被压缩或加密)，查看消息体请使用{@link #InspectDeadLetter}。
+ *
+ * @param offset
+ * @param limit 小于等于0时不限制数量
+ * @return
+ */
+func (c *Client) ListDeadLetters(offset, limit int) ([]*DeadLetter, error) {
+	store, err := c.deadLetterQueueStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.List(offset, limit)
+}
+
+/**
+ * 获取指定的死信并校验签名后解密和解压消息体，不存在时返回nil。
+ *
+ * @param id 死信ID，格式为{msgId}@{phase}
+ * @return
+ */
+func (c *Client) InspectDeadLetter(id string) (*DeadLetter, error) {
+	store, err := c.deadLetterQueueStore()
+	if err != nil {
+		return nil, err
+	}
+	letter, err := store.Get(id)
+	if err != nil || letter == nil {
+		return letter, err
+	}
+	mpl := *letter.Payload
+	if err = c.signer.Verify(&mpl); err != nil {
+		return nil, err
+	}
+	if err = c.open(&mpl); err != nil {
+		return nil, err
+	}
+	return &DeadLetter{Id: letter.Id, Payload: &mpl, Time: letter.Time}, nil
+}
+
+/**
+ * 将指定的死信重新投递到原来的队列中并从死信存储中删除，消息会以当前时间重新封装和签名。
+ * 原始签名校验失败的死信(如升级前保存的伪造消息)拒绝重新投递，返回{@link message.SignatureError}。
+ *
+ * @param id 死信ID，格式为{msgId}@{phase}
+ * @return
+ */
+func (c *Client) RequeueDeadLetter(id string) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	letter, err := c.InspectDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	if letter == nil {
+		return fmt.Errorf("[AMQ-Client-%s]死信不存在:%s", c.node.String(), id)
+	}
+	mpl := letter.Payload
+	mpl.Forward = ""
+	mpl.Failure = nil
+	// 过期的消息重新投递时不再受过期时间限制
+	mpl.ExpiresAt = 0
+	mpl.SendTime = time.Now().Unix()
+	if err = c.seal(mpl); err != nil {
+		return err
+	}
+	if err = c.provider.Send(mpl); err != nil {
+		return err
+	}
+	log.Info().Msgf("[AMQ-Client-%s]死信已重新投递:id=%s", c.node.String(), id)
+	return c.deadLetters.store.Remove(id)
+}
+
+/**
+ * 从死信存储中删除指定的死信。
+ *
+ * @param id 死信ID，格式为{msgId}@{phase}
+ * @return
+ */
+func (c *Client) RemoveDeadLetter(id string) error {
+	store, err := c.deadLetterQueueStore()
+	if err != nil {
+		return err
+	}
+	return store.Remove(id)
+}
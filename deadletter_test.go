@@ -0,0 +1,97 @@
+package amq_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+)
+
+/**
+ * 等待死信存储中的死信数量达到want并返回这些死信。
+ */
+func waitDeadLetters(t *testing.T, c *amq.Client, want int) []*amq.DeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters, err := c.ListDeadLetters(0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) == want {
+			return letters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("死信数量为%d，期望为%d", len(letters), want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func notice(c *amq.Client, systemId string) *message.MsgPayload {
+	nm := message.NewNoticeMessage(c.NewMsgId())
+	nm.SetType("dlq")
+	nm.SetBody(message.NewMessageBody().Add("k", "v"))
+	nm.Destination = c.BuildQueueName(systemId)
+	return message.NoticePayload(nm)
+}
+
+func TestRequeueDeadLetter(t *testing.T) {
+	c := newTestClient(t, "1097", `{"provider":"memory","deadLetter":{"maxAttempts":1}}`)
+	p := newTestProcessor("dlq", 1)
+	startClient(t, c, p)
+	mpl := notice(c, "1097")
+	if err := newRawProvider(t).Send(mpl); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, p.received, mpl.MsgId)
+	letters := waitDeadLetters(t, c, 1)
+	if f := letters[0].Payload.Failure; f == nil || f.Attempts != 1 || f.Queue != mpl.DstNewQueue {
+		t.Fatalf("死信的失败信息错误:%+v", f)
+	}
+	// 重新投递后处理成功，死信被删除
+	if err := c.RequeueDeadLetter(letters[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, p.received, mpl.MsgId)
+	waitDeadLetters(t, c, 0)
+}
+
+func TestForgedDeadLetterRejected(t *testing.T) {
+	c := newTestClient(t, "1098", `{"provider":"memory","deadLetter":{"maxAttempts":1}}`)
+	store := amq.NewMemoryDeadLetterStore(10)
+	c.SetDeadLetterStore(store)
+	startClient(t, c, newTestProcessor("dlq", 0))
+	raw := newRawProvider(t)
+
+	// 直接写入死信队列的伪造消息不保存，随后写入的签名正确的消息正常保存
+	forged := notice(c, "1098")
+	forged.Body.Add("k", "forged")
+	valid := notice(c, "1098")
+	for _, mpl := range []*message.MsgPayload{forged, valid} {
+		mpl.Forward = c.DeadLetterQueueName()
+		if err := raw.Send(mpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if letters := waitDeadLetters(t, c, 1); letters[0].Payload.MsgId != valid.MsgId {
+		t.Fatalf("保存了伪造的死信:%s", letters[0].Payload.MsgId)
+	}
+
+	// 存储中已有的伪造死信拒绝重新投递
+	planted := notice(c, "1098")
+	planted.Sign = "forged"
+	id := planted.MsgId + "@" + planted.Phase.String()
+	if err := store.Save(&amq.DeadLetter{Id: id, Payload: planted}); err != nil {
+		t.Fatal(err)
+	}
+	var signature *message.SignatureError
+	if err := c.RequeueDeadLetter(id); !errors.As(err, &signature) {
+		t.Fatalf("伪造的死信应拒绝重新投递:%v", err)
+	}
+	if letter, err := store.Get(id); err != nil || letter == nil {
+		t.Fatalf("拒绝重新投递的死信不应被删除:%v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package amq
+
+import (
+	"bufio"
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/aluka-7/amq/internal/sqldialect"
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 消息去重配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "cacheSize" : 100000  // 内存中最多记录的已处理消息数量(默认100000)
+ * }
+ * </pre>
+ * 配置后使用内存存储记录已处理的消息，也可以不配置而直接通过{@link Client#SetDedupStore}指定存储。
+ */
+type DedupConfig struct {
+	CacheSize int `json:"cacheSize"`
+}
+
+const (
+	defaultDedupCacheSize = 100000
+	defaultDedupTable     = "amq_inbox"
+	dedupCompactThreshold = 1024
+)
+
+/**
+ * 已处理消息的记录，同一个消息ID在不同阶段分别记录。
+ */
+type DedupRecord struct {
+	MsgId string           `json:"msgId"`
+	Phase string           `json:"phase"`
+	Ack   *message.MsgBody `json:"ack,omitempty"` // 处理器返回的应答消息体，重复消息直接使用该应答
+	Time  int64            `json:"time"`          // 处理完成时间(毫秒)
+}
+
+func (r *DedupRecord) Key() string {
+	return r.MsgId + "@" + r.Phase
+}
+
+/**
+ * 已处理消息的存储接口，内置了内存(LRU)、本地文件和数据库三种实现，也可自行实现后通过{@link Client#SetDedupStore}设置。
+ */
+type DedupStore interface {
+	/**
+	 * 获取已处理消息的记录，不存在时返回nil。
+	 */
+	Get(msgId, phase string) (*DedupRecord, error)
+
+	/**
+	 * 保存已处理消息的记录，记录已存在(如已被其他实例处理)时视为已处理，不返回错误。
+	 */
+	Save(record *DedupRecord) error
+
+	Close() error
+}
+
+/**
+ * 基于内存的去重存储，最多保存capacity条记录，超出时淘汰最久未使用的记录。
+ */
+type memoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // 最近使用的记录在前
+	records  map[string]*list.Element
+}
+
+func NewMemoryDedupStore(capacity int) DedupStore {
+	return newMemoryDedupStore(capacity)
+}
+
+func newMemoryDedupStore(capacity int) *memoryDedupStore {
+	if capacity <= 0 {
+		capacity = defaultDedupCacheSize
+	}
+	return &memoryDedupStore{capacity: capacity, order: list.New(), records: make(map[string]*list.Element)}
+}
+
+func (s *memoryDedupStore) Get(msgId, phase string) (*DedupRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.records[msgId+"@"+phase]
+	if !ok {
+		return nil, nil
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*DedupRecord), nil
+}
+
+func (s *memoryDedupStore) Save(record *DedupRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(record)
+	return nil
+}
+
+/**
+ * 调用方需持有s.mu。
+ */
+func (s *memoryDedupStore) put(record *DedupRecord) {
+	if e, ok := s.records[record.Key()]; ok {
+		e.Value = record
+		s.order.MoveToFront(e)
+		return
+	}
+	s.records[record.Key()] = s.order.PushFront(record)
+	for s.order.Len() > s.capacity {
+		back := s.order.Back()
+		s.order.Remove(back)
+		delete(s.records, back.Value.(*DedupRecord).Key())
+	}
+}
+
+func (s *memoryDedupStore) Close() error {
+	return nil
+}
+
+/**
+ * 基于本地文件的去重存储，每条记录以一行JSON追加写入文件，进程重启后重新加载最近的记录，记录数增长到一定程度后自动压缩文件。
+ */
+type fileDedupStore struct {
+	*memoryDedupStore
+	path    string
+	file    *os.File
+	written int
+}
+
+/**
+ * 打开指定路径的去重存储文件，文件不存在时自动创建。
+ *
+ * @param path
+ * @param capacity 最多保存的记录数量，小于等于0时使用默认值
+ * @return
+ */
+func NewFileDedupStore(path string, capacity int) (DedupStore, error) {
+	s := &fileDedupStore{memoryDedupStore: newMemoryDedupStore(capacity), path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileDedupStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		record := new(DedupRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// 忽略进程异常退出时未写完整的记录
+			continue
+		}
+		s.put(record)
+	}
+	return scanner.Err()
+}
+
+/**
+ * 将当前所有记录按照从旧到新的顺序写入临时文件后原子替换，调用方需持有s.mu。
+ */
+func (s *fileDedupStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		data, err := json.Marshal(e.Value)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	s.written = s.order.Len()
+	return nil
+}
+
+func (s *fileDedupStore) Save(record *DedupRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(record)
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.written++
+	if s.written > 2*s.order.Len()+dedupCompactThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *fileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+var sqlTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/**
+ * 基于关系型数据库的去重存储，可与业务数据使用同一个数据库，适用于多个实例共享处理记录的场景，记录不会自动删除，
+ * 可根据created_at字段定期清理。
+ */
+type sqlDedupStore struct {
+	db      *sql.DB
+	dialect *sqldialect.Dialect
+	table   string
+}
+
+/**
+ * 使用给定的数据库连接创建去重存储，记录表不存在时自动创建。
+ *
+ * @param db
+ * @param dialect SQL方言，postgres、mysql或sqlite
+ * @param table   记录表名，为空时使用amq_inbox
+ * @return
+ */
+func NewSQLDedupStore(db *sql.DB, dialect, table string) (DedupStore, error) {
+	if len(table) == 0 {
+		table = defaultDedupTable
+	}
+	if !sqlTablePattern.MatchString(table) {
+		return nil, fmt.Errorf("无效的去重记录表名:%s", table)
+	}
+	d, err := sqldialect.Get(dialect, "")
+	if err != nil {
+		return nil, err
+	}
+	schema := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (msg_id VARCHAR(64) NOT NULL, phase VARCHAR(8) NOT NULL, ack %s, created_at BIGINT NOT NULL, PRIMARY KEY (msg_id, phase))%s",
+		table, d.Text, d.TableOptions)
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("创建去重记录表失败:%v", err)
+	}
+	return &sqlDedupStore{db: db, dialect: d, table: table}, nil
+}
+
+func (s *sqlDedupStore) Get(msgId, phase string) (*DedupRecord, error) {
+	var (
+		ack       sql.NullString
+		createdAt int64
+	)
+	query := s.dialect.Rebind(fmt.Sprintf("SELECT ack, created_at FROM %s WHERE msg_id = ? AND phase = ?", s.table))
+	if err := s.db.QueryRow(query, msgId, phase).Scan(&ack, &createdAt); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	record := &DedupRecord{MsgId: msgId, Phase: phase, Time: createdAt}
+	if ack.Valid && len(ack.String) > 0 {
+		record.Ack = new(message.MsgBody)
+		if err := json.Unmarshal([]byte(ack.String), record.Ack); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func (s *sqlDedupStore) Save(record *DedupRecord) error {
+	var ack sql.NullString
+	if record.Ack != nil {
+		data, err := json.Marshal(record.Ack)
+		if err != nil {
+			return err
+		}
+		ack = sql.NullString{String: string(data), Valid: true}
+	}
+	// 多个实例同时处理同一条消息时保留最先保存的记录，冲突视为已处理
+	query := s.dialect.Rebind(fmt.Sprintf("INSERT INTO %s (msg_id, phase, ack, created_at) VALUES (?, ?, ?, ?)", s.table)) + s.dialect.IgnoreConflict("msg_id")
+	_, err := s.db.Exec(query, record.MsgId, record.Phase, ack, record.Time)
+	return err
+}
+
+func (s *sqlDedupStore) Close() error {
+	return nil
+}
+
+/**
+ * 查询消息在指定阶段是否已被处理过，查询失败时按未处理对待。
+ */
+func (l *defaultMessageListener) processed(msgId, phase string) (*DedupRecord, bool) {
+	store := l.client.dedupStore
+	if store == nil {
+		return nil, false
+	}
+	record, err := store.Get(msgId, phase)
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]查询消息处理记录失败:msgId=%s", l.node.String(), msgId)
+		return nil, false
+	}
+	if record != nil {
+		log.Warn().Msgf("[AMQ-Client-%s]忽略重复投递的消息:msgId=%s,phase=%s", l.node.String(), msgId, phase)
+	}
+	return record, record != nil
+}
+
+/**
+ * 记录消息在指定阶段已处理完成以及返回的应答消息体。
+ */
+func (l *defaultMessageListener) remember(msgId, phase string, ack *message.MsgBody) {
+	store := l.client.dedupStore
+	if store == nil {
+		return
+	}
+	if err := store.Save(&DedupRecord{MsgId: msgId, Phase: phase, Ack: ack, Time: nowMillis()}); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]保存消息处理记录失败:msgId=%s", l.node.String(), msgId)
+	}
+}
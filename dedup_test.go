@@ -0,0 +1,87 @@
+package amq_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newSQLiteDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "amq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func expectAck(t *testing.T, store amq.DedupStore, msgId, want string) {
+	t.Helper()
+	record, err := store.Get(msgId, "SENDER_REQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.Ack == nil || record.Ack.Get("result") != want {
+		t.Fatalf("消息%s的处理记录错误:%+v", msgId, record)
+	}
+}
+
+func TestSQLDedupStoreConflict(t *testing.T) {
+	store, err := amq.NewSQLDedupStore(newSQLiteDB(t), "sqlite", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.Get("m1", "SENDER_REQ"); err != nil || record != nil {
+		t.Fatalf("不存在的记录应返回nil:%+v,%v", record, err)
+	}
+	first := &amq.DedupRecord{MsgId: "m1", Phase: "SENDER_REQ", Ack: message.NewMessageBody().Add("result", "first"), Time: 1}
+	if err = store.Save(first); err != nil {
+		t.Fatal(err)
+	}
+	// 其他实例已经保存了同一条消息的记录，冲突视为已处理并保留最先保存的应答
+	second := &amq.DedupRecord{MsgId: "m1", Phase: "SENDER_REQ", Ack: message.NewMessageBody().Add("result", "second"), Time: 2}
+	if err = store.Save(second); err != nil {
+		t.Fatalf("重复保存处理记录不应返回错误:%v", err)
+	}
+	expectAck(t, store, "m1", "first")
+}
+
+func TestFileDedupStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	store, err := amq.NewFileDedupStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Save(&amq.DedupRecord{MsgId: "m1", Phase: "SENDER_REQ", Ack: message.NewMessageBody().Add("result", "ok"), Time: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 进程重启后重新加载处理记录
+	if store, err = amq.NewFileDedupStore(path, 10); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	expectAck(t, store, "m1", "ok")
+}
+
+func TestMemoryDedupStoreEviction(t *testing.T) {
+	store := amq.NewMemoryDedupStore(2)
+	for _, msgId := range []string{"m1", "m2", "m3"} {
+		if err := store.Save(&amq.DedupRecord{MsgId: msgId, Phase: "SENDER_REQ", Ack: message.NewMessageBody().Add("result", msgId)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 超出容量时淘汰最久未使用的记录
+	if record, _ := store.Get("m1", "SENDER_REQ"); record != nil {
+		t.Fatalf("最久未使用的记录应被淘汰:%+v", record)
+	}
+	expectAck(t, store, "m3", "m3")
+}
@@ -0,0 +1,121 @@
+package amq
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+
+	"github.com/aluka-7/amq/message"
+)
+
+/**
+ * 消息体加密配置，和节点的其他配置一起保存在/system/base/amq/{node}中，发送方使用目标系统的密钥加密，
+ * 接收方使用本系统的密钥解密，因此每个系统只需要配置自己以及需要加密发送的目标系统的密钥，格式如下：
+ * <pre>
+ * {
+ *   "keys" : {                                                   // 各系统的密钥，key为系统ID
+ *     "1001" : {"activeKey":"k1","keys":{"k1":"base64..."}},     // 本系统的密钥，用于解密
+ *     "2001" : {"activeKey":"k2","keys":{"k1":"...","k2":"..."}} // 目标系统的密钥，使用activeKey加密
+ *   },
+ *   "required" : true                                            // 是否拒绝未加密的消息(可选，默认false)
+ * }
+ * </pre>
+ * 密钥为Base64编码的16、24或32字节AES密钥，轮换期间新旧密钥同时保留，没有配置密钥的目标系统的消息不加密。
+ */
+type EncryptionConfig struct {
+	Keys     map[string]*EncryptionKey `json:"keys"`
+	Required bool                      `json:"required"`
+}
+
+/**
+ * 一个系统的加密密钥。
+ */
+type EncryptionKey struct {
+	ActiveKey string            `json:"activeKey"`
+	Keys      map[string]string `json:"keys"`
+}
+
+var systemIdPattern = regexp.MustCompile(`^sys_amq_(\d{4})_`)
+
+/**
+ * 根据加密配置对消息体加密和解密。
+ */
+type encryptor struct {
+	systemId string
+	active   map[string]string            // 系统ID -> 当前用于加密的密钥ID
+	keys     map[string]map[string][]byte // 系统ID -> 密钥ID -> 密钥
+	required bool
+}
+
+func newEncryptor(systemId string, cfg *EncryptionConfig) (*encryptor, error) {
+	e := &encryptor{
+		systemId: systemId,
+		active:   make(map[string]string, len(cfg.Keys)),
+		keys:     make(map[string]map[string][]byte, len(cfg.Keys)),
+		required: cfg.Required,
+	}
+	for system, ek := range cfg.Keys {
+		if ek == nil {
+			continue
+		}
+		keys := make(map[string][]byte, len(ek.Keys))
+		for id, v := range ek.Keys {
+			key, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("加密密钥不是有效的Base64编码:system=%s,keyId=%s", system, id)
+			}
+			if l := len(key); l != 16 && l != 24 && l != 32 {
+				return nil, fmt.Errorf("加密密钥长度必须为16、24或32字节:system=%s,keyId=%s", system, id)
+			}
+			keys[id] = key
+		}
+		if _, ok := keys[ek.ActiveKey]; !ok {
+			return nil, fmt.Errorf("加密密钥中不存在activeKey:system=%s,activeKey=%s", system, ek.ActiveKey)
+		}
+		e.active[system] = ek.ActiveKey
+		e.keys[system] = keys
+	}
+	return e, nil
+}
+
+/**
+ * 使用消息目标系统的密钥加密消息体，目标系统没有配置密钥时不加密。
+ */
+func (e *encryptor) encrypt(mpl *message.MsgPayload) error {
+	if e == nil {
+		return nil
+	}
+	name, err := mpl.SendQueueName()
+	if err != nil {
+		return err
+	}
+	m := systemIdPattern.FindStringSubmatch(name)
+	if len(m) == 0 {
+		return nil
+	}
+	keyId, ok := e.active[m[1]]
+	if !ok {
+		return nil
+	}
+	return message.Encrypt(mpl, keyId, e.keys[m[1]][keyId])
+}
+
+/**
+ * 使用本系统的密钥解密消息体。
+ */
+func (e *encryptor) decrypt(mpl *message.MsgPayload) error {
+	if e == nil {
+		return nil
+	}
+	if len(mpl.Encryption) == 0 {
+		if e.required {
+			return fmt.Errorf("拒绝未加密的AMQ消息:msgId=%s", mpl.MsgId)
+		}
+		return nil
+	}
+	key, ok := e.keys[e.systemId][mpl.CipherKeyId]
+	if !ok {
+		return fmt.Errorf("AMQ消息解密失败:msgId=%s,未配置密钥:%s", mpl.MsgId, mpl.CipherKeyId)
+	}
+	return message.Decrypt(mpl, key)
+}
@@ -1,6 +1,7 @@
 package amq
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/aluka-7/amq/node"
@@ -61,9 +62,9 @@ type Amq struct {
  * @return
  */
 func (e *Amq) Clean() {
-	for _, v := range e.clientMap {
-		v.Close()
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	_, _ = e.Shutdown(ctx)
 }
 
 /**
@@ -0,0 +1,135 @@
+package amq_test
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+	_ "github.com/aluka-7/amq/provider/memory"
+	"github.com/aluka-7/configuration"
+)
+
+/**
+ * 所有节点都使用同一份JSON配置的配置中心。
+ */
+type testConfiguration struct {
+	raw string
+}
+
+func (c testConfiguration) Values(app, group, tag string, path []string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (c testConfiguration) String(app, group, tag, path string) (string, error) {
+	return c.raw, nil
+}
+
+func (c testConfiguration) Clazz(app, group, tag, path string, clazz interface{}) error {
+	return json.Unmarshal([]byte(c.raw), clazz)
+}
+
+func (c testConfiguration) Get(app, group, tag string, path []string, parser configuration.ChangedListener) {
+}
+
+/**
+ * 创建使用给定配置的BIZ节点客户端，测试结束时关闭。各测试使用不同的系统ID，避免共用memory提供器的队列。
+ */
+func newTestClient(t *testing.T, systemId, cfg string) *amq.Client {
+	t.Helper()
+	c, err := amq.Engine(testConfiguration{cfg}, systemId).Client(node.BIZ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+/**
+ * 直接读写memory提供器队列的provider，用于模拟broker重复投递或转发到队列中的消息。
+ */
+func newRawProvider(t *testing.T) provider.Provider {
+	p := provider.Read("memory").New(node.BIZ, map[string]string{})
+	t.Cleanup(p.Close)
+	return p
+}
+
+/**
+ * 记录收到的新消息和应答，前fail次处理新消息失败；新消息的应答体为"ok:{msgId}"。
+ */
+type testProcessor struct {
+	genre    string
+	mu       sync.Mutex
+	fail     int
+	received chan string // 收到的新消息ID
+	acks     chan string // 发送方收到的接收方应答结果
+}
+
+func newTestProcessor(genre string, fail int) *testProcessor {
+	return &testProcessor{genre: genre, fail: fail, received: make(chan string, 16), acks: make(chan string, 16)}
+}
+
+func (p *testProcessor) GetType() string {
+	return p.genre
+}
+
+func (p *testProcessor) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	msgId := message.GetMsgId(msg)
+	p.received <- msgId
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail > 0 {
+		p.fail--
+		return nil, errors.New("处理失败")
+	}
+	return message.NewMessageBody().Add("result", "ok:"+msgId), nil
+}
+
+func (p *testProcessor) OnRecipientAckReceived(msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	p.acks <- rsp.Get("result")
+	return nil, nil
+}
+
+func (p *testProcessor) OnSenderAckReceived(msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+/**
+ * 等待从ch中收到want，超时或收到其他值时测试失败。
+ */
+func expectValue(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		if v != want {
+			t.Fatalf("期望收到%s，实际为%s", want, v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待收到%s超时", want)
+	}
+}
+
+/**
+ * 在wait时间内ch中不应收到任何值。
+ */
+func expectNone(t *testing.T, ch chan string, wait time.Duration) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("不应收到%s", v)
+	case <-time.After(wait):
+	}
+}
+
+func startClient(t *testing.T, c *amq.Client, processors ...amq.Processor) {
+	t.Helper()
+	c.AddProcessor(processors...)
+	if _, err := c.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+}
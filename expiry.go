@@ -0,0 +1,81 @@
+package amq
+
+import (
+	"fmt"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 消息在接收方处理之前已过期时返回的错误。
+ */
+type ExpiredError struct {
+	MsgId     string
+	ExpiresAt int64
+}
+
+func (e *ExpiredError) Error() string {
+	return fmt.Sprintf("AMQ消息已过期:msgId=%s,expiresAt=%d", e.MsgId, e.ExpiresAt)
+}
+
+/**
+ * 可选的处理器接口，发送方的消息处理器实现该接口后，在单向/双向事务消息到达接收方时已过期而未被处理的情况下会被回调。
+ */
+type ExpiredMessageProcessor interface {
+	/**
+	 * 事务消息已过期，接收方没有处理该消息。
+	 *
+	 * @param msgId 事务消息的唯一ID
+	 */
+	OnExpired(msgId string)
+}
+
+/**
+ * 接收方处理已过期的消息：不交给处理器，按照死信队列配置转发到死信队列，事务消息同时应答发送方该消息已过期。
+ */
+func (l *defaultMessageListener) expire(mpl *message.MsgPayload) (*message.MsgPayload, error) {
+	cause := &ExpiredError{MsgId: mpl.MsgId, ExpiresAt: mpl.ExpiresAt}
+	log.Warn().Msgf("[AMQ-Client-%s]丢弃已过期的消息:type=%s,msgId=%s,phase=%s,expiresAt=%d", l.node.String(), mpl.Genre, mpl.MsgId, mpl.Phase, mpl.ExpiresAt)
+	if dlq := l.client.deadLetters; dlq != nil && dlq.expired {
+		now := nowMillis()
+		if err := dlq.send(mpl, &message.Failure{Error: cause.Error(), FirstFailedAt: now, LastFailedAt: now}, cause); err != nil {
+			l.client.replay.forget(mpl)
+			return nil, err
+		}
+	}
+	if mpl.Phase != message.SenderReq || (mpl.Category != message.SIMPLEX && mpl.Category != message.DUPLEX) {
+		return nil, nil
+	}
+	rsp := message.NewPayload(mpl, message.ReceiverAck)
+	rsp.SetBody(message.NewMessageBody())
+	rsp.Expired = true
+	return rsp, nil
+}
+
+/**
+ * 发送方收到消息已过期的应答：结束事务跟踪和同步请求的等待，并回调处理器的{@link ExpiredMessageProcessor#OnExpired}。
+ */
+func (l *defaultMessageListener) notifyExpired(mpl *message.MsgPayload) error {
+	log.Warn().Msgf("[AMQ-Client-%s]消息已过期，接收方未处理:type=%s,msgId=%s", l.node.String(), mpl.Genre, mpl.MsgId)
+	l.client.tracker.complete(mpl.MsgId, string(message.ReceiverAck))
+	if reply := l.client.takeReply(mpl.MsgId); reply != nil {
+		close(reply)
+	}
+	if p, ok := l.processor(mpl.Genre).(ExpiredMessageProcessor); ok {
+		p.OnExpired(mpl.MsgId)
+	}
+	return nil
+}
+
+/**
+ * 判断消息此前是否已处理过(如应答消息发送失败后被重新投递)，已处理过的消息即使已过期也按照去重记录重新应答，而不是应答已过期。
+ */
+func (l *defaultMessageListener) handledBefore(mpl *message.MsgPayload) bool {
+	store := l.client.dedupStore
+	if store == nil {
+		return false
+	}
+	record, err := store.Get(mpl.MsgId, string(mpl.Phase))
+	return err == nil && record != nil
+}
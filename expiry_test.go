@@ -0,0 +1,90 @@
+package amq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+)
+
+/**
+ * 实现了amq.ExpiredMessageProcessor的处理器，记录过期通知。
+ */
+type expiringProcessor struct {
+	*testProcessor
+	expired chan string
+}
+
+func (p *expiringProcessor) OnExpired(msgId string) {
+	p.expired <- msgId
+}
+
+func TestExpiredSimplexNotifiesSender(t *testing.T) {
+	sender := newTestClient(t, "1108", `{"provider":"memory"}`)
+	receiver := newTestClient(t, "1109", `{"provider":"memory","deadLetter":{"expired":true}}`)
+	sp := &expiringProcessor{testProcessor: newTestProcessor("expiry", 0), expired: make(chan string, 1)}
+	rp := newTestProcessor("expiry", 0)
+	startClient(t, sender, sp)
+	startClient(t, receiver, rp)
+
+	msgId := sender.NewMsgId()
+	sm := message.NewSimplexMessage(msgId)
+	sm.SetType("expiry")
+	sm.SetBody(message.NewMessageBody())
+	sm.Source = sender.BuildQueueName("1108")
+	sm.Destination = receiver.BuildQueueName("1109")
+	sm.ExpiresAt = time.Now().Add(-time.Second)
+	if err := sender.Send(sm); err != nil {
+		t.Fatal(err)
+	}
+	// 过期的消息不交给接收方的处理器，转发到死信队列并通知发送方
+	expectValue(t, sp.expired, msgId)
+	expectNone(t, rp.received, 200*time.Millisecond)
+	expectNone(t, sp.acks, 0)
+	if letters := waitDeadLetters(t, receiver, 1); letters[0].Payload.MsgId != msgId {
+		t.Fatalf("死信的消息ID错误:%s", letters[0].Payload.MsgId)
+	}
+}
+
+func TestExpiredRequest(t *testing.T) {
+	requester := newTestClient(t, "1110", `{"provider":"memory"}`)
+	responder := newTestClient(t, "1111", `{"provider":"memory"}`)
+	rp := newTestProcessor("expiry", 0)
+	startClient(t, requester)
+	startClient(t, responder, rp)
+
+	sm := message.NewSimplexMessage(requester.NewMsgId())
+	sm.SetType("expiry")
+	sm.SetBody(message.NewMessageBody())
+	sm.Destination = responder.BuildQueueName("1111")
+	sm.ExpiresAt = time.Now().Add(-time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var expired *amq.ExpiredError
+	if _, err := requester.Request(ctx, sm); !errors.As(err, &expired) {
+		t.Fatalf("期望返回ExpiredError，实际为%v", err)
+	}
+	expectNone(t, rp.received, 100*time.Millisecond)
+}
+
+func TestTTLStartsAtDeliverTime(t *testing.T) {
+	c := newTestClient(t, "1112", `{"provider":"memory"}`)
+	p := newTestProcessor("expiry", 0)
+	startClient(t, c, p)
+
+	// 有效时长从投递时开始计算，延迟时间长于有效时长的消息到期投递后仍然有效
+	msgId := c.NewMsgId()
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("expiry")
+	nm.SetBody(message.NewMessageBody())
+	nm.Destination = c.BuildQueueName("1112")
+	nm.Delay = 300 * time.Millisecond
+	nm.TTL = 200 * time.Millisecond
+	if err := c.Send(nm); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, p.received, msgId)
+}
@@ -1,10 +1,22 @@
 module github.com/aluka-7/amq
 
-go 1.16
+go 1.20
 
 require (
 	github.com/aluka-7/configuration v1.0.1
 	github.com/aluka-7/utils v1.0.2
+	github.com/klauspost/compress v1.17.9
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/rabbitmq/amqp091-go v1.9.0
 	github.com/rs/zerolog v1.28.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/samuel/go-zookeeper v0.0.0-20201211165307-7117e9ea2414 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
 )
@@ -0,0 +1,499 @@
+package amq
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq/provider"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 消费组配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "name" : "",                 // 消费组名称(可选)，默认为sys_amq_{systemId}_{node}
+ *   "member" : "",               // 当前实例的成员ID(可选)，默认为{hostname}-{pid}
+ *   "heartbeat" : 1000,          // 心跳以及检查分区分配的间隔(毫秒，默认1000)
+ *   "sessionTimeout" : 10000,    // 超过该时间(毫秒，默认10000)没有心跳的成员视为已离开
+ *   "path" : "/data/amq/group"   // 本地文件协调器的目录(可选)，默认为系统临时目录下的amq/group
+ * }
+ * </pre>
+ * 配置后多分区节点在{@link Client#Start}未指定分区时加入消费组，由所有存活的成员自动分配节点的分区；未通过{@link Client#SetCoordinator}
+ * 设置协调器时使用基于本地文件的协调器，仅适用于同一台主机上的多个实例。
+ */
+type GroupConfig struct {
+	Name           string `json:"name"`
+	Member         string `json:"member"`
+	Heartbeat      int    `json:"heartbeat"`
+	SessionTimeout int    `json:"sessionTimeout"`
+	Path           string `json:"path"`
+}
+
+const (
+	defaultGroupHeartbeat      = 1000
+	defaultGroupSessionTimeout = 10000
+	groupLockTimeout           = 5 * time.Second
+)
+
+/**
+ * 消费组协调器接口，负责记录存活的成员以及每个分区的占有者，内置了基于本地文件的实现，
+ * 也可基于ZooKeeper、etcd等实现后通过{@link Client#SetCoordinator}设置。
+ */
+type Coordinator interface {
+	/**
+	 * 加入消费组或者刷新成员的心跳，超过ttl没有再次调用的成员视为已离开，其占有的分区会被释放。
+	 */
+	Heartbeat(group, member string, ttl time.Duration) error
+
+	/**
+	 * 获取消费组中所有存活的成员。
+	 */
+	Members(group string) ([]string, error)
+
+	/**
+	 * 尝试占有分区，分区未被占有、已被该成员占有或者占有者已离开时返回true。
+	 */
+	Acquire(group string, partition int, member string) (bool, error)
+
+	/**
+	 * 释放该成员占有的分区。
+	 */
+	Release(group string, partition int, member string) error
+
+	/**
+	 * 离开消费组并释放该成员占有的所有分区。
+	 */
+	Leave(group, member string) error
+
+	Close() error
+}
+
+/**
+ * 分区重新分配的监听接口，可通过{@link Client#SetRebalanceListener}设置。
+ */
+type RebalanceListener interface {
+	/**
+	 * 分区已停止监听并且处理中的消息已处理完成，回调结束后分区才会被释放给其他成员。
+	 *
+	 * @param partitions 被收回的分区编号
+	 */
+	OnPartitionsRevoked(partitions []int)
+
+	/**
+	 * 已占有并开始监听分区。
+	 *
+	 * @param partitions 新分配的分区编号
+	 */
+	OnPartitionsAssigned(partitions []int)
+}
+
+/**
+ * 消费组在协调器中的状态。
+ */
+type groupState struct {
+	Members map[string]int64 `json:"members"` // 成员ID -> 会话过期时间(毫秒)
+	Owners  map[int]string   `json:"owners"`  // 分区编号 -> 占有的成员ID
+}
+
+/**
+ * 删除会话已过期的成员以及它们占有的分区。
+ */
+func (s *groupState) prune(now int64) {
+	for member, expireAt := range s.Members {
+		if expireAt <= now {
+			delete(s.Members, member)
+		}
+	}
+	for partition, owner := range s.Owners {
+		if _, ok := s.Members[owner]; !ok {
+			delete(s.Owners, partition)
+		}
+	}
+}
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+/**
+ * 基于本地文件的协调器，每个消费组的状态保存在一个JSON文件中，通过创建锁目录实现互斥，仅适用于同一台主机上的多个实例。
+ */
+type fileCoordinator struct {
+	mu  sync.Mutex
+	dir string
+}
+
+/**
+ * 使用指定的目录创建本地文件协调器，目录不存在时自动创建。
+ *
+ * @param dir
+ * @return
+ */
+func NewFileCoordinator(dir string) (Coordinator, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileCoordinator{dir: dir}, nil
+}
+
+/**
+ * 获取消费组的锁，持有锁的进程异常退出时锁在超时后失效。
+ */
+func (c *fileCoordinator) lock(group string) (func(), error) {
+	path := filepath.Join(c.dir, group+".lock")
+	deadline := time.Now().Add(groupLockTimeout)
+	for {
+		err := os.Mkdir(path, 0755)
+		if err == nil {
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, serr := os.Stat(path); serr == nil && time.Since(fi.ModTime()) > groupLockTimeout {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("获取消费组锁超时:%s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/**
+ * 在锁内读取消费组的状态并删除已过期的成员，fn返回true时写回修改后的状态。
+ */
+func (c *fileCoordinator) update(group string, fn func(s *groupState, now int64) bool) error {
+	if !groupNamePattern.MatchString(group) {
+		return fmt.Errorf("无效的消费组名称:%s", group)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unlock, err := c.lock(group)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := filepath.Join(c.dir, group+".json")
+	state := &groupState{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, state); err != nil {
+			return err
+		}
+	}
+	if state.Members == nil {
+		state.Members = make(map[string]int64)
+	}
+	if state.Owners == nil {
+		state.Owners = make(map[int]string)
+	}
+	now := nowMillis()
+	state.prune(now)
+	if !fn(state, now) {
+		return nil
+	}
+	if data, err = json.Marshal(state); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (c *fileCoordinator) Heartbeat(group, member string, ttl time.Duration) error {
+	return c.update(group, func(s *groupState, now int64) bool {
+		s.Members[member] = now + int64(ttl/time.Millisecond)
+		return true
+	})
+}
+
+func (c *fileCoordinator) Members(group string) ([]string, error) {
+	members := make([]string, 0)
+	err := c.update(group, func(s *groupState, now int64) bool {
+		for member := range s.Members {
+			members = append(members, member)
+		}
+		return false
+	})
+	sort.Strings(members)
+	return members, err
+}
+
+func (c *fileCoordinator) Acquire(group string, partition int, member string) (bool, error) {
+	acquired := false
+	err := c.update(group, func(s *groupState, now int64) bool {
+		if owner, ok := s.Owners[partition]; ok && owner != member {
+			return false
+		}
+		s.Owners[partition] = member
+		acquired = true
+		return true
+	})
+	return acquired, err
+}
+
+func (c *fileCoordinator) Release(group string, partition int, member string) error {
+	return c.update(group, func(s *groupState, now int64) bool {
+		if s.Owners[partition] != member {
+			return false
+		}
+		delete(s.Owners, partition)
+		return true
+	})
+}
+
+func (c *fileCoordinator) Leave(group, member string) error {
+	return c.update(group, func(s *groupState, now int64) bool {
+		delete(s.Members, member)
+		s.prune(now)
+		return true
+	})
+}
+
+func (c *fileCoordinator) Close() error {
+	return nil
+}
+
+/**
+ * 按照成员ID排序后轮流分配分区，返回分配给member的分区编号。
+ */
+func assignPartitions(members []string, partitions int, member string) []int {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	index := sort.SearchStrings(sorted, member)
+	if index == len(sorted) || sorted[index] != member {
+		return nil
+	}
+	assigned := make([]int, 0)
+	for p := index; p < partitions; p += len(sorted) {
+		assigned = append(assigned, p)
+	}
+	return assigned
+}
+
+/**
+ * 消费组中的当前实例，定期发送心跳并根据存活的成员重新分配分区。分区被分配给其他成员时先停止监听并等待处理中的消息完成，
+ * 然后才释放分区；新的成员在分区被释放(或原成员的会话过期)后才能占有并开始监听，从而保证同一个分区不会被同时消费。
+ */
+type groupMember struct {
+	client      *Client
+	coordinator Coordinator
+	group       string
+	member      string
+	interval    time.Duration
+	timeout     time.Duration
+	listener    provider.MessageListener
+	mu          sync.Mutex
+	owned       map[int]func() // 分区编号 -> 关闭监听的方法
+	lastBeat    time.Time
+	stop        chan struct{}
+	done        chan struct{}
+	once        sync.Once
+}
+
+func newGroupMember(c *Client, coordinator Coordinator, cfg *GroupConfig, listener provider.MessageListener) *groupMember {
+	g := &groupMember{
+		client:      c,
+		coordinator: coordinator,
+		group:       cfg.Name,
+		member:      cfg.Member,
+		interval:    time.Duration(cfg.Heartbeat) * time.Millisecond,
+		timeout:     time.Duration(cfg.SessionTimeout) * time.Millisecond,
+		listener:    listener,
+		owned:       make(map[int]func()),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if len(g.group) == 0 {
+		g.group = fmt.Sprintf("sys_amq_%s_%s", c.systemId, c.node.String())
+	}
+	if len(g.member) == 0 {
+		host, _ := os.Hostname()
+		g.member = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if g.interval <= 0 {
+		g.interval = defaultGroupHeartbeat * time.Millisecond
+	}
+	if g.timeout <= 0 {
+		g.timeout = defaultGroupSessionTimeout * time.Millisecond
+	}
+	return g
+}
+
+/**
+ * 加入消费组并启动后台任务。
+ */
+func (g *groupMember) start() error {
+	if err := g.coordinator.Heartbeat(g.group, g.member, g.timeout); err != nil {
+		close(g.done)
+		return fmt.Errorf("[AMQ-Client-%s]加入消费组失败:%v", g.client.node.String(), err)
+	}
+	log.Info().Msgf("[AMQ-Client-%s]已加入消费组:group=%s,member=%s", g.client.node.String(), g.group, g.member)
+	go func() {
+		defer close(g.done)
+		g.rebalance()
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+				g.rebalance()
+			}
+		}
+	}()
+	return nil
+}
+
+/**
+ * 发送心跳，收回不再分配给当前实例的分区，并占有新分配的分区。
+ */
+func (g *groupMember) rebalance() {
+	c := g.client
+	now := time.Now()
+	if err := g.coordinator.Heartbeat(g.group, g.member, g.timeout); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]消费组心跳失败:group=%s", c.node.String(), g.group)
+		// 会话即将过期，过期后分区随时会被其他成员占有，提前一个心跳间隔停止监听以免同一个分区被同时消费
+		if !g.lastBeat.IsZero() && now.Sub(g.lastBeat) >= g.timeout-g.interval {
+			g.revoke(g.partitions())
+		}
+		return
+	}
+	g.lastBeat = now
+	members, err := g.coordinator.Members(g.group)
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]获取消费组成员失败:group=%s", c.node.String(), g.group)
+		return
+	}
+	target := make(map[int]bool)
+	for _, p := range assignPartitions(members, c.partitions, g.member) {
+		target[p] = true
+	}
+	revoked := make([]int, 0)
+	for _, p := range g.partitions() {
+		if !target[p] {
+			revoked = append(revoked, p)
+		}
+	}
+	g.revoke(revoked)
+	// 会话曾经过期(如进程暂停或心跳间隔过长)时分区可能已被其他成员占有，每次都重新确认仍占有的分区，未能确认的立即停止监听
+	lost := make([]int, 0)
+	for _, p := range g.partitions() {
+		if ok, err := g.coordinator.Acquire(g.group, p, g.member); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]确认分区失败:group=%s,partition=%d", c.node.String(), g.group, p)
+		} else if !ok {
+			log.Warn().Msgf("[AMQ-Client-%s]分区已被其他成员占有，停止监听:group=%s,partition=%d", c.node.String(), g.group, p)
+			lost = append(lost, p)
+		}
+	}
+	g.revoke(lost)
+	assigned := make([]int, 0)
+	for p := 0; p < c.partitions; p++ {
+		if !target[p] || g.owns(p) {
+			continue
+		}
+		ok, err := g.coordinator.Acquire(g.group, p, g.member)
+		if err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]占有分区失败:group=%s,partition=%d", c.node.String(), g.group, p)
+			continue
+		}
+		if !ok {
+			log.Debug().Msgf("[AMQ-Client-%s]等待分区的原成员释放:group=%s,partition=%d", c.node.String(), g.group, p)
+			continue
+		}
+		queueName := c.BuildQueueNameByPartition(c.systemId, p)
+		if err = c.listen(queueName, p, g.listener); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]监听分区队列失败:queue=%s", c.node.String(), queueName)
+			if rerr := g.coordinator.Release(g.group, p, g.member); rerr != nil {
+				log.Error().Err(rerr).Msgf("[AMQ-Client-%s]释放分区失败:group=%s,partition=%d", c.node.String(), g.group, p)
+			}
+			continue
+		}
+		log.Info().Msgf("[AMQ-Client-%s]启动监听AMQ多分区消息队列:partition=%d,queue=%s", c.node.String(), p, queueName)
+		g.mu.Lock()
+		g.owned[p] = func() { c.unlisten(queueName) }
+		g.mu.Unlock()
+		assigned = append(assigned, p)
+	}
+	if len(assigned) > 0 && c.rebalancer != nil {
+		c.rebalancer.OnPartitionsAssigned(assigned)
+	}
+}
+
+/**
+ * 停止监听给定的分区并等待处理中的消息完成，回调监听接口后释放分区(已被其他成员占有的分区不受影响)。
+ */
+func (g *groupMember) revoke(partitions []int) {
+	if len(partitions) == 0 {
+		return
+	}
+	c := g.client
+	for _, p := range partitions {
+		g.mu.Lock()
+		closer := g.owned[p]
+		delete(g.owned, p)
+		g.mu.Unlock()
+		if closer != nil {
+			closer()
+		}
+	}
+	if c.rebalancer != nil {
+		c.rebalancer.OnPartitionsRevoked(partitions)
+	}
+	for _, p := range partitions {
+		if err := g.coordinator.Release(g.group, p, g.member); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]释放分区失败:group=%s,partition=%d", c.node.String(), g.group, p)
+		}
+	}
+}
+
+func (g *groupMember) owns(partition int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.owned[partition]
+	return ok
+}
+
+/**
+ * 当前实例占有的分区编号，按照从小到大排序。
+ */
+func (g *groupMember) partitions() []int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	partitions := make([]int, 0, len(g.owned))
+	for p := range g.owned {
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+	return partitions
+}
+
+/**
+ * 收回所有分区后离开消费组。
+ */
+func (g *groupMember) close() {
+	g.once.Do(func() {
+		close(g.stop)
+		<-g.done
+		g.revoke(g.partitions())
+		if err := g.coordinator.Leave(g.group, g.member); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]离开消费组失败:group=%s", g.client.node.String(), g.group)
+		}
+		if err := g.coordinator.Close(); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭消费组协调器失败", g.client.node.String())
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package amq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestCoordinator(t *testing.T) Coordinator {
+	c, err := NewFileCoordinator(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func acquire(t *testing.T, c Coordinator, partition int, member string, want bool) {
+	t.Helper()
+	ok, err := c.Acquire("g", partition, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != want {
+		t.Fatalf("成员%s占有分区%d的结果为%v，期望为%v", member, partition, ok, want)
+	}
+}
+
+func TestFileCoordinatorAcquireRelease(t *testing.T) {
+	c := newTestCoordinator(t)
+	for _, member := range []string{"a", "b"} {
+		if err := c.Heartbeat("g", member, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err := c.Members("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Fatalf("消费组成员错误:%v", members)
+	}
+	acquire(t, c, 0, "a", true)
+	acquire(t, c, 0, "a", true)
+	acquire(t, c, 0, "b", false)
+	// 只有占有者才能释放分区
+	if err = c.Release("g", 0, "b"); err != nil {
+		t.Fatal(err)
+	}
+	acquire(t, c, 0, "b", false)
+	if err = c.Release("g", 0, "a"); err != nil {
+		t.Fatal(err)
+	}
+	acquire(t, c, 0, "b", true)
+	// 离开消费组后释放占有的所有分区
+	acquire(t, c, 1, "b", true)
+	if err = c.Leave("g", "b"); err != nil {
+		t.Fatal(err)
+	}
+	acquire(t, c, 0, "a", true)
+	acquire(t, c, 1, "a", true)
+	if members, err = c.Members("g"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []string{"a"}) {
+		t.Fatalf("消费组成员错误:%v", members)
+	}
+}
+
+func TestFileCoordinatorSessionExpired(t *testing.T) {
+	c := newTestCoordinator(t)
+	if err := c.Heartbeat("g", "a", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	acquire(t, c, 0, "a", true)
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Heartbeat("g", "b", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	acquire(t, c, 0, "b", true)
+	// 会话过期的成员重新发送心跳后不能再占有已被其他成员占有的分区
+	if err := c.Heartbeat("g", "a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	acquire(t, c, 0, "a", false)
+}
+
+func TestFileCoordinatorInvalidGroup(t *testing.T) {
+	c := newTestCoordinator(t)
+	if err := c.Heartbeat("../g", "a", time.Minute); err == nil {
+		t.Fatal("期望返回无效的消费组名称错误")
+	}
+}
+
+func TestAssignPartitions(t *testing.T) {
+	members := []string{"c", "a", "b"}
+	cases := map[string][]int{"a": {0, 3, 6}, "b": {1, 4}, "c": {2, 5}, "d": nil}
+	for member, want := range cases {
+		if got := assignPartitions(members, 7, member); !reflect.DeepEqual(got, want) {
+			t.Fatalf("成员%s分配的分区为%v，期望为%v", member, got, want)
+		}
+	}
+}
@@ -1,12 +1,164 @@
 package amq
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/aluka-7/amq/message"
 	"github.com/aluka-7/amq/provider"
 )
 
+/**
+ * 分发从消息队列中收到的AMQ消息，新消息交由{@link HandleNew}处理，应答消息交由{@link HandleAck}处理，
+ * 返回需要回送给对方的应答消息(无需应答时为nil)，供各个provider在收到消息后统一调用。分发之前会使用客户端配置的签名器
+ * 校验消息签名，校验失败时返回{@link message.SignatureError}，如果客户端配置了隔离队列则同时将该消息转发到隔离队列；
+ * 签名校验通过后拒绝重放的消息并丢弃已过期的消息(已处理过的消息重新投递时按照去重记录应答)，然后解密和解压消息体。处理失败的消息按照客户端的死信队列配置重试，仍然失败则转发到死信队列。
+ * provider根据{@link Rejected}区分被拒绝的消息和处理失败的消息，前者确认后丢弃，后者保留并稍后重新投递。
+ * 客户端配置了并发处理时等待协程池处理完成后返回，因此只适用于逐条同步确认消息的provider，支持并发处理的provider请使用{@link DispatchAsync}。
+ *
+ * @param message
+ * @param listener
+ * @throws AMQException
+ */
+func Dispatch(msg *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
+	var rsp *message.MsgPayload
+	var err error
+	done := make(chan struct{})
+	DispatchAsync(msg, listener, func(r *message.MsgPayload, e error) {
+		rsp, err = r, e
+		close(done)
+	})
+	<-done
+	return rsp, err
+}
+
+/**
+ * 和{@link Dispatch}相同，处理完成后将结果交给done，provider在done中发送应答消息并确认或重新投递消息。
+ * 客户端配置了并发处理时消息交给协程池后立即返回(缓冲已满时阻塞)，done由协程池在处理完成后调用，否则在返回前同步调用。
+ */
+func DispatchAsync(msg *message.MsgPayload, listener provider.MessageListener, done func(rsp *message.MsgPayload, err error)) {
+	if l, ok := listener.(*defaultMessageListener); ok {
+		l.client.enter(msg.MsgId)
+		if l.pool != nil {
+			l.pool.submit(msg, done)
+			return
+		}
+		defer l.client.leave(msg.MsgId)
+	}
+	done(dispatch(msg, listener))
+}
+
+func dispatch(msg *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
+	if dl, ok := listener.(*deadLetterListener); ok {
+		return nil, dl.queue.receive(msg)
+	}
+	l, ok := listener.(*defaultMessageListener)
+	var err error
+	if ok {
+		err = l.client.signer.Verify(msg)
+	} else {
+		err = message.Verify(msg)
+	}
+	if err != nil {
+		if ok {
+			l.client.quarantine(msg, err)
+		}
+		return nil, err
+	}
+	var (
+		rsp     *message.MsgPayload
+		handled bool
+	)
+	if ok {
+		// 去重记录中已处理的消息是broker重复投递的，跳过重放检查，由去重逻辑按记录应答；
+		// 其他消息先拒绝重放的消息，再丢弃过期的消息，避免重放的消息产生过期应答
+		if handled = l.handledBefore(msg); !handled {
+			if err = l.client.replay.check(msg); err != nil {
+				var replay *ReplayError
+				if errors.As(err, &replay) && replay.OutOfWindow {
+					// 无法区分积压过久的消息和重放的消息，转发到隔离队列避免丢失
+					l.client.quarantine(msg, err)
+				}
+				return nil, err
+			}
+		}
+	}
+	if msg.IsExpired() && !handled {
+		if !ok {
+			return nil, nil
+		}
+		rsp, err = l.expire(msg)
+	} else if ok {
+		sealed := *msg
+		if err = l.client.open(msg); err != nil {
+			l.client.replay.forget(msg)
+			return nil, &rejectedError{err}
+		}
+		if msg.Expired {
+			err = l.notifyExpired(msg)
+		} else {
+			rsp, err = l.handle(msg, &sealed)
+		}
+	} else if err = message.Decompress(msg); err != nil {
+		return nil, err
+	} else if msg.Phase == message.SenderReq {
+		rsp, err = HandleNew(msg, listener)
+	} else {
+		rsp, err = HandleAck(msg, listener)
+	}
+	// 应答消息按照客户端的配置压缩并重新签名
+	if rsp != nil && ok {
+		if serr := l.client.seal(rsp); serr != nil {
+			return nil, serr
+		}
+	}
+	return rsp, err
+}
+
+/**
+ * 消息无法处理(如无法解密)时返回的错误，重新投递后仍然无法处理。
+ */
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rejectedError) Unwrap() error {
+	return e.err
+}
+
+/**
+ * 判断{@link Dispatch}返回的错误是否表示消息被拒绝(签名校验失败、重放的消息、无法解密或没有对应的处理器)，被拒绝的消息重新投递后
+ * 仍然会被拒绝，provider应确认并丢弃该消息；其他错误表示消息处理失败，provider应保留该消息，稍后重新投递并调用{@link Requeue}。
+ *
+ * @param err
+ * @return
+ */
+func Rejected(err error) bool {
+	var (
+		signature *message.SignatureError
+		replay    *ReplayError
+		rejected  *rejectedError
+	)
+	return errors.As(err, &signature) || errors.As(err, &replay) || errors.As(err, &rejected) || errors.Is(err, errNoProcessor)
+}
+
+/**
+ * provider未能完成消息的投递(如应答消息发送失败)并将重新投递该消息时调用，清除该消息的处理记录，
+ * 使重新投递的消息不会被当作重放的消息拒绝，即使重新投递时发送时间已超出重放窗口。
+ *
+ * @param message
+ * @param listener
+ */
+func Requeue(msg *message.MsgPayload, listener provider.MessageListener) {
+	if l, ok := listener.(*defaultMessageListener); ok {
+		l.client.replay.requeue(msg)
+	}
+}
+
 /**
  * 处理收到的新消息（包括通知消息和事务消息）。
  *
@@ -22,7 +174,7 @@ func HandleNew(msg *message.MsgPayload, listener provider.MessageListener) (*mes
 	} else if msg.Category == message.DUPLEX {
 		return duplexNew(msg, listener)
 	} else {
-		return nil, fmt.Errorf("无效的消息类型:%d", msg.Category)
+		return nil, fmt.Errorf("无效的消息类型:%s", msg.Category)
 	}
 }
 
@@ -39,7 +191,7 @@ func HandleAck(msg *message.MsgPayload, listener provider.MessageListener) (*mes
 		if phase == message.ReceiverAck {
 			return simplexRecipientACK(msg, listener)
 		} else {
-			return nil, fmt.Errorf("无效的消息阶段：%d", msg.Phase)
+			return nil, fmt.Errorf("无效的消息阶段：%s", msg.Phase)
 		}
 	} else if msg.Category == message.DUPLEX {
 		phase := msg.Phase
@@ -49,16 +201,16 @@ func HandleAck(msg *message.MsgPayload, listener provider.MessageListener) (*mes
 			return duplexSenderACK(msg, listener)
 		} else {
 
-			return nil, fmt.Errorf("无效的消息阶段：%d", msg.Phase)
+			return nil, fmt.Errorf("无效的消息阶段：%s", msg.Phase)
 		}
 	} else {
-		return nil, fmt.Errorf("无效的消息类型:%d", msg.Category)
+		return nil, fmt.Errorf("无效的消息类型:%s", msg.Category)
 	}
 }
 func noticeNew(msg *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
 	phase := msg.Phase
 	if phase != message.SenderReq {
-		return nil, fmt.Errorf("无效的消息阶段：%d", msg.Phase)
+		return nil, fmt.Errorf("无效的消息阶段：%s", msg.Phase)
 	}
 	nm, err := msg.ConvertToNotice()
 	if err != nil {
@@ -70,7 +222,7 @@ func noticeNew(msg *message.MsgPayload, listener provider.MessageListener) (*mes
 func simplexNew(mpl *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
 	phase := mpl.Phase
 	if phase != message.SenderReq {
-		return nil, fmt.Errorf("无效的消息阶段:%d", phase)
+		return nil, fmt.Errorf("无效的消息阶段:%s", phase)
 	}
 	m, err := mpl.ConvertToSimplex()
 	if err != nil {
@@ -89,7 +241,7 @@ func simplexNew(mpl *message.MsgPayload, listener provider.MessageListener) (*me
 func duplexNew(mpl *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
 	phase := mpl.Phase
 	if phase != message.SenderReq {
-		return nil, fmt.Errorf("无效的消息阶段:%d", phase)
+		return nil, fmt.Errorf("无效的消息阶段:%s", phase)
 	}
 	m, err := mpl.ConvertToDuplex()
 	if err != nil {
@@ -109,7 +261,7 @@ func duplexNew(mpl *message.MsgPayload, listener provider.MessageListener) (*mes
 func simplexRecipientACK(mpl *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
 	phase := mpl.Phase
 	if phase != message.ReceiverAck {
-		return nil, fmt.Errorf("无效的消息阶段：%d", mpl.Phase)
+		return nil, fmt.Errorf("无效的消息阶段：%s", mpl.Phase)
 	}
 	// 单向事务应答消息，发送方处理
 	_, err := listener.OnRecipientAckReceived(mpl.Genre, mpl.MsgId, mpl.Body)
@@ -118,7 +270,7 @@ func simplexRecipientACK(mpl *message.MsgPayload, listener provider.MessageListe
 func duplexRecipientACK(mpl *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
 	phase := mpl.Phase
 	if phase != message.ReceiverAck {
-		return nil, fmt.Errorf("无效的消息阶段：%d", mpl.Phase)
+		return nil, fmt.Errorf("无效的消息阶段：%s", mpl.Phase)
 	}
 	// 双向事务的接收方应答消息送达，发送方处理并进行应答
 	rsp, err := listener.OnRecipientAckReceived(mpl.Genre, mpl.MsgId, mpl.Body)
@@ -133,7 +285,7 @@ func duplexRecipientACK(mpl *message.MsgPayload, listener provider.MessageListen
 func duplexSenderACK(mpl *message.MsgPayload, listener provider.MessageListener) (*message.MsgPayload, error) {
 	phase := mpl.Phase
 	if phase != message.SenderAck {
-		return nil, fmt.Errorf("无效的消息阶段：%d", mpl.Phase)
+		return nil, fmt.Errorf("无效的消息阶段：%s", mpl.Phase)
 	}
 	// 双向事务的发送方应答消息送达，接收方处理
 	err := listener.OnSenderAckReceived(mpl.Genre, mpl.MsgId, mpl.Body)
@@ -0,0 +1,29 @@
+package amq_test
+
+import (
+	"testing"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+)
+
+func TestClientMsgIdEmbedsSystemId(t *testing.T) {
+	c1 := newTestClient(t, "1091", `{"provider":"memory"}`)
+	c2 := newTestClient(t, "1092", `{"provider":"memory"}`)
+	// 两个引擎的客户端各自使用所属系统的ID，互不覆盖
+	for _, tc := range []struct {
+		client *amq.Client
+		want   string
+	}{{c1, "1091"}, {c2, "1092"}} {
+		system, err := message.MsgIdSystem(tc.client.NewMsgId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if system != tc.want {
+			t.Fatalf("消息ID的系统为%s，期望为%s", system, tc.want)
+		}
+	}
+	if system, err := message.MsgIdSystem(message.NewMsgId().Id()); err != nil || system != "0000" {
+		t.Fatalf("默认生成器的系统为%s，期望为0000:%v", system, err)
+	}
+}
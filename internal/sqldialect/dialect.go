@@ -0,0 +1,107 @@
+package sqldialect
+
+import (
+	"fmt"
+	"strings"
+)
+
+/**
+ * 不同数据库之间的SQL方言差异，供基于database/sql实现的各个组件共用。
+ */
+type Dialect struct {
+	Name string
+	// 第i个(从1开始)参数的占位符
+	placeholder func(i int) string
+	// 主键冲突时忽略插入的子句
+	ignoreConflict func(key string) string
+	// 消费时的行锁子句，跳过已被其他事务锁定的行
+	LockClause string
+	// 等待其他事务释放的行锁子句，用于需要保持顺序的场景
+	WaitLockClause string
+	// 自增主键的列定义
+	Serial string
+	// 大文本的列类型
+	Text string
+	// 建表语句的表选项
+	TableOptions string
+}
+
+var dialects = map[string]*Dialect{
+	"postgres": {
+		Name:           "postgres",
+		placeholder:    func(i int) string { return fmt.Sprintf("$%d", i) },
+		ignoreConflict: func(key string) string { return " ON CONFLICT DO NOTHING" },
+		LockClause:     " FOR UPDATE SKIP LOCKED",
+		WaitLockClause: " FOR UPDATE",
+		Serial:         "BIGSERIAL PRIMARY KEY",
+		Text:           "TEXT",
+	},
+	"mysql": {
+		Name:           "mysql",
+		placeholder:    func(i int) string { return "?" },
+		ignoreConflict: func(key string) string { return fmt.Sprintf(" ON DUPLICATE KEY UPDATE %s = %s", key, key) },
+		LockClause:     " FOR UPDATE SKIP LOCKED",
+		WaitLockClause: " FOR UPDATE",
+		Serial:         "BIGINT AUTO_INCREMENT PRIMARY KEY",
+		Text:           "LONGTEXT",
+		TableOptions:   " ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	},
+	// SQLite的写事务本身是串行的，不支持也不需要行锁
+	"sqlite": {
+		Name:           "sqlite",
+		placeholder:    func(i int) string { return "?" },
+		ignoreConflict: func(key string) string { return " ON CONFLICT DO NOTHING" },
+		Serial:         "INTEGER PRIMARY KEY AUTOINCREMENT",
+		Text:           "TEXT",
+	},
+}
+
+/**
+ * 根据配置的方言名称或驱动名称获取对应的方言。
+ *
+ * @param name   方言名称，为空时根据驱动名称推断
+ * @param driver database/sql的驱动名称
+ * @return
+ */
+func Get(name, driver string) (*Dialect, error) {
+	if len(name) == 0 {
+		switch strings.ToLower(driver) {
+		case "postgres", "pgx", "postgresql":
+			name = "postgres"
+		case "mysql":
+			name = "mysql"
+		case "sqlite", "sqlite3":
+			name = "sqlite"
+		}
+	}
+	d, ok := dialects[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("不支持的数据库方言:dialect=%s,driver=%s", name, driver)
+	}
+	return d, nil
+}
+
+/**
+ * 将使用?作为占位符的SQL语句转换为当前方言的占位符。
+ */
+func (d *Dialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(d.placeholder(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+/**
+ * 返回追加在INSERT语句之后、主键冲突时忽略该插入的子句，key为主键中的任意一列。
+ * MySQL不使用INSERT IGNORE，以免同时忽略数据截断等其他错误。
+ */
+func (d *Dialect) IgnoreConflict(key string) string {
+	return d.ignoreConflict(key)
+}
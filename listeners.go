@@ -0,0 +1,175 @@
+package amq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aluka-7/amq/provider"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 客户端监听的一个队列的状态。
+ */
+type PartitionStatus struct {
+	Partition int    `json:"partition"`       // 分区编号，-1表示未分区的队列(单分区节点的队列或死信队列)
+	Queue     string `json:"queue"`           // 队列名称
+	Listening bool   `json:"listening"`       // 是否正在监听
+	Since     int64  `json:"since"`           // 开始或停止监听的时间(毫秒)
+	Error     string `json:"error,omitempty"` // 最后一次监听失败的错误信息
+}
+
+/**
+ * 客户端监听的一个队列。
+ */
+type queueListener struct {
+	status PartitionStatus
+	closer func()
+}
+
+/**
+ * 监听指定的队列并记录关闭监听的方法，监听失败时记录错误信息，配置了并发处理时为该队列创建协程池。
+ */
+func (c *Client) listen(queue string, partition int, listener provider.MessageListener) error {
+	var pool *workerPool
+	if l, ok := listener.(*defaultMessageListener); ok && c.concurrency != nil {
+		pool = newWorkerPool(c, queue, l)
+		listener = pool.listener
+	}
+	closer, err := c.provider.Listen(queue, listener)
+	if pool != nil {
+		if err != nil {
+			pool.close()
+		} else {
+			// 停止投递后等待协程处理完缓冲中的消息
+			stop := closer
+			closer = func() {
+				stop()
+				pool.close()
+			}
+		}
+	}
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	ql := &queueListener{status: PartitionStatus{Partition: partition, Queue: queue, Listening: err == nil, Since: nowMillis()}, closer: closer}
+	if err != nil {
+		ql.status.Error = err.Error()
+		err = fmt.Errorf("[AMQ-Client-%s]监听队列失败:queue=%s,%v", c.node.String(), queue, err)
+	}
+	c.listeners[queue] = ql
+	return err
+}
+
+/**
+ * 停止监听指定的队列，关闭方法返回时处理中的消息已处理完成。
+ */
+func (c *Client) unlisten(queue string) {
+	c.listenersMu.Lock()
+	ql, ok := c.listeners[queue]
+	if !ok || ql.closer == nil {
+		c.listenersMu.Unlock()
+		return
+	}
+	closer := ql.closer
+	ql.closer = nil
+	c.listenersMu.Unlock()
+	// 处理中的消息完成之前仍然视为正在监听
+	closer()
+	c.listenersMu.Lock()
+	ql.status.Listening = false
+	ql.status.Since = nowMillis()
+	c.listenersMu.Unlock()
+	log.Info().Msgf("[AMQ-Client-%s]停止监听AMQ消息队列:queue=%s", c.node.String(), queue)
+}
+
+/**
+ * 停止监听所有的队列，包括消费组分配的分区。
+ */
+func (c *Client) unlistenAll() {
+	if c.group != nil {
+		c.group.close()
+	}
+	c.listenersMu.Lock()
+	queues := make([]string, 0, len(c.listeners))
+	for queue := range c.listeners {
+		queues = append(queues, queue)
+	}
+	c.listenersMu.Unlock()
+	for _, queue := range queues {
+		c.unlisten(queue)
+	}
+}
+
+/**
+ * 获取客户端监听的所有队列的状态，按照分区编号排序。
+ *
+ * @return
+ */
+func (c *Client) PartitionStatus() []PartitionStatus {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	status := make([]PartitionStatus, 0, len(c.listeners))
+	for _, ql := range c.listeners {
+		status = append(status, ql.status)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Partition != status[j].Partition {
+			return status[i].Partition < status[j].Partition
+		}
+		return status[i].Queue < status[j].Queue
+	})
+	return status
+}
+
+/**
+ * 停止监听客户端在{@link #Start}中监听的所有队列(包括死信队列和消费组分配的分区)，并等待处理中的消息完成，
+ * ctx超时或取消时不再等待并返回ctx的错误，停止后客户端仍然可以发送消息，释放其他资源请调用{@link #Shutdown}或{@link #Close}。
+ *
+ * @param ctx
+ * @return
+ */
+func (c *Client) Stop(ctx context.Context) error {
+	return c.awaitStopped(ctx, c.unlistenAsync())
+}
+
+/**
+ * 在后台停止监听所有的队列，返回的channel在所有队列都已停止监听并且处理中的消息完成后关闭。
+ */
+func (c *Client) unlistenAsync() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.unlistenAll()
+	}()
+	return done
+}
+
+/**
+ * 等待停止监听完成，ctx超时或取消时不再等待并返回ctx的错误。
+ */
+func (c *Client) awaitStopped(ctx context.Context, stopped <-chan struct{}) error {
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		log.Warn().Msgf("[AMQ-Client-%s]等待停止监听超时", c.node.String())
+		return ctx.Err()
+	}
+}
+
+/**
+ * 依次监听给定分区的队列，返回所有分区的监听错误。
+ */
+func (c *Client) listenPartitions(partitions []int, listener provider.MessageListener) error {
+	var errs []error
+	for _, p := range partitions {
+		queueName := c.BuildQueueNameByPartition(c.systemId, p)
+		log.Info().Msgf("[AMQ-Client-%s]启动监听AMQ多分区消息队列:partition=%d,queue=%s", c.node.String(), p, queueName)
+		if err := c.listen(queueName, p, listener); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+package amq_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+)
+
+/**
+ * 记录打开的监听，监听名称以failSuffix结尾的队列时失败的provider。
+ */
+type listenFailProvider struct {
+	mu         sync.Mutex
+	failSuffix string
+	open       map[string]bool
+}
+
+var listenFail = &listenFailProvider{open: make(map[string]bool)}
+
+func init() {
+	provider.Register("listen-fail-test", listenFail)
+}
+
+func (p *listenFailProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	return p
+}
+
+func (p *listenFailProvider) Listen(name string, listener provider.MessageListener) (func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.failSuffix) > 0 && strings.HasSuffix(name, p.failSuffix) {
+		return nil, errors.New("监听失败")
+	}
+	p.open[name] = true
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.open, name)
+	}, nil
+}
+
+func (p *listenFailProvider) Cancel(name string) {}
+
+func (p *listenFailProvider) Send(msg interface{}) error {
+	return nil
+}
+
+func (p *listenFailProvider) Close() {}
+
+func (p *listenFailProvider) opened() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.open)
+}
+
+func TestStartRollback(t *testing.T) {
+	c := newTestClient(t, "1118", `{"provider":"listen-fail-test","partitions":3,"deadLetter":{}}`)
+	c.AddProcessor(newTestProcessor("rollback", 0))
+	listenFail.mu.Lock()
+	listenFail.failSuffix = "_p2"
+	listenFail.mu.Unlock()
+
+	// 最后一个分区监听失败时关闭已经打开的死信队列和其他分区的监听，保留失败的原因
+	if _, err := c.Start(nil); err == nil {
+		t.Fatal("监听失败时应启动失败")
+	}
+	if n := listenFail.opened(); n != 0 {
+		t.Fatalf("启动失败后仍有%d个监听未关闭", n)
+	}
+	failed := false
+	for _, status := range c.PartitionStatus() {
+		if status.Partition == 2 {
+			failed = !status.Listening && len(status.Error) > 0
+		}
+	}
+	if !failed {
+		t.Fatalf("分区状态中没有记录失败的原因:%+v", c.PartitionStatus())
+	}
+
+	// 恢复后可以重新启动
+	listenFail.mu.Lock()
+	listenFail.failSuffix = ""
+	listenFail.mu.Unlock()
+	closer, err := c.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := listenFail.opened(); n != 4 {
+		t.Fatalf("重新启动后应监听死信队列和3个分区，实际为%d", n)
+	}
+	closer()
+	if n := listenFail.opened(); n != 0 {
+		t.Fatalf("关闭后仍有%d个监听未关闭", n)
+	}
+}
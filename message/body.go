@@ -0,0 +1,197 @@
+package message
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+/**
+ * 设置任意类型的值，字符串保存在{@link MsgBody#Body}中，其他类型序列化为JSON后保存在{@link MsgBody#Data}中，
+ * 如需保留高精度的小数可传入json.Number。
+ *
+ * @param key
+ * @param value
+ * @return
+ */
+func (mb *MsgBody) Set(key string, value interface{}) error {
+	if s, ok := value.(string); ok {
+		mb.Add(key, s)
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("AMQ消息体序列化失败:key=%s,%v", key, err)
+	}
+	mb.setRaw(key, raw)
+	return nil
+}
+
+/**
+ * 设置二进制数据，以Base64编码的JSON字符串保存，使用{@link #GetBytes}读取。
+ */
+func (mb *MsgBody) SetBytes(key string, value []byte) *MsgBody {
+	raw, _ := json.Marshal(base64.StdEncoding.EncodeToString(value))
+	mb.setRaw(key, raw)
+	return mb
+}
+
+func (mb *MsgBody) setRaw(key string, raw json.RawMessage) {
+	if mb.Data == nil {
+		mb.Data = make(map[string]json.RawMessage, 1)
+	}
+	mb.Data[key] = raw
+	delete(mb.Body, key)
+}
+
+/**
+ * 将指定键的值反序列化到value中(需传入指针)，兼容旧版本以字符串形式保存的数字和布尔值。
+ *
+ * @param key
+ * @param value
+ * @return
+ */
+func (mb *MsgBody) GetValue(key string, value interface{}) error {
+	raw, ok := mb.raw(key)
+	if !ok {
+		return fmt.Errorf("AMQ消息体中不存在:key=%s", key)
+	}
+	err := json.Unmarshal(raw, value)
+	if err != nil {
+		if legacy, ok := mb.legacyRaw(key); ok && json.Unmarshal(legacy, value) == nil {
+			return nil
+		}
+		return fmt.Errorf("AMQ消息体反序列化失败:key=%s,%v", key, err)
+	}
+	return nil
+}
+
+func (mb *MsgBody) GetBool(key string) bool {
+	var v bool
+	_ = mb.GetValue(key, &v)
+	return v
+}
+
+/**
+ * 获取通过{@link #SetBytes}设置的二进制数据，不存在或者格式错误时返回nil。
+ */
+func (mb *MsgBody) GetBytes(key string) []byte {
+	var v []byte
+	if err := mb.GetValue(key, &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+/**
+ * 返回消息体中所有的键。
+ */
+func (mb *MsgBody) Keys() []string {
+	keys := make([]string, 0, len(mb.Body)+len(mb.Data))
+	for k := range mb.Body {
+		keys = append(keys, k)
+	}
+	for k := range mb.Data {
+		if _, ok := mb.Body[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+/**
+ * 获取指定键的JSON表示，字符串值被编码为JSON字符串。
+ */
+func (mb *MsgBody) raw(key string) (json.RawMessage, bool) {
+	if mb == nil {
+		return nil, false
+	}
+	if v, ok := mb.Body[key]; ok {
+		raw, _ := json.Marshal(v)
+		return raw, true
+	}
+	raw, ok := mb.Data[key]
+	return raw, ok
+}
+
+/**
+ * 旧版本的消息体将数字和布尔值保存为字符串，此时将字符串内容直接作为JSON值。
+ */
+func (mb *MsgBody) legacyRaw(key string) (json.RawMessage, bool) {
+	v, ok := mb.Body[key]
+	if !ok {
+		return nil, false
+	}
+	if v == "true" || v == "false" {
+		return json.RawMessage(v), true
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil && json.Valid([]byte(v)) {
+		return json.RawMessage(v), true
+	}
+	return nil, false
+}
+
+/**
+ * 将业务对象(结构体或者map)编码为消息体，对象的每个顶层字段对应消息体中的一个键，字符串字段保存在{@link MsgBody#Body}中，
+ * 使只读取字符串的旧版本接收方仍可正常处理。
+ *
+ * @param v
+ * @return
+ */
+func Encode(v interface{}) (*MsgBody, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("AMQ消息体序列化失败:%v", err)
+	}
+	fields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("AMQ消息体只支持编码为JSON对象的值:%T", v)
+	}
+	mb := NewMessageBody()
+	for k, raw := range fields {
+		var s string
+		if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+			mb.Body[k] = s
+		} else {
+			mb.setRaw(k, raw)
+		}
+	}
+	return mb, nil
+}
+
+/**
+ * 将消息体解码为业务对象，是{@link Encode}的逆操作，兼容旧版本以字符串形式保存的数字和布尔值。
+ *
+ * @param body
+ * @return
+ */
+func Decode[T any](body *MsgBody) (T, error) {
+	var v T
+	if body == nil {
+		return v, nil
+	}
+	fields := make(map[string]json.RawMessage, len(body.Body)+len(body.Data))
+	for _, k := range body.Keys() {
+		fields[k], _ = body.raw(k)
+	}
+	data, _ := json.Marshal(fields)
+	err := json.Unmarshal(data, &v)
+	if err == nil {
+		return v, nil
+	}
+	legacy := false
+	for k := range body.Body {
+		if raw, ok := body.legacyRaw(k); ok {
+			fields[k], legacy = raw, true
+		}
+	}
+	if legacy {
+		var lv T
+		data, _ = json.Marshal(fields)
+		if json.Unmarshal(data, &lv) == nil {
+			return lv, nil
+		}
+	}
+	return v, fmt.Errorf("AMQ消息体反序列化失败:%v", err)
+}
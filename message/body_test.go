@@ -0,0 +1,80 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type testOrder struct {
+	Id     string            `json:"id"`
+	Amount json.Number       `json:"amount"`
+	Paid   bool              `json:"paid"`
+	Items  []string          `json:"items"`
+	Extra  map[string]int    `json:"extra"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func TestEncodeDecode(t *testing.T) {
+	want := testOrder{Id: "o1", Amount: "12345678901234567.89", Paid: true, Items: []string{"a", "b"}, Extra: map[string]int{"n": 1}}
+	body, err := Encode(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 字符串字段保存在Body中，旧版本的接收方可以直接读取
+	if _, ok := body.Body["amount"]; ok || body.Get("id") != "o1" {
+		t.Fatalf("字符串字段应保存在Body中:%+v", body)
+	}
+	got, err := Decode[testOrder](body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("解码后的对象不一致:%+v", got)
+	}
+	if _, err = Encode([]string{"a"}); err == nil {
+		t.Fatal("非JSON对象的值应编码失败")
+	}
+}
+
+func TestDecodeLegacyBody(t *testing.T) {
+	// 旧版本的发送方将数字和布尔值以字符串形式保存
+	body := NewMessageBody().Add("id", "o1").Add("amount", "12.5").Add("paid", "true")
+	got, err := Decode[testOrder](body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != "o1" || got.Amount != "12.5" || !got.Paid {
+		t.Fatalf("旧版本的消息体解码错误:%+v", got)
+	}
+	var amount float64
+	if err = body.GetValue("amount", &amount); err != nil || amount != 12.5 || !body.GetBool("paid") {
+		t.Fatalf("旧版本的消息体读取错误:%v,%v", amount, err)
+	}
+}
+
+func TestBodySetAndGet(t *testing.T) {
+	body := NewMessageBody()
+	if err := body.Set("n", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := body.Set("s", "text"); err != nil {
+		t.Fatal(err)
+	}
+	body.SetBytes("b", []byte{0, 1, 255})
+	if body.GetInt("n") != 42 || body.Get("s") != "text" || !bytes.Equal(body.GetBytes("b"), []byte{0, 1, 255}) {
+		t.Fatalf("消息体读取错误:%+v", body)
+	}
+	// 同一个键以其他类型重新设置时覆盖原来的值
+	body.Add("n", "x")
+	if err := body.Set("s", 1); err != nil {
+		t.Fatal(err)
+	}
+	if body.Get("n") != "x" || body.GetInt("s") != 1 || len(body.Keys()) != 3 {
+		t.Fatalf("重新设置后的消息体错误:%+v", body)
+	}
+	if err := body.GetValue("missing", new(int)); err == nil {
+		t.Fatal("不存在的键应返回错误")
+	}
+}
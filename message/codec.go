@@ -0,0 +1,181 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/**
+ * AMQ消息在传输时的编解码器，目前内置了JSON(默认)、MessagePack和Protobuf三种实现，可通过{@link RegisterCodec}注册自定义实现。
+ * 提供器通过{@link Marshal}和{@link Unmarshal}收发消息，非JSON编码的消息前会附加内容类型标记，接收方据此自动识别编解码器，
+ * 因此同一个队列中可以同时存在不同编码的消息。
+ */
+type Codec interface {
+	/**
+	 * 编解码器名称，对应节点配置中的codec。
+	 */
+	Name() string
+
+	/**
+	 * 编码后内容的类型，写入消息的内容类型标记中。
+	 */
+	ContentType() string
+
+	Marshal(mpl *MsgPayload) ([]byte, error)
+
+	Unmarshal(data []byte, mpl *MsgPayload) error
+}
+
+var (
+	codecsMu     sync.RWMutex
+	codecs       = make(map[string]Codec)
+	contentTypes = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(MsgpackCodec)
+	RegisterCodec(ProtobufCodec)
+}
+
+/**
+ * 注册编解码器，名称或内容类型重复时会抛出异常。
+ *
+ * @param codec
+ */
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if codec == nil {
+		panic("amq: RegisterCodec codec is nil")
+	}
+	name := strings.ToLower(codec.Name())
+	if _, dup := codecs[name]; dup {
+		panic("amq: RegisterCodec called twice for codec " + name)
+	}
+	if _, dup := contentTypes[codec.ContentType()]; dup {
+		panic("amq: RegisterCodec called twice for content type " + codec.ContentType())
+	}
+	codecs[name] = codec
+	contentTypes[codec.ContentType()] = codec
+}
+
+/**
+ * 根据名称获取编解码器，名称为空时返回默认的{@link JSONCodec}。
+ *
+ * @param name
+ * @return
+ */
+func GetCodec(name string) (Codec, error) {
+	if len(name) == 0 {
+		return JSONCodec, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if c, ok := codecs[strings.ToLower(name)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("不支持的AMQ消息编码:%s", name)
+}
+
+/**
+ * 内容类型标记的起始字节，JSON编码的消息总是以'{'开头，因此不会与标记冲突。
+ */
+const codecMarker = 0x00
+
+/**
+ * 使用指定的编解码器编码消息，JSON编码不附加标记以兼容旧版本的接收方，其他编码的格式为：
+ * <pre>
+ * 0x00 | 内容类型长度(1字节) | 内容类型 | 编码后的消息
+ * </pre>
+ *
+ * @param codec 为nil时使用{@link JSONCodec}
+ * @param mpl
+ * @return
+ */
+func Marshal(codec Codec, mpl *MsgPayload) ([]byte, error) {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	data, err := codec.Marshal(mpl)
+	if err != nil {
+		return nil, err
+	}
+	if codec == JSONCodec {
+		return data, nil
+	}
+	ct := codec.ContentType()
+	if len(ct) > 255 {
+		return nil, fmt.Errorf("AMQ消息的内容类型过长:%s", ct)
+	}
+	out := make([]byte, 0, 2+len(ct)+len(data))
+	out = append(out, codecMarker, byte(len(ct)))
+	out = append(out, ct...)
+	return append(out, data...), nil
+}
+
+/**
+ * 根据内容类型标记自动识别编解码器并解码消息，没有标记的消息按JSON解码。
+ *
+ * @param data
+ * @return
+ */
+func Unmarshal(data []byte) (*MsgPayload, error) {
+	codec, body, err := DetectCodec(data)
+	if err != nil {
+		return nil, err
+	}
+	mpl := new(MsgPayload)
+	if err = codec.Unmarshal(body, mpl); err != nil {
+		return nil, err
+	}
+	return mpl, nil
+}
+
+/**
+ * 识别消息使用的编解码器，返回编解码器和去掉标记后的消息内容。
+ *
+ * @param data
+ * @return
+ */
+func DetectCodec(data []byte) (Codec, []byte, error) {
+	if len(data) == 0 || data[0] != codecMarker {
+		return JSONCodec, data, nil
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, nil, fmt.Errorf("AMQ消息的内容类型标记不完整")
+	}
+	ct := string(data[2 : 2+int(data[1])])
+	codecsMu.RLock()
+	codec, ok := contentTypes[ct]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("不支持的AMQ消息内容类型:%s", ct)
+	}
+	return codec, data[2+int(data[1]):], nil
+}
+
+/**
+ * JSON编解码器，与旧版本的消息格式完全一致。
+ */
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(mpl *MsgPayload) ([]byte, error) {
+	return json.Marshal(mpl)
+}
+
+func (jsonCodec) Unmarshal(data []byte, mpl *MsgPayload) error {
+	return json.Unmarshal(data, mpl)
+}
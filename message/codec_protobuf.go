@@ -0,0 +1,309 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/**
+ * Protobuf编解码器，按照如下的消息定义直接编码，接收方可以使用任意语言根据该定义生成代码解析：
+ * <pre>
+ * syntax = "proto3";
+ *
+ * message MsgPayload {
+ *   string category = 1;
+ *   string type = 2;
+ *   string msgId = 3;
+ *   string srcAckQueue = 4;
+ *   string dstNewQueue = 5;
+ *   string dstAckQueue = 6;
+ *   MsgBody body = 7;
+ *   int64 sendTime = 8;
+ *   string phase = 9;
+ *   string keyId = 10;
+ *   string sign = 11;
+ *   string forward = 12;
+ *   string compression = 13;
+ *   bytes envelope = 14;
+ *   string encryption = 15;
+ *   string cipherKeyId = 16;
+ *   Failure failure = 17;
+ *   int64 deliverAt = 18;
+ *   int64 expiresAt = 19;
+ *   bool expired = 20;
+ *   string partitionKey = 21;
+ * }
+ *
+ * message MsgBody {
+ *   map<string, string> body = 1;
+ *   map<string, bytes> data = 2; // 原始JSON
+ * }
+ *
+ * message Failure {
+ *   string queue = 1;
+ *   string error = 2;
+ *   int64 attempts = 3;
+ *   int64 firstFailedAt = 4;
+ *   int64 lastFailedAt = 5;
+ * }
+ * </pre>
+ * {@link MsgPayload}新增字段时需同步在此处分配新的字段编号。
+ */
+var ProtobufCodec Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) Marshal(mpl *MsgPayload) ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, string(mpl.Category))
+	b = appendString(b, 2, mpl.Genre)
+	b = appendString(b, 3, mpl.MsgId)
+	b = appendString(b, 4, mpl.SrcAckQueue)
+	b = appendString(b, 5, mpl.DstNewQueue)
+	b = appendString(b, 6, mpl.DstAckQueue)
+	if mpl.Body != nil {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProtoBody(mpl.Body))
+	}
+	if mpl.SendTime != 0 {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(mpl.SendTime))
+	}
+	b = appendString(b, 9, string(mpl.Phase))
+	b = appendString(b, 10, mpl.KeyId)
+	b = appendString(b, 11, mpl.Sign)
+	b = appendString(b, 12, mpl.Forward)
+	b = appendString(b, 13, mpl.Compression)
+	if len(mpl.Envelope) > 0 {
+		b = protowire.AppendTag(b, 14, protowire.BytesType)
+		b = protowire.AppendBytes(b, mpl.Envelope)
+	}
+	b = appendString(b, 15, mpl.Encryption)
+	b = appendString(b, 16, mpl.CipherKeyId)
+	if mpl.Failure != nil {
+		b = protowire.AppendTag(b, 17, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProtoFailure(mpl.Failure))
+	}
+	if mpl.DeliverAt != 0 {
+		b = protowire.AppendTag(b, 18, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(mpl.DeliverAt))
+	}
+	if mpl.ExpiresAt != 0 {
+		b = protowire.AppendTag(b, 19, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(mpl.ExpiresAt))
+	}
+	if mpl.Expired {
+		b = protowire.AppendTag(b, 20, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	b = appendString(b, 21, mpl.PartitionKey)
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, mpl *MsgPayload) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 7 && typ == protowire.BytesType:
+			mpl.Body = &MsgBody{}
+			return unmarshalProtoBody(v, mpl.Body)
+		case num == 8 && typ == protowire.VarintType:
+			mpl.SendTime = int64(x)
+		case num == 18 && typ == protowire.VarintType:
+			mpl.DeliverAt = int64(x)
+		case num == 19 && typ == protowire.VarintType:
+			mpl.ExpiresAt = int64(x)
+		case num == 20 && typ == protowire.VarintType:
+			mpl.Expired = x != 0
+		case num == 17 && typ == protowire.BytesType:
+			mpl.Failure = &Failure{}
+			return unmarshalProtoFailure(v, mpl.Failure)
+		case typ == protowire.BytesType:
+			switch num {
+			case 1:
+				mpl.Category = _MessageCategory(v)
+			case 2:
+				mpl.Genre = string(v)
+			case 3:
+				mpl.MsgId = string(v)
+			case 4:
+				mpl.SrcAckQueue = string(v)
+			case 5:
+				mpl.DstNewQueue = string(v)
+			case 6:
+				mpl.DstAckQueue = string(v)
+			case 9:
+				mpl.Phase = _MessagePhase(v)
+			case 10:
+				mpl.KeyId = string(v)
+			case 11:
+				mpl.Sign = string(v)
+			case 12:
+				mpl.Forward = string(v)
+			case 13:
+				mpl.Compression = string(v)
+			case 14:
+				mpl.Envelope = append([]byte(nil), v...)
+			case 15:
+				mpl.Encryption = string(v)
+			case 16:
+				mpl.CipherKeyId = string(v)
+			case 21:
+				mpl.PartitionKey = string(v)
+			}
+		}
+		return nil
+	})
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+/**
+ * 编码消息体，map按键排序以保证相同的消息体编码结果一致。
+ */
+func marshalProtoBody(mb *MsgBody) []byte {
+	var b []byte
+	keys := make([]string, 0, len(mb.Body))
+	for k := range mb.Body {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, mb.Body[k])
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	keys = keys[:0]
+	for k := range mb.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, mb.Data[k])
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalProtoBody(data []byte, mb *MsgBody) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return nil
+		}
+		var key, value []byte
+		err := consumeFields(v, func(n protowire.Number, t protowire.Type, ev []byte, _ uint64) error {
+			if t == protowire.BytesType && n == 1 {
+				key = ev
+			} else if t == protowire.BytesType && n == 2 {
+				value = ev
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if num == 1 {
+			if mb.Body == nil {
+				mb.Body = make(map[string]string)
+			}
+			mb.Body[string(key)] = string(value)
+		} else {
+			if mb.Data == nil {
+				mb.Data = make(map[string]json.RawMessage)
+			}
+			mb.Data[string(key)] = append(json.RawMessage(nil), value...)
+		}
+		return nil
+	})
+}
+
+func marshalProtoFailure(f *Failure) []byte {
+	var b []byte
+	b = appendString(b, 1, f.Queue)
+	b = appendString(b, 2, f.Error)
+	for num, v := range []int64{3: int64(f.Attempts), 4: f.FirstFailedAt, 5: f.LastFailedAt} {
+		if v != 0 {
+			b = protowire.AppendTag(b, protowire.Number(num), protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	}
+	return b
+}
+
+func unmarshalProtoFailure(data []byte, f *Failure) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			f.Queue = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			f.Error = string(v)
+		case num == 3 && typ == protowire.VarintType:
+			f.Attempts = int(x)
+		case num == 4 && typ == protowire.VarintType:
+			f.FirstFailedAt = int64(x)
+		case num == 5 && typ == protowire.VarintType:
+			f.LastFailedAt = int64(x)
+		}
+		return nil
+	})
+}
+
+/**
+ * 依次解析每个字段，变长整数类型的值通过x返回，长度分隔类型的值通过v返回，其他类型的字段直接跳过。
+ */
+func consumeFields(data []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("AMQ消息解析失败:%v", protowire.ParseError(n))
+		}
+		data = data[n:]
+		var (
+			v []byte
+			x uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("AMQ消息解析失败:%v", protowire.ParseError(n))
+		}
+		data = data[n:]
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := fn(num, typ, v, x); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+/**
+ * 每个会被编码的字段都设置了非零值的消息，新增字段时如果忘记赋值则测试失败，避免漏掉编解码器的支持。
+ */
+func fullPayload(t *testing.T) *MsgPayload {
+	mpl := &MsgPayload{
+		Category:    DUPLEX,
+		Genre:       "order",
+		MsgId:       "10012024010112000000000001",
+		SrcAckQueue: "sys_amq_1001_biz",
+		DstNewQueue: "sys_amq_1002_biz",
+		DstAckQueue: "sys_amq_1002_biz",
+		Body: &MsgBody{
+			Body: map[string]string{"k": "v", "empty": ""},
+			Data: map[string]json.RawMessage{"n": json.RawMessage(`12`), "o": json.RawMessage(`{"a":[1,true,null]}`)},
+		},
+		SendTime:     1700000000,
+		Phase:        ReceiverAck,
+		KeyId:        "k1",
+		Sign:         "sign",
+		Forward:      "sys_amq_1001_biz_quarantine",
+		Compression:  "gzip",
+		Envelope:     []byte{0, 1, 2, 255},
+		Encryption:   AESGCM,
+		CipherKeyId:  "c1",
+		Failure:      &Failure{Queue: "sys_amq_1002_biz", Error: "失败", Attempts: 3, FirstFailedAt: 1700000000001, LastFailedAt: 1700000000002},
+		DeliverAt:    1700000001000,
+		ExpiresAt:    1700000002000,
+		Expired:      true,
+		PartitionKey: "customer-1",
+	}
+	v := reflect.ValueOf(mpl).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.Tag.Get("json") != "-" && v.Field(i).IsZero() {
+			t.Fatalf("测试消息的字段%s未赋值", f.Name)
+		}
+	}
+	return mpl
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range []string{"json", "msgpack", "protobuf"} {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fullPayload(t)
+		data, err := Marshal(codec, want)
+		if err != nil {
+			t.Fatalf("%s编码失败:%v", name, err)
+		}
+		if detected, _, _ := DetectCodec(data); detected != codec {
+			t.Fatalf("%s编码的消息被识别为%s", name, detected.Name())
+		}
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s解码失败:%v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s编解码后的消息不一致:\n%+v\n%+v", name, got, want)
+		}
+		if Signature(got) != Signature(want) {
+			t.Fatalf("%s编解码后的签名内容发生了变化", name)
+		}
+	}
+}
+
+func TestCodecRoundTripEmptyBody(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec, ProtobufCodec} {
+		want := &MsgPayload{Category: NOTICE, MsgId: "10012024010112000000000002", Phase: SenderReq, Body: NewMessageBody()}
+		data, err := Marshal(codec, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Failure != nil || got.Body == nil || len(got.Body.Body) != 0 || len(got.Body.Data) != 0 {
+			t.Fatalf("%s编解码后的空消息体不一致:%+v", codec.Name(), got)
+		}
+	}
+}
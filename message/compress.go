@@ -0,0 +1,235 @@
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+/**
+ * 消息体的压缩算法，目前内置了gzip、zstd和snappy三种实现，可通过{@link RegisterCompressor}注册自定义实现。
+ */
+type Compressor interface {
+	/**
+	 * 压缩算法名称，记录在{@link MsgPayload#Compression}中，接收方据此选择解压算法。
+	 */
+	Name() string
+
+	Compress(data []byte) ([]byte, error)
+
+	Decompress(data []byte) ([]byte, error)
+}
+
+/**
+ * 解压后消息体的最大长度，防止恶意构造的压缩数据耗尽内存。
+ */
+const maxDecompressedSize = 64 << 20
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[string]Compressor)
+)
+
+func init() {
+	RegisterCompressor(gzipCompressor{})
+	RegisterCompressor(&zstdCompressor{})
+	RegisterCompressor(snappyCompressor{})
+}
+
+/**
+ * 注册压缩算法，名称重复时会抛出异常。
+ *
+ * @param compressor
+ */
+func RegisterCompressor(compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if compressor == nil {
+		panic("amq: RegisterCompressor compressor is nil")
+	}
+	name := strings.ToLower(compressor.Name())
+	if _, dup := compressors[name]; dup {
+		panic("amq: RegisterCompressor called twice for compressor " + name)
+	}
+	compressors[name] = compressor
+}
+
+/**
+ * 根据名称获取压缩算法。
+ *
+ * @param name
+ * @return
+ */
+func GetCompressor(name string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	if c, ok := compressors[strings.ToLower(name)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("不支持的AMQ消息压缩算法:%s", name)
+}
+
+/**
+ * 当消息体序列化后的长度不小于threshold时使用指定的算法压缩，压缩后的内容保存在{@link MsgPayload#Envelope}中并清空消息体，
+ * 压缩后没有变小的消息保持不变。压缩需要在签名之前进行，使签名覆盖压缩后的内容。
+ *
+ * @param mpl
+ * @param compressor
+ * @param threshold
+ * @return
+ */
+func Compress(mpl *MsgPayload, compressor Compressor, threshold int) error {
+	if compressor == nil || mpl.Body == nil || len(mpl.Envelope) > 0 {
+		return nil
+	}
+	data, err := json.Marshal(mpl.Body)
+	if err != nil {
+		return err
+	}
+	if len(data) < threshold {
+		return nil
+	}
+	compressed, err := compressor.Compress(data)
+	if err != nil {
+		return fmt.Errorf("AMQ消息压缩失败:msgId=%s,%v", mpl.MsgId, err)
+	}
+	if len(compressed) >= len(data) {
+		return nil
+	}
+	mpl.Compression = compressor.Name()
+	mpl.Envelope = compressed
+	mpl.Body = nil
+	return nil
+}
+
+/**
+ * 解压使用{@link Compress}压缩的消息体，未压缩的消息保持不变，加密的消息需先调用{@link Decrypt}解密。
+ * 解压会改变签名内容，因此需要在签名校验之后进行。
+ *
+ * @param mpl
+ * @return
+ */
+func Decompress(mpl *MsgPayload) error {
+	if len(mpl.Compression) == 0 {
+		return nil
+	}
+	if len(mpl.Encryption) > 0 {
+		return fmt.Errorf("AMQ消息解压失败:msgId=%s,消息体尚未解密", mpl.MsgId)
+	}
+	compressor, err := GetCompressor(mpl.Compression)
+	if err != nil {
+		return err
+	}
+	data, err := compressor.Decompress(mpl.Envelope)
+	if err != nil {
+		return fmt.Errorf("AMQ消息解压失败:msgId=%s,%v", mpl.MsgId, err)
+	}
+	body := new(MsgBody)
+	if err = json.Unmarshal(data, body); err != nil {
+		return fmt.Errorf("AMQ消息解压失败:msgId=%s,%v", mpl.MsgId, err)
+	}
+	mpl.Body = body
+	mpl.Compression = ""
+	mpl.Envelope = nil
+	return nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, fmt.Errorf("解压后的消息体超过最大长度:%d", maxDecompressedSize)
+	}
+	return out, nil
+}
+
+/**
+ * zstd的编码器和解码器可以并发使用，首次使用时创建。
+ */
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (z *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		if z.encoder, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.decoder, z.err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+	return z.err
+}
+
+func (z *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.encoder.EncodeAll(data, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.decoder.DecodeAll(data, nil)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxDecompressedSize {
+		return nil, fmt.Errorf("解压后的消息体超过最大长度:%d", maxDecompressedSize)
+	}
+	return snappy.Decode(nil, data)
+}
@@ -0,0 +1,63 @@
+package message
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, name := range []string{"gzip", "zstd", "snappy"} {
+		compressor, err := GetCompressor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := NewMessageBody().Add("text", string(bytes.Repeat([]byte("amq"), 1000)))
+		if err = body.Set("n", 12); err != nil {
+			t.Fatal(err)
+		}
+		mpl := &MsgPayload{MsgId: "10012024010112000000000004", Body: body}
+		if err = Compress(mpl, compressor, 1024); err != nil {
+			t.Fatal(err)
+		}
+		if mpl.Compression != name || mpl.Body != nil || len(mpl.Envelope) == 0 {
+			t.Fatalf("%s压缩后的消息不正确:%+v", name, mpl)
+		}
+		if err = Decompress(mpl); err != nil {
+			t.Fatal(err)
+		}
+		if mpl.Compression != "" || mpl.Envelope != nil || !reflect.DeepEqual(mpl.Body, body) {
+			t.Fatalf("%s解压后的消息体不一致:%+v", name, mpl.Body)
+		}
+	}
+}
+
+func TestCompressBelowThreshold(t *testing.T) {
+	compressor, _ := GetCompressor("gzip")
+	mpl := &MsgPayload{Body: NewMessageBody().Add("k", "v")}
+	if err := Compress(mpl, compressor, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if len(mpl.Compression) > 0 || mpl.Body == nil {
+		t.Fatal("小于阈值的消息体不应压缩")
+	}
+}
+
+func TestDecompressSizeLimit(t *testing.T) {
+	// 压缩后很小但解压后超过最大长度的消息体(解压炸弹)应被拒绝，而不是全部解压到内存中
+	bomb := make([]byte, maxDecompressedSize+1)
+	for _, name := range []string{"gzip", "zstd", "snappy"} {
+		compressor, _ := GetCompressor(name)
+		data, err := compressor.Compress(bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = compressor.Decompress(data); err == nil {
+			t.Fatalf("%s解压超过最大长度的消息体时应返回错误", name)
+		}
+		mpl := &MsgPayload{MsgId: "10012024010112000000000005", Compression: name, Envelope: data}
+		if err = Decompress(mpl); err == nil {
+			t.Fatalf("%s解压超过最大长度的消息体时应返回错误", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package message
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+/**
+ * 消息体的加密算法，目前仅支持AES-GCM。
+ */
+const AESGCM = "aes-gcm"
+
+/**
+ * 使用AES-GCM加密消息体，密钥长度为16、24或32字节，加密后的内容(随机nonce+密文)保存在{@link MsgPayload#Envelope}中并清空消息体；
+ * 如果消息体已被压缩则加密压缩后的内容。消息的分类、ID和阶段作为附加认证数据，使密文无法被挪用到其他消息中。
+ * 加密需要在签名之前进行，使签名覆盖密文。
+ *
+ * @param mpl
+ * @param keyId 密钥ID，接收方据此选择解密密钥
+ * @param key
+ * @return
+ */
+func Encrypt(mpl *MsgPayload, keyId string, key []byte) error {
+	if len(mpl.Encryption) > 0 || (mpl.Body == nil && len(mpl.Envelope) == 0) {
+		return nil
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	plain := mpl.Envelope
+	if len(plain) == 0 {
+		if plain, err = json.Marshal(mpl.Body); err != nil {
+			return err
+		}
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	mpl.Encryption = AESGCM
+	mpl.CipherKeyId = keyId
+	mpl.Envelope = aead.Seal(nonce, nonce, plain, additionalData(mpl))
+	mpl.Body = nil
+	return nil
+}
+
+/**
+ * 解密使用{@link Encrypt}加密的消息体，未加密的消息保持不变；解密后如果消息体仍是压缩的，需继续调用{@link Decompress}。
+ * 解密会改变签名内容，因此需要在签名校验之后进行。
+ *
+ * @param mpl
+ * @param key 与{@link MsgPayload#CipherKeyId}对应的密钥
+ * @return
+ */
+func Decrypt(mpl *MsgPayload, key []byte) error {
+	if len(mpl.Encryption) == 0 {
+		return nil
+	}
+	if mpl.Encryption != AESGCM {
+		return fmt.Errorf("不支持的AMQ消息加密算法:%s", mpl.Encryption)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if len(mpl.Envelope) < aead.NonceSize() {
+		return fmt.Errorf("AMQ消息解密失败:msgId=%s,密文不完整", mpl.MsgId)
+	}
+	nonce, sealed := mpl.Envelope[:aead.NonceSize()], mpl.Envelope[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, additionalData(mpl))
+	if err != nil {
+		return fmt.Errorf("AMQ消息解密失败:msgId=%s,%v", mpl.MsgId, err)
+	}
+	mpl.Encryption = ""
+	mpl.CipherKeyId = ""
+	if len(mpl.Compression) > 0 {
+		mpl.Envelope = plain
+		return nil
+	}
+	body := new(MsgBody)
+	if err = json.Unmarshal(plain, body); err != nil {
+		return fmt.Errorf("AMQ消息解密失败:msgId=%s,%v", mpl.MsgId, err)
+	}
+	mpl.Body = body
+	mpl.Envelope = nil
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AMQ消息加密密钥无效:%v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(mpl *MsgPayload) []byte {
+	return []byte(string(mpl.Category) + "@" + mpl.MsgId + "@" + string(mpl.Phase) + "@" + mpl.CipherKeyId)
+}
@@ -0,0 +1,68 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testCipherKey = []byte("0123456789abcdef0123456789abcdef")
+
+func encrypted(t *testing.T, compress bool) (*MsgPayload, *MsgBody) {
+	body := NewMessageBody().Add("card", "6222000000000000")
+	mpl := &MsgPayload{Category: SIMPLEX, MsgId: "10012024010112000000000006", Phase: SenderReq, Body: body}
+	if compress {
+		compressor, _ := GetCompressor("gzip")
+		mpl.Body = NewMessageBody().Add("card", string(make([]byte, 2048)))
+		body = mpl.Body
+		if err := Compress(mpl, compressor, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Encrypt(mpl, "c1", testCipherKey); err != nil {
+		t.Fatal(err)
+	}
+	if mpl.Encryption != AESGCM || mpl.CipherKeyId != "c1" || mpl.Body != nil {
+		t.Fatalf("加密后的消息不正确:%+v", mpl)
+	}
+	return mpl, body
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		mpl, body := encrypted(t, compress)
+		if err := Decrypt(mpl, testCipherKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := Decompress(mpl); err != nil {
+			t.Fatal(err)
+		}
+		if mpl.Encryption != "" || mpl.Envelope != nil || !reflect.DeepEqual(mpl.Body, body) {
+			t.Fatalf("解密后的消息体不一致:compress=%v,%+v", compress, mpl)
+		}
+	}
+}
+
+func TestDecryptAdditionalDataMismatch(t *testing.T) {
+	// 密文与消息的分类、ID、阶段和密钥ID绑定，挪用到其他消息中无法解密
+	tamper := map[string]func(mpl *MsgPayload){
+		"category":    func(mpl *MsgPayload) { mpl.Category = NOTICE },
+		"msgId":       func(mpl *MsgPayload) { mpl.MsgId = "10012024010112000000000007" },
+		"phase":       func(mpl *MsgPayload) { mpl.Phase = ReceiverAck },
+		"cipherKeyId": func(mpl *MsgPayload) { mpl.CipherKeyId = "c2" },
+	}
+	for field, fn := range tamper {
+		mpl, _ := encrypted(t, false)
+		fn(mpl)
+		if err := Decrypt(mpl, testCipherKey); err == nil {
+			t.Fatalf("修改%s后应解密失败", field)
+		}
+	}
+	mpl, _ := encrypted(t, false)
+	if err := Decrypt(mpl, []byte("fedcba9876543210fedcba9876543210")); err == nil {
+		t.Fatal("使用错误的密钥应解密失败")
+	}
+	mpl.Envelope = mpl.Envelope[:4]
+	if err := Decrypt(mpl, testCipherKey); err == nil {
+		t.Fatal("密文不完整时应解密失败")
+	}
+}
@@ -0,0 +1,167 @@
+package message
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * 消息ID生成器接口，客户端默认使用嵌入了所属系统ID的{@link NewIdGenerator}，可通过Client#SetIdGenerator替换。
+ */
+type IdGenerator interface {
+	/**
+	 * 生成一个新的全局唯一的消息ID。
+	 */
+	NextId() string
+}
+
+const (
+	timeWidth     = 13 // 毫秒时间戳
+	systemWidth   = 4  // 系统ID
+	instanceWidth = 6  // 实例标示(16进制)
+	seqWidth      = 6  // 同一毫秒内的序号
+	maxSeq        = 999999
+	msgIdLength   = timeWidth + systemWidth + instanceWidth + seqWidth
+)
+
+/**
+ * 默认的消息ID生成器，生成的ID为固定长度的字符串，按字典序排序即为生成的先后顺序，格式如下：
+ * <pre>
+ * {毫秒时间戳:13位}{系统ID:4位}{实例标示:6位16进制}{毫秒内序号:6位}
+ * </pre>
+ * 实例标示在生成器创建时随机生成，用于区分同一系统的多个实例；毫秒内序号单调递增，时钟回拨或序号用尽时沿用/借用下一毫秒，
+ * 保证同一个生成器产生的ID严格递增。
+ */
+type defaultIdGenerator struct {
+	mu       sync.Mutex
+	systemId string
+	instance string
+	lastTime int64
+	seq      int64
+}
+
+/**
+ * 创建嵌入了系统ID的默认消息ID生成器，系统ID必须为4位。
+ *
+ * @param systemId
+ * @return
+ */
+func NewIdGenerator(systemId string) (IdGenerator, error) {
+	if len(systemId) != systemWidth {
+		return nil, fmt.Errorf("系统ID必须为%d位:%s", systemWidth, systemId)
+	}
+	b := make([]byte, instanceWidth/2)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &defaultIdGenerator{systemId: systemId, instance: hex.EncodeToString(b)}, nil
+}
+
+func (g *defaultIdGenerator) NextId() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now > g.lastTime {
+		g.lastTime, g.seq = now, 0
+	} else if g.seq < maxSeq {
+		g.seq++
+	} else {
+		g.lastTime, g.seq = g.lastTime+1, 0
+	}
+	return fmt.Sprintf("%013d%s%s%06d", g.lastTime, g.systemId, g.instance, g.seq)
+}
+
+var (
+	generatorMu sync.RWMutex
+	generator   IdGenerator
+)
+
+func init() {
+	generator, _ = NewIdGenerator("0000")
+}
+
+/**
+ * 替换{@link NewMsgId}使用的全局消息ID生成器，默认生成器的系统ID为0000。该生成器仅用于兼容旧代码，
+ * 同一进程中存在多个AMQ引擎时会互相覆盖，请使用Client#NewMsgId生成带有所属系统ID的消息ID。
+ *
+ * @param g
+ */
+func SetIdGenerator(g IdGenerator) {
+	generatorMu.Lock()
+	defer generatorMu.Unlock()
+	generator = g
+}
+
+func nextId() string {
+	generatorMu.RLock()
+	defer generatorMu.RUnlock()
+	return generator.NextId()
+}
+
+/**
+ * 从消息ID中解析出的信息。
+ */
+type MsgIdInfo struct {
+	Time     time.Time // 消息ID的生成时间
+	SystemId string    // 生成消息ID的系统，旧版本的ID为空
+	Instance string    // 生成消息ID的实例标示，旧版本的ID为空
+	Sequence int64     // 毫秒内序号
+}
+
+/**
+ * 解析消息ID的生成时间和来源系统，同时兼容旧版本使用纳秒时间戳作为ID的格式。
+ *
+ * @param id
+ * @return
+ */
+func ParseMsgId(id string) (*MsgIdInfo, error) {
+	if len(id) == msgIdLength {
+		ms, err := strconv.ParseInt(id[:timeWidth], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("无效的消息ID:%s", id)
+		}
+		offset := timeWidth + systemWidth + instanceWidth
+		seq, err := strconv.ParseInt(id[offset:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("无效的消息ID:%s", id)
+		}
+		return &MsgIdInfo{
+			Time:     time.Unix(0, ms*int64(time.Millisecond)),
+			SystemId: id[timeWidth : timeWidth+systemWidth],
+			Instance: id[timeWidth+systemWidth : offset],
+			Sequence: seq,
+		}, nil
+	}
+	// 旧版本的纳秒时间戳
+	ns, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("无效的消息ID:%s", id)
+	}
+	return &MsgIdInfo{Time: time.Unix(0, ns)}, nil
+}
+
+/**
+ * 获取消息ID的生成时间。
+ */
+func MsgIdTime(id string) (time.Time, error) {
+	info, err := ParseMsgId(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.Time, nil
+}
+
+/**
+ * 获取生成消息ID的来源系统。
+ */
+func MsgIdSystem(id string) (string, error) {
+	info, err := ParseMsgId(id)
+	if err != nil {
+		return "", err
+	}
+	return info.SystemId, nil
+}
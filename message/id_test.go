@@ -0,0 +1,57 @@
+package message
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdGeneratorMonotonic(t *testing.T) {
+	g, err := NewIdGenerator("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := ""
+	for i := 0; i < 10000; i++ {
+		id := g.NextId()
+		if len(id) != msgIdLength {
+			t.Fatalf("消息ID长度错误:%s", id)
+		}
+		if id <= last {
+			t.Fatalf("消息ID不是严格递增的:%s,%s", last, id)
+		}
+		last = id
+	}
+}
+
+func TestIdGeneratorInvalidSystem(t *testing.T) {
+	if _, err := NewIdGenerator("10001"); err == nil {
+		t.Fatal("期望返回系统ID长度错误")
+	}
+}
+
+func TestParseMsgId(t *testing.T) {
+	g, err := NewIdGenerator("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Truncate(time.Millisecond)
+	info, err := ParseMsgId(g.NextId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SystemId != "1001" || len(info.Instance) != instanceWidth || info.Time.Before(before) || info.Time.After(time.Now()) {
+		t.Fatalf("消息ID解析错误:%+v", info)
+	}
+	// 兼容旧版本的纳秒时间戳
+	now := time.Now()
+	if info, err = ParseMsgId(strconv.FormatInt(now.UnixNano(), 10)); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Time.Equal(time.Unix(0, now.UnixNano())) || len(info.SystemId) != 0 {
+		t.Fatalf("旧版本消息ID解析错误:%+v", info)
+	}
+	if _, err = ParseMsgId("invalid"); err == nil {
+		t.Fatal("期望返回无效的消息ID错误")
+	}
+}
@@ -2,6 +2,8 @@ package message
 
 import (
 	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"sort"
@@ -72,11 +74,11 @@ type msgId struct {
 }
 
 /**
- * 创建一个新的MsgId实例并返回。
+ * 创建一个新的MsgId实例并返回，ID由全局的默认消息ID生成器生成，参看{@link SetIdGenerator}，需要嵌入所属系统ID时请使用Client#NewMsgId。
  */
 func NewMsgId() *msgId {
 	return &msgId{
-		msgId: utils.ToStr(time.Now().UnixNano()),
+		msgId: nextId(),
 	}
 }
 
@@ -89,9 +91,12 @@ func (mid msgId) Id() string {
 
 /**
  * AMQ消息体封装，提供流式操作。
+ * 字符串类型的值保存在Body中(与旧版本的扁平消息体完全兼容)，其他任意JSON值(数字、布尔、对象、数组、二进制数据等)以原始JSON
+ * 保存在Data中，参看{@link #Set}和{@link Decode}。
  */
 type MsgBody struct {
-	Body map[string]string `json:"body"`
+	Body map[string]string          `json:"body"`
+	Data map[string]json.RawMessage `json:"data,omitempty"`
 }
 
 func NewMessageBody() *MsgBody {
@@ -99,40 +104,66 @@ func NewMessageBody() *MsgBody {
 		Body: make(map[string]string, 0),
 	}
 }
+
+/**
+ * 以字符串形式添加一个值，需要保留值类型时请使用{@link #Set}。
+ */
 func (mb *MsgBody) Add(key string, value interface{}) *MsgBody {
 	if len(mb.Body) < 1 {
 		mb.Body = make(map[string]string, 1)
 	}
 	mb.Body[key] = utils.ToStr(value)
+	delete(mb.Data, key)
 	return mb
 }
 
 func (mb *MsgBody) HasKey(key string) bool {
-	_, ok := mb.Body[key]
+	if _, ok := mb.Body[key]; ok {
+		return true
+	}
+	_, ok := mb.Data[key]
 	return ok
 }
 
+/**
+ * 以字符串形式获取值，非字符串类型的值返回其JSON文本。
+ */
 func (mb *MsgBody) Get(key string) string {
-	return mb.Body[key]
+	if v, ok := mb.Body[key]; ok {
+		return v
+	}
+	raw, ok := mb.Data[key]
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
 }
 
 func (mb *MsgBody) GetInt(key string) int {
-	return utils.StrTo(mb.Body[key]).MustInt()
+	return utils.StrTo(mb.Get(key)).MustInt()
 }
 
 func (mb *MsgBody) GetInt64(key string) int64 {
-	return utils.StrTo(mb.Body[key]).MustInt64()
+	return utils.StrTo(mb.Get(key)).MustInt64()
 }
 
 func (mb *MsgBody) GetFloat(key string) float64 {
-	return utils.StrTo(mb.Body[key]).Float64()
+	return utils.StrTo(mb.Get(key)).Float64()
 }
 
 /**
- * 输出AMQ消息体内容
+ * 输出AMQ消息体内容，按键排序，字符串值输出为"key":"value"，其他值输出为紧凑格式的原始JSON，
+ * 只包含字符串值的消息体与旧版本的输出完全一致，因此旧版本的签名仍然有效。
  */
 func (mb *MsgBody) ToString() string {
-	size := len(mb.Body)
+	if mb == nil {
+		return ""
+	}
+	size := len(mb.Body) + len(mb.Data)
 	if size == 0 {
 		return ""
 	}
@@ -140,6 +171,11 @@ func (mb *MsgBody) ToString() string {
 	for k, _ := range mb.Body {
 		keys = append(keys, k)
 	}
+	for k, _ := range mb.Data {
+		if _, ok := mb.Body[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
 	sort.Strings(keys)
 	var buffer bytes.Buffer
 	buffer.WriteString("{")
@@ -149,9 +185,16 @@ func (mb *MsgBody) ToString() string {
 		}
 		buffer.WriteString("\"")
 		buffer.WriteString(k)
-		buffer.WriteString("\":\"")
-		buffer.WriteString(mb.Body[k])
-		buffer.WriteString("\"")
+		if v, ok := mb.Body[k]; ok {
+			buffer.WriteString("\":\"")
+			buffer.WriteString(v)
+			buffer.WriteString("\"")
+			continue
+		}
+		buffer.WriteString("\":")
+		if err := json.Compact(&buffer, mb.Data[k]); err != nil {
+			buffer.Write(mb.Data[k])
+		}
 	}
 	buffer.WriteString("}")
 	return buffer.String()
@@ -169,6 +212,16 @@ type Message struct {
 	genre string
 	msgId string
 	Body  *MsgBody
+	// 指定的投递时间(可选)，在此之前消息不会被投递给接收方
+	DeliverAt time.Time
+	// 延迟投递的时长(可选)，从发送时开始计算，同时设置了DeliverAt时以DeliverAt为准
+	Delay time.Duration
+	// 消息的过期时间(可选)，接收方在此之后收到的消息不再交给处理器
+	ExpiresAt time.Time
+	// 消息的有效时长(可选)，从投递时开始计算，同时设置了ExpiresAt时以ExpiresAt为准
+	TTL time.Duration
+	// 分区键(可选)，多分区节点上目标队列未指定分区时按照分区键选择分区，相同分区键的消息进入同一个分区队列
+	PartitionKey string
 }
 
 func NewMessage(mid *msgId) *Message {
@@ -188,6 +241,18 @@ func GetGenre(msg interface{}) string {
 	return ""
 }
 
+func GetMsgId(msg interface{}) string {
+	switch msg.(type) {
+	case *NoticeMessage:
+		return msg.(*NoticeMessage).msgId
+	case *SimplexMessage:
+		return msg.(*SimplexMessage).msgId
+	case *DuplexMessage:
+		return msg.(*DuplexMessage).msgId
+	}
+	return ""
+}
+
 func (m *Message) SetType(genre string) {
 	m.genre = genre
 }
@@ -201,6 +266,36 @@ func (m *Message) SetBody(body *MsgBody) {
 	m.Body = body
 }
 
+/**
+ * 获取消息的投递时间(毫秒)，返回0表示立即投递。
+ */
+func (m *Message) deliverTime() int64 {
+	if !m.DeliverAt.IsZero() {
+		return m.DeliverAt.UnixNano() / int64(time.Millisecond)
+	}
+	if m.Delay > 0 {
+		return time.Now().Add(m.Delay).UnixNano() / int64(time.Millisecond)
+	}
+	return 0
+}
+
+/**
+ * 获取消息的过期时间(毫秒)，返回0表示永不过期。
+ */
+func (m *Message) expireTime() int64 {
+	if !m.ExpiresAt.IsZero() {
+		return m.ExpiresAt.UnixNano() / int64(time.Millisecond)
+	}
+	if m.TTL > 0 {
+		from := m.deliverTime()
+		if from == 0 {
+			from = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		return from + int64(m.TTL/time.Millisecond)
+	}
+	return 0
+}
+
 /**
  * 发送到AMQ的通知类消息，通知类消息只保证被正确投递到AMQ队列中，不保证接收方是否处理成功。
  */
@@ -247,16 +342,39 @@ func NewDuplexMessage(msgId string) *DuplexMessage {
  * 发送到AMQ中去的消息的封装，对通知消息和事务消息进行统一封装。
  */
 type MsgPayload struct {
-	Category    _MessageCategory `json:"category"`    // 消息分类
-	Genre       string           `json:"type"`        // 消息类型
-	MsgId       string           `json:"msgId"`       // 消息的唯一ID，发送时自动生成
-	SrcAckQueue string           `json:"srcAckQueue"` // 消息发送方的应答队列名称（对事务消息有效）
-	DstNewQueue string           `json:"dstNewQueue"` // 消息接收方的新消息队列名称
-	DstAckQueue string           `json:"dstAckQueue"` // 消息接收方的应答消息队列（对双向事务消息有效）
-	Body        *MsgBody         `json:"body"`        // 业务数据
-	SendTime    int64            `json:"sendTime"`    // 发送时间
-	Phase       _MessagePhase    `json:"phase"`       // 消息所处的阶段
-	Sign        string           `json:"sign"`        // 签名信息
+	Category     _MessageCategory `json:"category"`               // 消息分类
+	Genre        string           `json:"type"`                   // 消息类型
+	MsgId        string           `json:"msgId"`                  // 消息的唯一ID，发送时自动生成
+	SrcAckQueue  string           `json:"srcAckQueue"`            // 消息发送方的应答队列名称（对事务消息有效）
+	DstNewQueue  string           `json:"dstNewQueue"`            // 消息接收方的新消息队列名称
+	DstAckQueue  string           `json:"dstAckQueue"`            // 消息接收方的应答消息队列（对双向事务消息有效）
+	Body         *MsgBody         `json:"body"`                   // 业务数据
+	SendTime     int64            `json:"sendTime"`               // 发送时间
+	Phase        _MessagePhase    `json:"phase"`                  // 消息所处的阶段
+	KeyId        string           `json:"keyId,omitempty"`        // 签名所使用的密钥ID，为空表示旧版本的MD5签名
+	Sign         string           `json:"sign"`                   // 签名信息
+	Forward      string           `json:"forward,omitempty"`      // 指定投递的队列(如隔离队列)，设置后优先于按消息阶段决定的队列
+	Compression  string           `json:"compression,omitempty"`  // 消息体的压缩算法，为空表示未压缩
+	Envelope     []byte           `json:"envelope,omitempty"`     // 压缩或加密后的消息体，此时Body为空
+	Encryption   string           `json:"encryption,omitempty"`   // 消息体的加密算法，为空表示未加密
+	CipherKeyId  string           `json:"cipherKeyId,omitempty"`  // 加密所使用的密钥ID
+	Failure      *Failure         `json:"failure,omitempty"`      // 处理失败的信息，仅死信队列中的消息携带
+	DeliverAt    int64            `json:"deliverAt,omitempty"`    // 投递时间(毫秒)，为0表示立即投递
+	ExpiresAt    int64            `json:"expiresAt,omitempty"`    // 过期时间(毫秒)，为0表示永不过期
+	Expired      bool             `json:"expired,omitempty"`      // 接收方应答的消息已过期且未被处理
+	PartitionKey string           `json:"partitionKey,omitempty"` // 分区键，应答消息沿用新消息的分区键
+	Redelivered  bool             `json:"-"`                      // broker重新投递的消息，由provider在收到消息时设置，不参与编码和签名
+}
+
+/**
+ * 消息处理失败的信息，由接收方在将消息转发到死信队列时附加，不参与签名。
+ */
+type Failure struct {
+	Queue         string `json:"queue"`         // 消息原来所在的队列
+	Error         string `json:"error"`         // 最后一次处理失败的错误信息
+	Attempts      int    `json:"attempts"`      // 处理次数
+	FirstFailedAt int64  `json:"firstFailedAt"` // 首次处理失败的时间(毫秒)
+	LastFailedAt  int64  `json:"lastFailedAt"`  // 最后一次处理失败的时间(毫秒)
 }
 
 func (mpl *MsgPayload) SetBody(body *MsgBody) {
@@ -272,6 +390,7 @@ func (mpl *MsgPayload) ConvertToNotice() (*NoticeMessage, error) {
 	}
 	msg.genre = mpl.Genre
 	msg.Body = mpl.Body
+	msg.PartitionKey = mpl.PartitionKey
 	msg.Destination = mpl.DstNewQueue
 	return msg, nil
 }
@@ -282,6 +401,7 @@ func (mpl *MsgPayload) ConvertToSimplex() (*SimplexMessage, error) {
 	}
 	msg.genre = mpl.Genre
 	msg.Body = mpl.Body
+	msg.PartitionKey = mpl.PartitionKey
 	msg.Destination = mpl.DstNewQueue
 	msg.Source = mpl.SrcAckQueue
 	return msg, nil
@@ -293,6 +413,7 @@ func (mpl *MsgPayload) ConvertToDuplex() (*DuplexMessage, error) {
 	}
 	msg.genre = mpl.Genre
 	msg.Body = mpl.Body
+	msg.PartitionKey = mpl.PartitionKey
 	msg.DestinationNew = mpl.DstNewQueue
 	msg.DestinationAck = mpl.DstAckQueue
 	msg.Source = mpl.SrcAckQueue
@@ -303,12 +424,24 @@ func (mpl *MsgPayload) String() string {
 	return string(v)
 }
 
+/**
+ * 判断消息是否已超过过期时间，未设置过期时间的消息永不过期。
+ *
+ * @return
+ */
+func (mpl *MsgPayload) IsExpired() bool {
+	return mpl.ExpiresAt > 0 && time.Now().UnixNano()/int64(time.Millisecond) > mpl.ExpiresAt
+}
+
 /**
  * 根据当前消息的类型和所处的阶段来决定发送的队列名称。
  *
  * @return
  */
 func (mpl *MsgPayload) SendQueueName() (string, error) {
+	if len(mpl.Forward) > 0 {
+		return mpl.Forward, nil
+	}
 	if mpl.Phase == SenderReq {
 		return mpl.DstNewQueue, nil
 	} else if mpl.Phase == ReceiverAck {
@@ -321,14 +454,15 @@ func (mpl *MsgPayload) SendQueueName() (string, error) {
 }
 func NewPayload(msg *MsgPayload, phase _MessagePhase) *MsgPayload {
 	mpl := &MsgPayload{
-		Category:    msg.Category,
-		Genre:       msg.Genre,
-		MsgId:       msg.MsgId,
-		SrcAckQueue: msg.SrcAckQueue,
-		DstNewQueue: msg.DstNewQueue,
-		DstAckQueue: msg.DstAckQueue,
-		SendTime:    time.Now().Unix(),
-		Phase:       phase,
+		Category:     msg.Category,
+		Genre:        msg.Genre,
+		MsgId:        msg.MsgId,
+		SrcAckQueue:  msg.SrcAckQueue,
+		DstNewQueue:  msg.DstNewQueue,
+		DstAckQueue:  msg.DstAckQueue,
+		SendTime:     time.Now().Unix(),
+		Phase:        phase,
+		PartitionKey: msg.PartitionKey,
 	}
 	mpl.Body = msg.Body
 	mpl.Sign = Signature(mpl)
@@ -336,12 +470,15 @@ func NewPayload(msg *MsgPayload, phase _MessagePhase) *MsgPayload {
 }
 func NoticePayload(message *NoticeMessage) *MsgPayload {
 	mpl := &MsgPayload{
-		Category:    NOTICE,
-		Genre:       message.genre,
-		MsgId:       message.msgId,
-		DstNewQueue: message.Destination,
-		SendTime:    time.Now().Unix(),
-		Phase:       SenderReq,
+		Category:     NOTICE,
+		Genre:        message.genre,
+		MsgId:        message.msgId,
+		DstNewQueue:  message.Destination,
+		SendTime:     time.Now().Unix(),
+		Phase:        SenderReq,
+		DeliverAt:    message.deliverTime(),
+		ExpiresAt:    message.expireTime(),
+		PartitionKey: message.PartitionKey,
 	}
 	mpl.Body = message.Body
 	mpl.Sign = Signature(mpl)
@@ -349,13 +486,16 @@ func NoticePayload(message *NoticeMessage) *MsgPayload {
 }
 func SimplexPayload(message *SimplexMessage) *MsgPayload {
 	mpl := &MsgPayload{
-		Category:    SIMPLEX,
-		Genre:       message.genre,
-		MsgId:       message.msgId,
-		SrcAckQueue: message.Source,
-		DstNewQueue: message.Destination,
-		SendTime:    time.Now().Unix(),
-		Phase:       SenderReq,
+		Category:     SIMPLEX,
+		Genre:        message.genre,
+		MsgId:        message.msgId,
+		SrcAckQueue:  message.Source,
+		DstNewQueue:  message.Destination,
+		SendTime:     time.Now().Unix(),
+		Phase:        SenderReq,
+		DeliverAt:    message.deliverTime(),
+		ExpiresAt:    message.expireTime(),
+		PartitionKey: message.PartitionKey,
 	}
 	mpl.Body = message.Body
 	mpl.Sign = Signature(mpl)
@@ -363,20 +503,54 @@ func SimplexPayload(message *SimplexMessage) *MsgPayload {
 }
 func DuplexPayload(message *DuplexMessage) *MsgPayload {
 	mpl := &MsgPayload{
-		Category:    DUPLEX,
-		Genre:       message.genre,
-		MsgId:       message.msgId,
-		SrcAckQueue: message.Source,
-		DstNewQueue: message.DestinationNew,
-		DstAckQueue: message.DestinationAck,
-		SendTime:    time.Now().Unix(),
-		Phase:       SenderReq,
+		Category:     DUPLEX,
+		Genre:        message.genre,
+		MsgId:        message.msgId,
+		SrcAckQueue:  message.Source,
+		DstNewQueue:  message.DestinationNew,
+		DstAckQueue:  message.DestinationAck,
+		SendTime:     time.Now().Unix(),
+		Phase:        SenderReq,
+		DeliverAt:    message.deliverTime(),
+		ExpiresAt:    message.expireTime(),
+		PartitionKey: message.PartitionKey,
 	}
 	mpl.Body = message.Body
 	mpl.Sign = Signature(mpl)
 	return mpl
 }
+
+/**
+ * 将业务系统发送的AMQ消息统一转换为{@link MsgPayload}，已经是{@link MsgPayload}的消息(如应答消息)则原样返回。
+ *
+ * @param msg
+ * @return
+ */
+func ToPayload(msg interface{}) (*MsgPayload, error) {
+	switch m := msg.(type) {
+	case *MsgPayload:
+		return m, nil
+	case *NoticeMessage:
+		return NoticePayload(m), nil
+	case *SimplexMessage:
+		return SimplexPayload(m), nil
+	case *DuplexMessage:
+		return DuplexPayload(m), nil
+	}
+	return nil, fmt.Errorf("不支持的AMQ消息类型:%T", msg)
+}
+
+/**
+ * 使用兼容旧版本的MD5加盐方式计算消息签名，参看{@link NewMD5Signer}。
+ */
 func Signature(mpl *MsgPayload) string {
+	return utils.MD5(signContent(mpl) + "@#$dz874&*&*#@@$^&^FS()()!@FSF")
+}
+
+/**
+ * 构建参与签名的消息内容。
+ */
+func signContent(mpl *MsgPayload) string {
 	var buffer bytes.Buffer
 	buffer.WriteString("category=")
 	buffer.WriteString(mpl.Category.String())
@@ -394,6 +568,60 @@ func Signature(mpl *MsgPayload) string {
 	buffer.WriteString(mpl.Phase.String())
 	buffer.WriteString("@sendTime=")
 	buffer.WriteString(utils.ToStr(mpl.SendTime))
-	buffer.WriteString("@#$dz874&*&*#@@$^&^FS()()!@FSF")
-	return utils.MD5(buffer.String())
+	// 未压缩和加密的消息与旧版本的签名内容保持一致，只要设置了压缩或加密标记就参与签名，防止被添加标记后接收方解压或解密失败
+	if len(mpl.Envelope) > 0 || len(mpl.Compression) > 0 || len(mpl.Encryption) > 0 {
+		buffer.WriteString("@compression=")
+		buffer.WriteString(mpl.Compression)
+		if len(mpl.Encryption) > 0 {
+			buffer.WriteString("@encryption=")
+			buffer.WriteString(mpl.Encryption)
+			buffer.WriteString("@cipherKeyId=")
+			buffer.WriteString(mpl.CipherKeyId)
+		}
+		buffer.WriteString("@envelope=")
+		buffer.WriteString(base64.StdEncoding.EncodeToString(mpl.Envelope))
+	}
+	// 延迟投递的消息签名投递时间，防止被篡改后提前或推迟投递
+	if mpl.DeliverAt > 0 {
+		buffer.WriteString("@deliverAt=")
+		buffer.WriteString(utils.ToStr(mpl.DeliverAt))
+	}
+	// 过期时间和过期应答同样参与签名
+	if mpl.ExpiresAt > 0 {
+		buffer.WriteString("@expiresAt=")
+		buffer.WriteString(utils.ToStr(mpl.ExpiresAt))
+	}
+	if mpl.Expired {
+		buffer.WriteString("@expired=true")
+	}
+	if len(mpl.PartitionKey) > 0 {
+		buffer.WriteString("@partitionKey=")
+		buffer.WriteString(mpl.PartitionKey)
+	}
+	return buffer.String()
+}
+
+/**
+ * 消息签名校验失败的错误，说明消息在传输过程中被篡改或者签名密钥不一致。
+ */
+type SignatureError struct {
+	MsgId string
+	Phase string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("AMQ消息签名校验失败:msgId=%s,phase=%s", e.MsgId, e.Phase)
+}
+
+/**
+ * 重新计算消息的签名并与消息中携带的签名进行比较，不一致时返回{@link SignatureError}。
+ *
+ * @param mpl
+ * @return
+ */
+func Verify(mpl *MsgPayload) error {
+	if subtle.ConstantTimeCompare([]byte(Signature(mpl)), []byte(mpl.Sign)) != 1 {
+		return &SignatureError{MsgId: mpl.MsgId, Phase: mpl.Phase.String()}
+	}
+	return nil
 }
@@ -0,0 +1,118 @@
+package message
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+/**
+ * AMQ消息的签名器，发送方在发送前对消息签名，接收方在分发前校验签名。
+ */
+type Signer interface {
+	/**
+	 * 对消息进行签名，同时设置消息的签名密钥ID。
+	 *
+	 * @param mpl
+	 * @throws error
+	 */
+	Sign(mpl *MsgPayload) error
+
+	/**
+	 * 校验消息的签名，校验失败时返回{@link SignatureError}。
+	 *
+	 * @param mpl
+	 * @throws error
+	 */
+	Verify(mpl *MsgPayload) error
+}
+
+/**
+ * 兼容旧版本的MD5加盐签名器，所有使用本类库的系统共享同一个盐值，仅用于和尚未升级的系统互通。
+ */
+type md5Signer struct{}
+
+func NewMD5Signer() Signer {
+	return md5Signer{}
+}
+
+func (md5Signer) Sign(mpl *MsgPayload) error {
+	mpl.KeyId = ""
+	mpl.Sign = Signature(mpl)
+	return nil
+}
+
+func (md5Signer) Verify(mpl *MsgPayload) error {
+	if len(mpl.KeyId) > 0 {
+		return &SignatureError{MsgId: mpl.MsgId, Phase: mpl.Phase.String()}
+	}
+	return Verify(mpl)
+}
+
+/**
+ * 基于HMAC-SHA256的签名器，支持同时配置多个有效密钥以便轮换：始终使用当前密钥(activeKey)签名，
+ * 校验时根据消息中携带的密钥ID选择对应的密钥，轮换期间新旧密钥同时有效，待所有系统切换完成后再移除旧密钥。
+ */
+type hmacSigner struct {
+	activeKey    string
+	keys         map[string][]byte
+	acceptLegacy bool
+}
+
+/**
+ * 创建HMAC-SHA256签名器。
+ *
+ * @param activeKey    当前用于签名的密钥ID
+ * @param keys         所有有效的密钥，key为密钥ID，value为密钥
+ * @param acceptLegacy 是否接受旧版本MD5签名(未携带密钥ID)的消息
+ * @return
+ */
+func NewHMACSigner(activeKey string, keys map[string]string, acceptLegacy bool) (Signer, error) {
+	if len(activeKey) == 0 {
+		return nil, fmt.Errorf("未指定签名使用的密钥ID")
+	}
+	s := &hmacSigner{activeKey: activeKey, keys: make(map[string][]byte, len(keys)), acceptLegacy: acceptLegacy}
+	for id, key := range keys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("签名密钥为空:keyId=%s", id)
+		}
+		s.keys[id] = []byte(key)
+	}
+	if _, ok := s.keys[activeKey]; !ok {
+		return nil, fmt.Errorf("签名密钥不存在:keyId=%s", activeKey)
+	}
+	return s, nil
+}
+
+func (s *hmacSigner) Sign(mpl *MsgPayload) error {
+	mpl.KeyId = s.activeKey
+	mpl.Sign = hmacSign(s.keys[s.activeKey], mpl)
+	return nil
+}
+
+func (s *hmacSigner) Verify(mpl *MsgPayload) error {
+	if len(mpl.KeyId) == 0 {
+		if s.acceptLegacy {
+			return Verify(mpl)
+		}
+		return &SignatureError{MsgId: mpl.MsgId, Phase: mpl.Phase.String()}
+	}
+	key, ok := s.keys[mpl.KeyId]
+	if !ok || subtle.ConstantTimeCompare([]byte(hmacSign(key, mpl)), []byte(mpl.Sign)) != 1 {
+		return &SignatureError{MsgId: mpl.MsgId, Phase: mpl.Phase.String()}
+	}
+	return nil
+}
+
+/**
+ * 计算消息的HMAC-SHA256签名，密钥ID同样参与签名，防止被替换。
+ */
+func hmacSign(key []byte, mpl *MsgPayload) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(signContent(mpl)))
+	h.Write([]byte("@keyId="))
+	h.Write([]byte(mpl.KeyId))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,70 @@
+package message
+
+import (
+	"errors"
+	"testing"
+)
+
+func signed(t *testing.T, s Signer) *MsgPayload {
+	mpl := &MsgPayload{Category: NOTICE, Genre: "order", MsgId: "10012024010112000000000003", DstNewQueue: "sys_amq_1002_biz",
+		Body: NewMessageBody().Add("k", "v"), SendTime: 1700000000, Phase: SenderReq}
+	if err := s.Sign(mpl); err != nil {
+		t.Fatal(err)
+	}
+	return mpl
+}
+
+func TestSignerInterop(t *testing.T) {
+	legacy := NewMD5Signer()
+	accepting, err := NewHMACSigner("k1", map[string]string{"k1": "secret1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := NewHMACSigner("k1", map[string]string{"k1": "secret1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var se *SignatureError
+	// 旧版本MD5签名的消息只有配置了acceptLegacy的HMAC签名器接受
+	if err = accepting.Verify(signed(t, legacy)); err != nil {
+		t.Fatalf("acceptLegacy时应接受MD5签名:%v", err)
+	}
+	if err = strict.Verify(signed(t, legacy)); !errors.As(err, &se) {
+		t.Fatalf("未配置acceptLegacy时应拒绝MD5签名:%v", err)
+	}
+	// HMAC签名的消息携带密钥ID，旧版本的签名器不接受，也不能去掉密钥ID冒充MD5签名
+	hmacSigned := signed(t, accepting)
+	if err = legacy.Verify(hmacSigned); !errors.As(err, &se) {
+		t.Fatalf("MD5签名器应拒绝HMAC签名:%v", err)
+	}
+	hmacSigned.KeyId = ""
+	if err = accepting.Verify(hmacSigned); !errors.As(err, &se) {
+		t.Fatalf("去掉密钥ID的HMAC签名应校验失败:%v", err)
+	}
+	if err = legacy.Verify(signed(t, legacy)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHMACSignerRotation(t *testing.T) {
+	old, _ := NewHMACSigner("k1", map[string]string{"k1": "secret1"}, false)
+	rotating, _ := NewHMACSigner("k2", map[string]string{"k1": "secret1", "k2": "secret2"}, false)
+	other, _ := NewHMACSigner("k1", map[string]string{"k1": "other"}, false)
+	if err := rotating.Verify(signed(t, old)); err != nil {
+		t.Fatalf("轮换期间应接受旧密钥的签名:%v", err)
+	}
+	if err := old.Verify(signed(t, rotating)); err == nil {
+		t.Fatal("未配置新密钥时应拒绝新密钥的签名")
+	}
+	if err := other.Verify(signed(t, old)); err == nil {
+		t.Fatal("相同密钥ID不同密钥的签名应校验失败")
+	}
+	mpl := signed(t, rotating)
+	mpl.Body.Add("k", "changed")
+	if err := rotating.Verify(mpl); err == nil {
+		t.Fatal("修改消息体后签名应校验失败")
+	}
+	if _, err := NewHMACSigner("k3", map[string]string{"k1": "secret1"}, false); err == nil {
+		t.Fatal("当前密钥不存在时应创建失败")
+	}
+}
@@ -0,0 +1,405 @@
+package amq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/aluka-7/amq/internal/sqldialect"
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 事务发件箱(outbox)配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "table" : "amq_outbox", // 发件箱表名(默认amq_outbox)
+ *   "interval" : 1000,      // 转发待发送消息的轮询间隔(毫秒，默认1000)
+ *   "batchSize" : 100,      // 每次最多转发的消息数量(默认100)
+ *   "maxAttempts" : 0,      // 最多发送次数，超过后不再重试(默认0表示一直重试)
+ *   "retryDelay" : 1,       // 首次重试的间隔(秒，默认1)，之后每次翻倍
+ *   "maxRetryDelay" : 300,  // 重试间隔的上限(秒，默认300)
+ *   "retention" : 86400     // 发送成功的消息保留的时间(秒，默认86400)，超过后自动删除
+ * }
+ * </pre>
+ * 数据库连接需要通过{@link Client#SetOutbox}指定，未指定时该配置不生效。
+ */
+type OutboxConfig struct {
+	Table         string `json:"table"`
+	Interval      int    `json:"interval"`
+	BatchSize     int    `json:"batchSize"`
+	MaxAttempts   int    `json:"maxAttempts"`
+	RetryDelay    int    `json:"retryDelay"`
+	MaxRetryDelay int    `json:"maxRetryDelay"`
+	Retention     int    `json:"retention"`
+}
+
+const (
+	defaultOutboxTable         = "amq_outbox"
+	defaultOutboxInterval      = 1000
+	defaultOutboxBatchSize     = 100
+	defaultOutboxRetryDelay    = 1
+	defaultOutboxMaxRetryDelay = 300
+	defaultOutboxRetention     = 86400
+	outboxClaimTimeout         = 5 * time.Minute // 领取后超过该时间仍未更新状态(如进程退出)的消息会被重新领取和发送
+	outboxPurgeInterval        = time.Minute     // 删除已发送消息的间隔
+)
+
+/**
+ * 发件箱中消息的状态。
+ */
+const (
+	outboxPending   = 0 // 等待发送
+	outboxDelivered = 1 // 已发送
+	outboxFailed    = 2 // 超过最多发送次数或无法解析，不再重试
+)
+
+/**
+ * 事务发件箱，业务系统在自己的数据库事务中写入待发送的消息，事务提交后由后台任务转发到AMQ并标记为已发送，
+ * 事务回滚则消息随之丢弃。同一个目标队列的消息按照写入的顺序发送，前面的消息发送失败时后面的消息等待其重试成功。
+ * 转发时先在一个短事务中领取一批消息(将下次发送时间推迟{@link outboxClaimTimeout})，提交后再逐条发送并更新状态，发送期间不持有行锁；
+ * 有消息已被领取或正在等待重试的队列整体跳过，因此多个实例同时转发时同一个队列的消息仍按顺序发送。
+ * 消息发送成功但标记失败(如进程退出)时会在领取超时后被再次发送，接收方可开启消息去重。
+ * 发送成功的消息保留{@link OutboxConfig#Retention}后由后台任务删除，超过最多发送次数的消息保留在表中等待人工处理。
+ */
+type outbox struct {
+	client        *Client
+	db            *sql.DB
+	dialect       *sqldialect.Dialect
+	table         string
+	interval      time.Duration
+	batchSize     int
+	maxAttempts   int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+	retention     time.Duration
+	lastPurge     time.Time
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+/**
+ * 发件箱中的一条待发送消息。
+ */
+type outboxEntry struct {
+	id       int64
+	queue    string
+	payload  string
+	attempts int
+}
+
+func newOutbox(c *Client, db *sql.DB, dialect string, cfg *OutboxConfig) (*outbox, error) {
+	if cfg == nil {
+		cfg = &OutboxConfig{}
+	}
+	d, err := sqldialect.Get(dialect, "")
+	if err != nil {
+		return nil, err
+	}
+	o := &outbox{
+		client:        c,
+		db:            db,
+		dialect:       d,
+		table:         cfg.Table,
+		interval:      time.Duration(cfg.Interval) * time.Millisecond,
+		batchSize:     cfg.BatchSize,
+		maxAttempts:   cfg.MaxAttempts,
+		retryDelay:    time.Duration(cfg.RetryDelay) * time.Second,
+		maxRetryDelay: time.Duration(cfg.MaxRetryDelay) * time.Second,
+		retention:     time.Duration(cfg.Retention) * time.Second,
+	}
+	if len(o.table) == 0 {
+		o.table = defaultOutboxTable
+	}
+	if !sqlTablePattern.MatchString(o.table) {
+		return nil, fmt.Errorf("无效的发件箱表名:%s", o.table)
+	}
+	if o.interval <= 0 {
+		o.interval = defaultOutboxInterval * time.Millisecond
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = defaultOutboxBatchSize
+	}
+	if o.retryDelay <= 0 {
+		o.retryDelay = defaultOutboxRetryDelay * time.Second
+	}
+	if o.maxRetryDelay <= 0 {
+		o.maxRetryDelay = defaultOutboxMaxRetryDelay * time.Second
+	}
+	if o.retention <= 0 {
+		o.retention = defaultOutboxRetention * time.Second
+	}
+	schema := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id %s, msg_id VARCHAR(64) NOT NULL, queue VARCHAR(255) NOT NULL, payload %s NOT NULL, status INT NOT NULL, attempts INT NOT NULL, next_attempt BIGINT NOT NULL, last_error %s, created_at BIGINT NOT NULL, delivered_at BIGINT)%s",
+		o.table, d.Serial, d.Text, d.Text, d.TableOptions)
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("创建发件箱表失败:%v", err)
+	}
+	return o, nil
+}
+
+/**
+ * 在业务系统的事务中写入待发送的消息，消息在发送时才压缩、加密和签名，因此这里保存的是原始消息。
+ */
+func (o *outbox) add(tx *sql.Tx, mpl *message.MsgPayload) error {
+	queue, err := mpl.SendQueueName()
+	if err != nil {
+		return err
+	}
+	data, err := message.Marshal(message.JSONCodec, mpl)
+	if err != nil {
+		return err
+	}
+	now := nowMillis()
+	query := o.dialect.Rebind(fmt.Sprintf("INSERT INTO %s (msg_id, queue, payload, status, attempts, next_attempt, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)", o.table))
+	_, err = tx.Exec(query, mpl.MsgId, queue, string(data), outboxPending, 0, now, now)
+	return err
+}
+
+/**
+ * 启动后台转发任务。
+ */
+func (o *outbox) start() {
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-ticker.C:
+				o.drain(o.stop)
+				o.purge()
+			}
+		}
+	}()
+}
+
+/**
+ * 连续转发待发送的消息，直到一批消息都未能发送成功或者stop关闭。
+ */
+func (o *outbox) drain(stop <-chan struct{}) {
+	for {
+		n, err := o.relay()
+		if err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]转发发件箱消息失败", o.client.node.String())
+			return
+		}
+		if n == 0 {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+/**
+ * 删除发送成功超过保留时间的消息，每{@link outboxPurgeInterval}最多执行一次。
+ */
+func (o *outbox) purge() {
+	now := time.Now()
+	if now.Sub(o.lastPurge) < outboxPurgeInterval {
+		return
+	}
+	o.lastPurge = now
+	query := o.dialect.Rebind(fmt.Sprintf("DELETE FROM %s WHERE status = ? AND delivered_at < ?", o.table))
+	res, err := o.db.Exec(query, outboxDelivered, now.Add(-o.retention).UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]删除发件箱已发送的消息失败", o.client.node.String())
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Debug().Msgf("[AMQ-Client-%s]删除发件箱已发送的消息:count=%d", o.client.node.String(), n)
+	}
+}
+
+/**
+ * 停止后台任务并在ctx结束之前转发所有可发送的消息，返回发件箱中仍未发送的消息数量，这些消息在下次启动后继续发送。
+ */
+func (o *outbox) flush(ctx context.Context) (int, error) {
+	o.close()
+	o.drain(ctx.Done())
+	var n int
+	query := o.dialect.Rebind(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE status = ?", o.table))
+	if err := o.db.QueryRow(query, outboxPending).Scan(&n); err != nil {
+		return 0, fmt.Errorf("[AMQ-Client-%s]查询发件箱未发送的消息失败:%v", o.client.node.String(), err)
+	}
+	if n > 0 {
+		log.Warn().Msgf("[AMQ-Client-%s]发件箱中仍有未发送的消息:count=%d", o.client.node.String(), n)
+	}
+	return n, nil
+}
+
+/**
+ * 领取并逐条转发一批待发送的消息，返回本批发送成功的消息数量。
+ */
+func (o *outbox) relay() (int, error) {
+	entries, err := o.claim()
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	blocked := make(map[string]bool)
+	for _, e := range entries {
+		var uerr error
+		if blocked[e.queue] {
+			// 前面的消息未能发送，释放领取的消息，等待下次按顺序发送
+			query := o.dialect.Rebind(fmt.Sprintf("UPDATE %s SET next_attempt = ? WHERE id = ? AND status = ?", o.table))
+			_, uerr = o.db.Exec(query, nowMillis(), e.id, outboxPending)
+		} else if uerr = o.deliver(e); uerr == nil && e.attempts == 0 {
+			delivered++
+			continue
+		}
+		blocked[e.queue] = true
+		if uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return delivered, err
+}
+
+/**
+ * 在一个短事务中锁定一批可以发送的消息并推迟其下次发送时间，使其他实例在领取超时之前不会领取这些消息及其所在队列的后续消息。
+ */
+func (o *outbox) claim() ([]*outboxEntry, error) {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := nowMillis()
+	// 等待其他实例释放行锁而不是跳过，避免同一个队列的后续消息被其他实例抢先领取
+	query := o.dialect.Rebind(fmt.Sprintf("SELECT id, queue, payload, attempts FROM %[1]s WHERE status = ? AND next_attempt <= ? AND queue NOT IN (SELECT queue FROM %[1]s WHERE status = ? AND next_attempt > ?) ORDER BY id LIMIT ?", o.table)) + o.dialect.WaitLockClause
+	rows, err := tx.Query(query, outboxPending, now, outboxPending, now, o.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*outboxEntry, 0, o.batchSize)
+	for rows.Next() {
+		e := new(outboxEntry)
+		if err = rows.Scan(&e.id, &e.queue, &e.payload, &e.attempts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	// 等待行锁期间其他实例可能已经领取了同一队列的消息，获得行锁后重新查询并排除这些队列
+	rows, err = tx.Query(o.dialect.Rebind(fmt.Sprintf("SELECT DISTINCT queue FROM %s WHERE status = ? AND next_attempt > ?", o.table)), outboxPending, now)
+	if err != nil {
+		return nil, err
+	}
+	busy := make(map[string]bool)
+	for rows.Next() {
+		var queue string
+		if err = rows.Scan(&queue); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		busy[queue] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	claimed := entries[:0]
+	update := o.dialect.Rebind(fmt.Sprintf("UPDATE %s SET next_attempt = ? WHERE id = ?", o.table))
+	for _, e := range entries {
+		if busy[e.queue] {
+			continue
+		}
+		if _, err = tx.Exec(update, now+int64(outboxClaimTimeout/time.Millisecond), e.id); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, e)
+	}
+	return claimed, tx.Commit()
+}
+
+/**
+ * 发送一条已领取的消息并更新其状态，发送失败时e.attempts为累计的失败次数，成功时为0；返回的错误仅为数据库错误。
+ */
+func (o *outbox) deliver(e *outboxEntry) error {
+	c := o.client
+	mpl, err := message.Unmarshal([]byte(e.payload))
+	if err == nil {
+		err = o.send(mpl)
+	}
+	now := nowMillis()
+	if err == nil {
+		log.Debug().Msgf("[AMQ-Client-%s]发件箱消息发送成功:msgId=%s", c.node.String(), mpl.MsgId)
+		e.attempts = 0
+		query := o.dialect.Rebind(fmt.Sprintf("UPDATE %s SET status = ?, attempts = attempts + 1, last_error = NULL, delivered_at = ? WHERE id = ?", o.table))
+		_, err = o.db.Exec(query, outboxDelivered, now, e.id)
+		return err
+	}
+	e.attempts++
+	status := outboxPending
+	if mpl == nil || (o.maxAttempts > 0 && e.attempts >= o.maxAttempts) {
+		status = outboxFailed
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]发件箱消息发送失败，不再重试:id=%d,attempts=%d", c.node.String(), e.id, e.attempts)
+	} else {
+		log.Warn().Err(err).Msgf("[AMQ-Client-%s]发件箱消息发送失败，稍后重试:id=%d,attempts=%d", c.node.String(), e.id, e.attempts)
+	}
+	query := o.dialect.Rebind(fmt.Sprintf("UPDATE %s SET status = ?, attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?", o.table))
+	_, uerr := o.db.Exec(query, status, e.attempts, now+int64(o.backoff(e.attempts)/time.Millisecond), err.Error(), e.id)
+	return uerr
+}
+
+/**
+ * 以当前时间作为发送时间封装消息后发送，避免在发件箱中等待过久的消息被接收方当作重放的消息。
+ */
+func (o *outbox) send(mpl *message.MsgPayload) error {
+	c := o.client
+	mpl.SendTime = time.Now().Unix()
+	if err := c.seal(mpl); err != nil {
+		return err
+	}
+	if scheduled, err := c.schedule(mpl); scheduled {
+		return err
+	}
+	if err := c.tracker.begin(mpl); err != nil {
+		return err
+	}
+	err := c.provider.Send(mpl)
+	if err != nil {
+		c.tracker.cancel(mpl.MsgId)
+	}
+	return err
+}
+
+/**
+ * 第n次发送失败后到下一次重试的间隔。
+ */
+func (o *outbox) backoff(n int) time.Duration {
+	delay := o.retryDelay
+	for i := 1; i < n && delay < o.maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.maxRetryDelay {
+		delay = o.maxRetryDelay
+	}
+	return delay
+}
+
+func (o *outbox) close() {
+	if o.stop == nil {
+		return
+	}
+	close(o.stop)
+	<-o.done
+	o.stop = nil
+}
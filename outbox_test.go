@@ -0,0 +1,178 @@
+package amq
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/**
+ * 记录发送的消息ID，fail为true时发送失败。
+ */
+type recordingProvider struct {
+	mu   sync.Mutex
+	sent []string
+	fail bool
+}
+
+func (p *recordingProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	return p
+}
+
+func (p *recordingProvider) Listen(name string, listener provider.MessageListener) (func(), error) {
+	return func() {}, nil
+}
+
+func (p *recordingProvider) Cancel(name string) {}
+
+func (p *recordingProvider) Send(msg interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail {
+		return errors.New("发送失败")
+	}
+	mpl, err := message.ToPayload(msg)
+	if err != nil {
+		return err
+	}
+	p.sent = append(p.sent, mpl.MsgId)
+	return nil
+}
+
+func (p *recordingProvider) Close() {}
+
+func (p *recordingProvider) expectSent(t *testing.T, msgIds ...string) {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(msgIds) == 0 && len(p.sent) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(p.sent, msgIds) {
+		t.Fatalf("发送的消息为%v，期望为%v", p.sent, msgIds)
+	}
+}
+
+func newTestOutbox(t *testing.T, cfg *OutboxConfig) (*outbox, *recordingProvider) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	p := &recordingProvider{}
+	c := &Client{node: node.BIZ, signer: message.NewMD5Signer(), provider: p}
+	o, err := newOutbox(c, db, "sqlite", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, p
+}
+
+/**
+ * 在一个业务事务中向发件箱写入发往同一个队列的通知消息。
+ */
+func addNotices(t *testing.T, o *outbox, msgIds ...string) {
+	t.Helper()
+	tx, err := o.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msgId := range msgIds {
+		nm := message.NewNoticeMessage(msgId)
+		nm.SetType("outbox")
+		nm.SetBody(message.NewMessageBody())
+		nm.Destination = "sys_amq_1001_biz"
+		if err = o.add(tx, message.NoticePayload(nm)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func relay(t *testing.T, o *outbox, want int) {
+	t.Helper()
+	n, err := o.relay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != want {
+		t.Fatalf("发送成功的消息数量为%d，期望为%d", n, want)
+	}
+}
+
+func countRows(t *testing.T, o *outbox) int {
+	t.Helper()
+	var n int
+	if err := o.db.QueryRow("SELECT COUNT(*) FROM " + o.table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOutboxResendAfterCrashBetweenClaimAndSend(t *testing.T) {
+	o, p := newTestOutbox(t, nil)
+	addNotices(t, o, "m1", "m2")
+	// 领取后进程退出，消息没有发送也没有更新状态
+	entries, err := o.claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("领取的消息数量为%d，期望为2", len(entries))
+	}
+	// 领取超时之前其他实例不会领取这些消息
+	relay(t, o, 0)
+	p.expectSent(t)
+	// 领取超时后按原来的顺序重新发送
+	if _, err = o.db.Exec("UPDATE "+o.table+" SET next_attempt = ?", nowMillis()-1); err != nil {
+		t.Fatal(err)
+	}
+	relay(t, o, 2)
+	p.expectSent(t, "m1", "m2")
+}
+
+func TestOutboxRetryKeepsQueueOrder(t *testing.T) {
+	o, p := newTestOutbox(t, &OutboxConfig{RetryDelay: 1})
+	addNotices(t, o, "m1", "m2")
+	p.fail = true
+	relay(t, o, 0)
+	p.fail = false
+	// 第一条消息等待重试期间同一个队列的后续消息也不发送
+	relay(t, o, 0)
+	p.expectSent(t)
+	if _, err := o.db.Exec("UPDATE "+o.table+" SET next_attempt = ?", nowMillis()-1); err != nil {
+		t.Fatal(err)
+	}
+	relay(t, o, 2)
+	p.expectSent(t, "m1", "m2")
+}
+
+func TestOutboxPurgesDeliveredRows(t *testing.T) {
+	o, _ := newTestOutbox(t, &OutboxConfig{Retention: 60})
+	addNotices(t, o, "m1", "m2")
+	relay(t, o, 2)
+	// 只删除发送成功超过保留时间的消息
+	if _, err := o.db.Exec("UPDATE "+o.table+" SET delivered_at = ? WHERE msg_id = ?", nowMillis()-120*1000, "m1"); err != nil {
+		t.Fatal(err)
+	}
+	o.purge()
+	if n := countRows(t, o); n != 1 {
+		t.Fatalf("发件箱中剩余%d条消息，期望为1", n)
+	}
+	var msgId string
+	if err := o.db.QueryRow("SELECT msg_id FROM " + o.table).Scan(&msgId); err != nil || msgId != "m2" {
+		t.Fatalf("保留时间内的消息被删除:%s,%v", msgId, err)
+	}
+}
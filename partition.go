@@ -0,0 +1,190 @@
+package amq
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * 分区选择器，多分区节点上根据消息的分区键选择目标分区，相同分区键的消息应当进入同一个分区以保证顺序，
+ * 内置了一致性哈希(hash，默认)、轮询(roundRobin)和粘性(sticky)三种实现，也可自行实现后通过{@link Client#SetPartitioner}设置。
+ */
+type Partitioner interface {
+	/**
+	 * 选择分区编号。
+	 *
+	 * @param key        消息的分区键，可能为空
+	 * @param partitions 节点的分区数量，大于1
+	 * @return 分区编号，范围为[0, partitions)
+	 */
+	Partition(key string, partitions int) int
+}
+
+const stickyBatchSize = 100
+
+/**
+ * 根据名称创建内置的分区选择器，名称为空时使用一致性哈希。
+ *
+ * @param name hash、roundRobin或sticky
+ * @return
+ */
+func NewPartitioner(name string) (Partitioner, error) {
+	switch name {
+	case "", "hash":
+		return &hashPartitioner{}, nil
+	case "roundRobin":
+		return &roundRobinPartitioner{}, nil
+	case "sticky":
+		return &stickyPartitioner{current: -1}, nil
+	}
+	return nil, fmt.Errorf("不支持的分区选择器:%s", name)
+}
+
+/**
+ * 一致性哈希分区选择器，分区键相同的消息总是进入同一个分区，分区数量变化时只有少量分区键被重新分配；没有分区键的消息轮询所有分区。
+ */
+type hashPartitioner struct {
+	roundRobinPartitioner
+}
+
+func (p *hashPartitioner) Partition(key string, partitions int) int {
+	if len(key) == 0 {
+		return p.roundRobinPartitioner.Partition(key, partitions)
+	}
+	return hashPartition(key, partitions)
+}
+
+/**
+ * 轮询分区选择器，忽略分区键依次使用每个分区，适用于不要求顺序而只需要均衡负载的消息。
+ */
+type roundRobinPartitioner struct {
+	next uint32
+}
+
+func (p *roundRobinPartitioner) Partition(key string, partitions int) int {
+	return int((atomic.AddUint32(&p.next, 1) - 1) % uint32(partitions))
+}
+
+/**
+ * 粘性分区选择器，有分区键的消息和一致性哈希相同；没有分区键的消息连续发送到同一个分区，每发送一批后随机切换到另一个分区，
+ * 便于provider批量投递。
+ */
+type stickyPartitioner struct {
+	mu      sync.Mutex
+	current int
+	count   int
+}
+
+func (p *stickyPartitioner) Partition(key string, partitions int) int {
+	if len(key) > 0 {
+		return hashPartition(key, partitions)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current < 0 || p.current >= partitions || p.count >= stickyBatchSize {
+		next := rand.Intn(partitions)
+		if next == p.current {
+			next = (next + 1) % partitions
+		}
+		p.current, p.count = next, 0
+	}
+	p.count++
+	return p.current
+}
+
+/**
+ * 使用跳跃一致性哈希(Jump Consistent Hash)计算分区键对应的分区。
+ */
+func hashPartition(key string, partitions int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	k := h.Sum64()
+	var b, j int64 = -1, 0
+	for j < int64(partitions) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
+
+var (
+	unpartitionedQueuePattern = regexp.MustCompile(`^sys_amq_(\d{4})_[^_]+$`)
+	queueSystemPattern        = regexp.MustCompile(`^sys_amq_(\d{4})_`)
+	singleQueueNamePattern    = regexp.MustCompile("(sys_amq_\\d{4})_(.+)")
+	partitionQueueNamePattern = regexp.MustCompile("(sys_amq_\\d{4})_(.+)_p\\d+")
+)
+
+/**
+ * 返回分区数量为partitions的系统的队列名称格式。
+ */
+func queueNamePattern(partitions int) *regexp.Regexp {
+	if partitions > 1 {
+		return partitionQueueNamePattern
+	}
+	return singleQueueNamePattern
+}
+
+/**
+ * 获取指定系统在当前节点上的分区数量，未在systemPartitions中配置时与当前系统相同。
+ */
+func (c *Client) partitionsOf(systemId string) int {
+	if n, ok := c.systemPartitions[systemId]; ok && n > 0 {
+		return n
+	}
+	return c.partitions
+}
+
+/**
+ * 设置分区选择器，默认使用节点配置中指定的分区选择器(未配置时为一致性哈希)，需要确保该方法在发送消息之前调用。
+ *
+ * @param partitioner
+ */
+func (c *Client) SetPartitioner(partitioner Partitioner) {
+	if partitioner != nil {
+		c.partitioner = partitioner
+	}
+}
+
+/**
+ * 根据分区键构建目标系统的队列名称，单分区节点等同{@link #BuildQueueName(string)}，多分区节点由分区选择器选择分区，
+ * 使用一致性哈希时相同分区键总是得到同一个分区的队列。
+ *
+ * @param systemId 目标系统ID
+ * @param key      分区键，如客户ID
+ * @return
+ */
+func (c *Client) BuildQueueNameForKey(systemId, key string) string {
+	partitions := c.partitionsOf(systemId)
+	if partitions <= 1 {
+		return c.BuildQueueName(systemId)
+	}
+	return c.BuildQueueNameByPartition(systemId, c.partitioner.Partition(key, partitions))
+}
+
+/**
+ * 为未指定分区的目标队列按照目标系统的分区数量和分区键选择分区，同一条消息分区数量相同的多个目标队列使用相同的分区。
+ */
+func (c *Client) route(key string, names ...*string) {
+	chosen := make(map[int]int, 1)
+	for _, name := range names {
+		m := unpartitionedQueuePattern.FindStringSubmatch(*name)
+		if m == nil {
+			continue
+		}
+		partitions := c.partitionsOf(m[1])
+		if partitions <= 1 {
+			continue
+		}
+		partition, ok := chosen[partitions]
+		if !ok {
+			partition = c.partitioner.Partition(key, partitions)
+			chosen[partitions] = partition
+		}
+		*name = fmt.Sprintf("%s_p%d", *name, partition)
+	}
+}
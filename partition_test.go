@@ -0,0 +1,61 @@
+package amq_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+)
+
+func TestHashPartitionStable(t *testing.T) {
+	a, _ := amq.NewPartitioner("hash")
+	b, _ := amq.NewPartitioner("hash")
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("customer-%d", i)
+		p4 := a.Partition(key, 4)
+		if p4 != b.Partition(key, 4) || p4 != a.Partition(key, 4) {
+			t.Fatalf("分区键%s的分区不稳定", key)
+		}
+		// 分区数量从4增加到5时，分区键只会移动到新增的分区
+		if p5 := a.Partition(key, 5); p5 != p4 {
+			if p5 != 4 {
+				t.Fatalf("分区键%s从分区%d移动到了已有的分区%d", key, p4, p5)
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Fatalf("增加一个分区后移动了%d个分区键，期望约200个", moved)
+	}
+}
+
+func TestRouteUsesDestinationPartitions(t *testing.T) {
+	sender := newTestClient(t, "1106", `{"provider":"memory","partitions":1,"systemPartitions":{"1107":4}}`)
+	queue := sender.BuildQueueNameForKey("1107", "customer-1")
+	if queue == sender.BuildQueueName("1107") {
+		t.Fatalf("目标系统有4个分区，期望分区队列名称，实际为%s", queue)
+	}
+	captured := &captureListener{received: make(chan string, 2)}
+	if _, err := newRawProvider(t).Listen(queue, captured); err != nil {
+		t.Fatal(err)
+	}
+
+	msgId := sender.NewMsgId()
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("route")
+	nm.SetBody(message.NewMessageBody())
+	nm.Destination = sender.BuildQueueName("1107")
+	nm.PartitionKey = "customer-1"
+	// 同一条消息发送两次，调用方的目标队列保持未分区的名称
+	for i := 0; i < 2; i++ {
+		if err := sender.Send(nm); err != nil {
+			t.Fatal(err)
+		}
+		if nm.Destination != sender.BuildQueueName("1107") {
+			t.Fatalf("调用方的目标队列被修改为%s", nm.Destination)
+		}
+		expectValue(t, captured.received, msgId)
+	}
+}
@@ -0,0 +1,293 @@
+package filelog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 基于本地文件(追加写日志)实现的AMQ提供器，注册名称为<b>filelog</b>，适用于不希望依赖外部消息中间件的单机部署，
+ * 同一主机上的多个进程只要使用同一个数据目录即可相互收发消息，初始化参数如下：
+ * <pre>
+ * {
+ *   "provider" : "filelog",
+ *   "parameter" : {
+ *     "dir" : "/data/amq",         // 数据目录，每个队列对应其中的一个子目录
+ *     "segmentSize" : "67108864",  // 单个日志段的大小(字节，可选，默认64MB)，超过后滚动到新的日志段
+ *     "syncWrite" : "true",        // 每次写入后是否立即刷盘(可选，默认true)
+ *     "pollInterval" : "100",      // 监听方轮询新消息的间隔(毫秒，可选，默认100)
+ *     "codec" : "json"             // 消息编码(可选，默认使用节点配置的codec)
+ *   },
+ *   "partitions" : 1
+ * }
+ * </pre>
+ * 每条消息持久化到所属队列的日志段中，监听方在消息处理完成(包括应答消息写入成功)后才提交消费偏移量，进程重启后从已提交的偏移量
+ * 继续消费，因此已确认的消息不会丢失也不会被重复投递；所有消息均已被确认消费的旧日志段会被自动删除。处理失败的消息等待一段时间后
+ * 重新处理，直到成功后才提交偏移量；被拒绝的消息(参看{@link amq.Rejected})直接跳过，无法解析的消息转存到队列目录下的poison文件后跳过。
+ */
+func init() {
+	provider.Register("filelog", &fileProvider{})
+}
+
+const (
+	defaultSegmentSize  = 64 << 20
+	defaultPollInterval = 100 * time.Millisecond
+	retryInterval       = time.Second // 消息处理失败后重新处理前等待的时间
+)
+
+type fileProvider struct {
+	node         node.Node
+	codec        message.Codec
+	dir          string
+	segmentSize  int64
+	syncWrite    bool
+	pollInterval time.Duration
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+/**
+ * 队列上的一个监听。
+ */
+type subscription struct {
+	name     string
+	log      *queueLog
+	listener provider.MessageListener
+	lockFile *os.File
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (p *fileProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	fp := &fileProvider{
+		node:         node,
+		codec:        provider.GetCodec(node, cfg),
+		dir:          cfg["dir"],
+		segmentSize:  defaultSegmentSize,
+		syncWrite:    true,
+		pollInterval: defaultPollInterval,
+		subs:         make(map[string]*subscription),
+	}
+	if len(fp.dir) == 0 {
+		fp.dir = "amq-data"
+	}
+	if v, err := strconv.ParseInt(cfg["segmentSize"], 10, 64); err == nil && v > 0 {
+		fp.segmentSize = v
+	}
+	if v, err := strconv.ParseBool(cfg["syncWrite"]); err == nil {
+		fp.syncWrite = v
+	}
+	if v, err := strconv.Atoi(cfg["pollInterval"]); err == nil && v > 0 {
+		fp.pollInterval = time.Duration(v) * time.Millisecond
+	}
+	return fp
+}
+
+/**
+ * 打开指定队列的日志。
+ */
+func (p *fileProvider) queue(name string) (*queueLog, error) {
+	if len(name) == 0 || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("[AMQ-FileLog-%s]无效的消息队列名称:%s", p.node.String(), name)
+	}
+	return openLog(filepath.Join(p.dir, name), p.segmentSize, p.syncWrite)
+}
+
+func (p *fileProvider) Listen(name string, listener provider.MessageListener) (closer func(), err error) {
+	l, err := p.queue(name)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	if l.consuming {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("[AMQ-FileLog-%s]消息队列已存在监听器:%s", p.node.String(), name)
+	}
+	// 通过文件锁保证同一主机上的多个进程中只有一个监听器
+	lf, err := os.OpenFile(filepath.Join(l.dir, ".consumer"), os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		if err = tryLockFile(lf); err != nil {
+			lf.Close()
+			err = fmt.Errorf("[AMQ-FileLog-%s]消息队列已存在监听器:%s", p.node.String(), name)
+		}
+	}
+	if err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.consuming = true
+	l.mu.Unlock()
+
+	offset, err := l.committed()
+	if err != nil {
+		p.release(l, lf)
+		return nil, err
+	}
+	sub := &subscription{
+		name:     name,
+		log:      l,
+		listener: listener,
+		lockFile: lf,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.subs[name] = sub
+	p.mu.Unlock()
+
+	go p.consume(sub, l.reader(offset))
+	return func() { p.Cancel(name) }, nil
+}
+
+/**
+ * 释放监听方持有的文件锁。
+ */
+func (p *fileProvider) release(l *queueLog, lf *os.File) {
+	_ = unlockFile(lf)
+	_ = lf.Close()
+	l.mu.Lock()
+	l.consuming = false
+	l.mu.Unlock()
+}
+
+/**
+ * 按顺序逐条消费队列中的消息，每条消息处理完成后提交消费偏移量，直到监听被取消。
+ */
+func (p *fileProvider) consume(sub *subscription, r *reader) {
+	defer close(sub.done)
+	defer r.Close()
+	for {
+		select {
+		case <-sub.stop:
+			return
+		default:
+		}
+		data, offset, err := r.next()
+		if err != nil {
+			if err != errNotReady {
+				log.Error().Err(err).Msgf("[AMQ-FileLog-%s]读取消息失败:queue=%s", p.node.String(), sub.name)
+			}
+			select {
+			case <-sub.stop:
+				return
+			case <-time.After(p.pollInterval):
+			}
+			continue
+		}
+		if !p.handle(sub, data, offset) {
+			return
+		}
+		if err = sub.log.commit(offset + 1); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-FileLog-%s]提交消费偏移量失败:queue=%s,offset=%d", p.node.String(), sub.name, offset)
+		}
+	}
+}
+
+/**
+ * 处理一条消息，消息处理失败或应答消息写入失败时会一直重试直到成功，如果期间监听被取消则返回false且不提交偏移量。
+ */
+func (p *fileProvider) handle(sub *subscription, data []byte, offset int64) bool {
+	mpl, err := message.Unmarshal(data)
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-FileLog-%s]消息解析失败，转存到隔离文件:queue=%s,offset=%d", p.node.String(), sub.name, offset)
+		return p.retry(sub, retryInterval, func() error { return sub.log.poison(offset, data) })
+	}
+	var rsp *message.MsgPayload
+	if !p.retry(sub, retryInterval, func() error {
+		if rsp, err = amq.Dispatch(mpl, sub.listener); err == nil {
+			return nil
+		} else if amq.Rejected(err) {
+			log.Error().Err(err).Msgf("[AMQ-FileLog-%s]消息被拒绝，跳过该消息:queue=%s,msgId=%s", p.node.String(), sub.name, mpl.MsgId)
+			return nil
+		}
+		amq.Requeue(mpl, sub.listener)
+		return fmt.Errorf("消息处理失败:msgId=%s,%v", mpl.MsgId, err)
+	}) {
+		return false
+	}
+	if rsp == nil {
+		return true
+	}
+	return p.retry(sub, p.pollInterval, func() error {
+		if err := p.Send(rsp); err != nil {
+			return fmt.Errorf("应答消息发送失败:msgId=%s,%v", rsp.MsgId, err)
+		}
+		return nil
+	})
+}
+
+/**
+ * 执行fn直到成功，每次失败后等待interval，如果期间监听被取消则返回false。
+ */
+func (p *fileProvider) retry(sub *subscription, interval time.Duration, fn func() error) bool {
+	for {
+		err := fn()
+		if err == nil {
+			return true
+		}
+		log.Error().Err(err).Msgf("[AMQ-FileLog-%s]%v后重试:queue=%s", p.node.String(), interval, sub.name)
+		select {
+		case <-sub.stop:
+			return false
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (p *fileProvider) Cancel(name string) {
+	p.mu.Lock()
+	sub, ok := p.subs[name]
+	delete(p.subs, name)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(sub.stop)
+	<-sub.done
+	p.release(sub.log, sub.lockFile)
+}
+
+func (p *fileProvider) Send(msg interface{}) error {
+	mpl, err := message.ToPayload(msg)
+	if err != nil {
+		return err
+	}
+	name, err := mpl.SendQueueName()
+	if err != nil {
+		return err
+	}
+	l, err := p.queue(name)
+	if err != nil {
+		return err
+	}
+	data, err := message.Marshal(p.codec, mpl)
+	if err != nil {
+		return err
+	}
+	_, err = l.append(data)
+	return err
+}
+
+func (p *fileProvider) Close() {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.subs))
+	for name := range p.subs {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	for _, name := range names {
+		p.Cancel(name)
+	}
+}
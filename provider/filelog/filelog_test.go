@@ -0,0 +1,167 @@
+package filelog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+)
+
+/**
+ * 记录收到的消息，前fail次处理失败。
+ */
+type testListener struct {
+	mu       sync.Mutex
+	fail     int
+	received chan string
+}
+
+func (l *testListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	l.received <- msg.(*message.NoticeMessage).Body.Get("id")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fail > 0 {
+		l.fail--
+		return nil, errors.New("处理失败")
+	}
+	return nil, nil
+}
+
+func (l *testListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (l *testListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func newTestProvider(t *testing.T) (*fileProvider, string) {
+	dir := t.TempDir()
+	p := (&fileProvider{}).New(node.BIZ, map[string]string{"dir": dir, "syncWrite": "false", "pollInterval": "10"}).(*fileProvider)
+	t.Cleanup(p.Close)
+	return p, dir
+}
+
+func notice(msgId, queue string) *message.MsgPayload {
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("test")
+	nm.SetBody(message.NewMessageBody().Add("id", msgId))
+	nm.Destination = queue
+	return message.NoticePayload(nm)
+}
+
+func expectReceived(t *testing.T, l *testListener, want string) {
+	t.Helper()
+	select {
+	case msgId := <-l.received:
+		if msgId != want {
+			t.Fatalf("期望收到消息%s，实际为%s", want, msgId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待收到消息%s超时", want)
+	}
+}
+
+/**
+ * 等待监听方提交的偏移量达到want。
+ */
+func expectCommitted(t *testing.T, p *fileProvider, queue string, want int64) {
+	t.Helper()
+	l, err := p.queue(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		offset, err := l.committed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("期望提交的偏移量为%d，实际为%d", want, offset)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommitHandledMessage(t *testing.T) {
+	p, _ := newTestProvider(t)
+	for _, msgId := range []string{"m0", "m1"} {
+		if err := p.Send(notice(msgId, "q0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := &testListener{received: make(chan string, 8)}
+	closer, err := p.Listen("q0", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m0")
+	expectReceived(t, l, "m1")
+	expectCommitted(t, p, "q0", 2)
+	// 重新监听后从提交的偏移量继续消费
+	closer()
+	if err = p.Send(notice("m2", "q0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Listen("q0", l); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m2")
+	expectCommitted(t, p, "q0", 3)
+}
+
+func TestRetryFailedMessage(t *testing.T) {
+	p, _ := newTestProvider(t)
+	l := &testListener{fail: 1, received: make(chan string, 8)}
+	if _, err := p.Listen("q1", l); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(notice("m1", "q1")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m1")
+	expectCommitted(t, p, "q1", 0)
+	expectReceived(t, l, "m1")
+	expectCommitted(t, p, "q1", 1)
+}
+
+func TestSkipRejectedAndPoisonMessage(t *testing.T) {
+	p, dir := newTestProvider(t)
+	tampered := notice("m2", "q2")
+	tampered.Sign = "tampered"
+	if err := p.Send(tampered); err != nil {
+		t.Fatal(err)
+	}
+	ql, err := p.queue("q2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ql.append([]byte("not a message")); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Send(notice("m3", "q2")); err != nil {
+		t.Fatal(err)
+	}
+	l := &testListener{received: make(chan string, 8)}
+	if _, err = p.Listen("q2", l); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m3")
+	expectCommitted(t, p, "q2", 3)
+	data, err := os.ReadFile(filepath.Join(dir, "q2", "poison"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 8+headerSize+len("not a message") {
+		t.Fatalf("隔离文件内容错误:%q", data)
+	}
+}
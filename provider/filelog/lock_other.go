@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package filelog
+
+import (
+	"os"
+)
+
+// 不支持flock的平台上仅依靠进程内的互斥，多个进程同时读写同一个队列目录时无法保证一致性。
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func tryLockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package filelog
+
+import (
+	"os"
+	"syscall"
+)
+
+/**
+ * 对文件加排它锁，阻塞直到获得锁为止，用于同一主机上多个进程之间的互斥。
+ */
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+/**
+ * 尝试对文件加排它锁，已被其他进程锁定时立即返回错误。
+ */
+func tryLockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,438 @@
+package filelog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+ * 单个队列的追加写日志，队列目录下的文件布局如下：
+ * <pre>
+ * {dir}/{queue}/00000000000000000000.log // 日志段，文件名为该段第一条消息的偏移量
+ * {dir}/{queue}/offset                   // 监听方已确认消费的偏移量(下一条待消费消息的偏移量)
+ * {dir}/{queue}/.lock                    // 写入和压缩时使用的文件锁
+ * {dir}/{queue}/.consumer                // 监听方持有的文件锁，保证同一队列只有一个监听器
+ * {dir}/{queue}/poison                   // 无法解析的消息，每条为8字节偏移量 + 与日志段相同格式的记录
+ * </pre>
+ * 每条记录的格式为：4字节长度 + 4字节CRC32校验 + 消息内容，写入不完整或校验失败的记录视为尚未写入，由下一次写入截断。
+ */
+type queueLog struct {
+	dir         string
+	segmentSize int64
+	syncWrite   bool
+
+	mu        sync.Mutex
+	consuming bool
+	// 当前进程缓存的最后一个日志段的信息，其他进程追加写入后会重新扫描
+	tailBase  int64
+	tailSize  int64
+	tailCount int64
+	tailValid bool
+}
+
+const (
+	headerSize    = 8
+	maxRecordSize = 64 << 20
+	segmentSuffix = ".log"
+)
+
+var (
+	logsMu sync.Mutex
+	logs   = make(map[string]*queueLog)
+
+	errNotReady = errors.New("record not ready")
+)
+
+/**
+ * 获取指定目录的队列日志，同一进程内同一目录只会存在一个实例。
+ */
+func openLog(dir string, segmentSize int64, syncWrite bool) (*queueLog, error) {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	if l, ok := logs[dir]; ok {
+		return l, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &queueLog{dir: dir, segmentSize: segmentSize, syncWrite: syncWrite}
+	logs[dir] = l
+	return l, nil
+}
+
+func (l *queueLog) segmentPath(base int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+/**
+ * 按偏移量从小到大列出队列的所有日志段。
+ */
+func (l *queueLog) segments() ([]int64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	bases := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+/**
+ * 获取跨进程的写锁，返回释放锁的函数。
+ */
+func (l *queueLog) lock() (func(), error) {
+	f, err := os.OpenFile(filepath.Join(l.dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}, nil
+}
+
+/**
+ * 读取指定位置的一条记录，返回记录内容和下一条记录的位置。
+ */
+func readRecord(f *os.File, pos int64) ([]byte, int64, error) {
+	var header [headerSize]byte
+	if n, err := f.ReadAt(header[:], pos); n < headerSize {
+		if err == nil || err == io.EOF {
+			return nil, pos, errNotReady
+		}
+		return nil, pos, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, pos, errNotReady
+	}
+	data := make([]byte, size)
+	if n, err := f.ReadAt(data, pos+headerSize); n < int(size) {
+		if err == nil || err == io.EOF {
+			return nil, pos, errNotReady
+		}
+		return nil, pos, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, pos, errNotReady
+	}
+	return data, pos + headerSize + int64(size), nil
+}
+
+/**
+ * 从指定位置开始扫描日志段，返回最后一条完整记录的结束位置以及扫描到的记录数。
+ */
+func scanSegment(f *os.File, pos int64) (int64, int64, error) {
+	var count int64
+	for {
+		_, next, err := readRecord(f, pos)
+		if err == errNotReady {
+			return pos, count, nil
+		} else if err != nil {
+			return pos, count, err
+		}
+		pos = next
+		count++
+	}
+}
+
+/**
+ * 追加一条消息到队列日志中，返回该消息的偏移量。
+ */
+func (l *queueLog) append(data []byte) (int64, error) {
+	if len(data) > maxRecordSize {
+		return 0, fmt.Errorf("消息长度超过限制:%d", len(data))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	unlock, err := l.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	bases, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+	var last int64
+	if len(bases) > 0 {
+		last = bases[len(bases)-1]
+	}
+	f, err := os.OpenFile(l.segmentPath(last), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { f.Close() }()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !l.tailValid || l.tailBase != last || l.tailSize > st.Size() {
+		l.tailBase, l.tailSize, l.tailCount, l.tailValid = last, 0, 0, true
+	}
+	if st.Size() != l.tailSize {
+		end, n, err := scanSegment(f, l.tailSize)
+		if err != nil {
+			l.tailValid = false
+			return 0, err
+		}
+		l.tailSize = end
+		l.tailCount += n
+		// 截断进程崩溃时残留的不完整记录
+		if end < st.Size() {
+			if err = f.Truncate(end); err != nil {
+				l.tailValid = false
+				return 0, err
+			}
+		}
+	}
+	if l.tailSize >= l.segmentSize && l.tailCount > 0 {
+		next := l.tailBase + l.tailCount
+		nf, err := os.OpenFile(l.segmentPath(next), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return 0, err
+		}
+		f.Close()
+		f = nf
+		l.tailBase, l.tailSize, l.tailCount = next, 0, 0
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+	if _, err = f.WriteAt(record, l.tailSize); err != nil {
+		l.tailValid = false
+		return 0, err
+	}
+	if l.syncWrite {
+		if err = f.Sync(); err != nil {
+			l.tailValid = false
+			return 0, err
+		}
+	}
+	offset := l.tailBase + l.tailCount
+	l.tailSize += int64(len(record))
+	l.tailCount++
+	return offset, nil
+}
+
+/**
+ * 将无法解析的消息连同其偏移量转存到隔离文件中，以便监听方跳过该消息后仍可人工排查。
+ */
+func (l *queueLog) poison(offset int64, data []byte) error {
+	f, err := os.OpenFile(filepath.Join(l.dir, "poison"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 8+headerSize+len(data))
+	binary.BigEndian.PutUint64(record[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[12:16], crc32.ChecksumIEEE(data))
+	copy(record[8+headerSize:], data)
+	if _, err = f.Write(record); err == nil && l.syncWrite {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/**
+ * 删除所有消息均已被确认消费的日志段，最后一个日志段始终保留。
+ */
+func (l *queueLog) compact(committed int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	bases, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(bases); i++ {
+		if bases[i+1] > committed {
+			break
+		}
+		if err = os.Remove(l.segmentPath(bases[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * 读取已确认消费的偏移量，不存在时返回0。
+ */
+func (l *queueLog) committed() (int64, error) {
+	data, err := os.ReadFile(filepath.Join(l.dir, "offset"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+/**
+ * 持久化已确认消费的偏移量，先写临时文件再原子替换，避免进程崩溃时偏移量文件损坏。
+ */
+func (l *queueLog) commit(offset int64) error {
+	path := filepath.Join(l.dir, "offset")
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.FormatInt(offset, 10)); err == nil && l.syncWrite {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/**
+ * 队列日志的顺序读取器，由监听方使用。
+ */
+type reader struct {
+	log    *queueLog
+	offset int64 // 下一条待读取消息的偏移量
+	base   int64
+	pos    int64
+	f      *os.File
+}
+
+/**
+ * 创建从指定偏移量开始读取的读取器。
+ */
+func (l *queueLog) reader(offset int64) *reader {
+	return &reader{log: l, offset: offset}
+}
+
+/**
+ * 定位到待读取偏移量所在的日志段及位置。
+ */
+func (r *reader) seek() error {
+	bases, err := r.log.segments()
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		return errNotReady
+	}
+	base := bases[0]
+	for _, b := range bases {
+		if b <= r.offset {
+			base = b
+		}
+	}
+	if r.offset < base {
+		r.offset = base
+	}
+	if err = r.open(base); err != nil {
+		return err
+	}
+	// 跳过日志段中已确认消费的消息
+	target := r.offset
+	r.offset = base
+	for r.offset < target {
+		_, next, err := readRecord(r.f, r.pos)
+		if err == errNotReady {
+			break
+		} else if err != nil {
+			r.Close()
+			return err
+		}
+		r.pos = next
+		r.offset++
+	}
+	return nil
+}
+
+func (r *reader) open(base int64) error {
+	f, err := os.Open(r.log.segmentPath(base))
+	if err != nil {
+		return err
+	}
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f, r.base, r.pos = f, base, 0
+	return nil
+}
+
+/**
+ * 读取下一条消息，返回消息内容及其偏移量，没有新消息时返回errNotReady。
+ */
+func (r *reader) next() ([]byte, int64, error) {
+	if r.f == nil {
+		if err := r.seek(); err != nil {
+			return nil, 0, err
+		}
+	}
+	data, next, err := readRecord(r.f, r.pos)
+	if err == errNotReady {
+		// 当前日志段已读完，如果已经滚动到了新的日志段则切换过去
+		if _, serr := os.Stat(r.log.segmentPath(r.offset)); r.offset == r.base || serr != nil {
+			return nil, 0, errNotReady
+		}
+		if err = r.open(r.offset); err != nil {
+			return nil, 0, err
+		}
+		committed, err := r.log.committed()
+		if err != nil {
+			return nil, 0, err
+		}
+		if err = r.log.compact(committed); err != nil {
+			return nil, 0, err
+		}
+		return r.next()
+	} else if err != nil {
+		return nil, 0, err
+	}
+	offset := r.offset
+	r.pos = next
+	r.offset++
+	return data, offset, nil
+}
+
+func (r *reader) Close() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
@@ -0,0 +1,278 @@
+package memory
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 基于进程内存实现的AMQ提供器，注册名称为<b>memory</b>，同一进程内的所有客户端共享同一组消息队列，
+ * 主要用于单元测试以及单进程内的系统联调，不提供任何持久化能力，进程退出后未消费的消息全部丢失。
+ * <pre>
+ * {"provider":"memory","parameter":{"codec":"json"},"partitions":1}
+ * </pre>
+ * 每个队列只允许一个监听器，队列中的消息按照发送顺序逐条投递给监听器，事务消息的应答消息会自动发送到对应的应答队列。
+ * 处理失败的消息等待一段时间后放回队首重新投递，被拒绝的消息(参看{@link amq.Rejected})直接丢弃。
+ * 延迟投递的消息在投递时间到达后才放入队列，provider关闭时尚未到期的消息被丢弃。
+ */
+func init() {
+	provider.Register("memory", &memoryProvider{})
+}
+
+// 处理失败的消息重新投递前等待的时间
+const requeueInterval = time.Second
+
+var (
+	queuesMu sync.Mutex
+	queues   = make(map[string]*queue)
+)
+
+/**
+ * 获取指定名称的消息队列，不存在则创建。
+ */
+func getQueue(name string) *queue {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	q, ok := queues[name]
+	if !ok {
+		q = &queue{name: name}
+		q.cond = sync.NewCond(&q.mu)
+		queues[name] = q
+	}
+	return q
+}
+
+/**
+ * 进程内的消息队列，未被消费的消息按照发送顺序缓存在队列中。
+ */
+type queue struct {
+	name  string
+	mu    sync.Mutex
+	cond  *sync.Cond
+	items [][]byte
+	sub   *subscription
+}
+
+func (q *queue) push(data []byte) {
+	q.mu.Lock()
+	q.items = append(q.items, data)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+/**
+ * 将处理失败的消息放回队首，保证重新投递时的顺序。
+ */
+func (q *queue) requeue(data []byte) {
+	q.mu.Lock()
+	q.items = append([][]byte{data}, q.items...)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+/**
+ * 阻塞获取队列中的下一条消息，如果订阅已被取消则返回false。
+ */
+func (q *queue) pop(sub *subscription) ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !sub.closed {
+		q.cond.Wait()
+	}
+	if sub.closed {
+		return nil, false
+	}
+	data := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return data, true
+}
+
+/**
+ * 队列上的一个监听，一个队列同一时刻只允许存在一个监听。
+ */
+type subscription struct {
+	queue    *queue
+	listener provider.MessageListener
+	closed   bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type memoryProvider struct {
+	node   node.Node
+	codec  message.Codec
+	mu     sync.Mutex
+	subs   map[string]*subscription
+	timers map[*time.Timer]struct{} // 尚未到期的延迟投递
+	closed bool
+}
+
+func (p *memoryProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	return &memoryProvider{node: node, codec: provider.GetCodec(node, cfg), subs: make(map[string]*subscription), timers: make(map[*time.Timer]struct{})}
+}
+
+func (p *memoryProvider) Listen(name string, listener provider.MessageListener) (closer func(), err error) {
+	q := getQueue(name)
+	q.mu.Lock()
+	if q.sub != nil {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("[AMQ-Memory-%s]消息队列已存在监听器:%s", p.node.String(), name)
+	}
+	sub := &subscription{queue: q, listener: listener, stop: make(chan struct{}), done: make(chan struct{})}
+	q.sub = sub
+	q.mu.Unlock()
+
+	p.mu.Lock()
+	p.subs[name] = sub
+	p.mu.Unlock()
+
+	go p.consume(sub)
+	return func() { p.Cancel(name) }, nil
+}
+
+/**
+ * 按顺序逐条消费队列中的消息，直到监听被取消。
+ */
+func (p *memoryProvider) consume(sub *subscription) {
+	defer close(sub.done)
+	for {
+		data, ok := sub.queue.pop(sub)
+		if !ok {
+			return
+		}
+		mpl, err := message.Unmarshal(data)
+		if err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Memory-%s]消息解析失败:queue=%s", p.node.String(), sub.queue.name)
+			continue
+		}
+		amq.DispatchAsync(mpl, sub.listener, func(rsp *message.MsgPayload, err error) {
+			if err != nil {
+				if !amq.Rejected(err) {
+					log.Error().Err(err).Msgf("[AMQ-Memory-%s]消息处理失败，重新投递:queue=%s,msgId=%s", p.node.String(), sub.queue.name, mpl.MsgId)
+					p.requeue(sub, mpl, data)
+					return
+				}
+				log.Error().Err(err).Msgf("[AMQ-Memory-%s]消息被拒绝，丢弃该消息:queue=%s,msgId=%s", p.node.String(), sub.queue.name, mpl.MsgId)
+			}
+			if rsp != nil {
+				if err := p.Send(rsp); err != nil {
+					log.Error().Err(err).Msgf("[AMQ-Memory-%s]应答消息发送失败:msgId=%s", p.node.String(), rsp.MsgId)
+				}
+			}
+		})
+	}
+}
+
+/**
+ * 等待一段时间(监听被取消时立即)后将消息放回队首，避免处理失败的消息被立即重新投递。
+ */
+func (p *memoryProvider) requeue(sub *subscription, mpl *message.MsgPayload, data []byte) {
+	amq.Requeue(mpl, sub.listener)
+	timer := time.NewTimer(requeueInterval)
+	defer timer.Stop()
+	select {
+	case <-sub.stop:
+	case <-timer.C:
+	}
+	sub.queue.requeue(data)
+}
+
+func (p *memoryProvider) Cancel(name string) {
+	p.mu.Lock()
+	sub, ok := p.subs[name]
+	delete(p.subs, name)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	q := sub.queue
+	close(sub.stop)
+	q.mu.Lock()
+	sub.closed = true
+	if q.sub == sub {
+		q.sub = nil
+	}
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	<-sub.done
+}
+
+func (p *memoryProvider) Send(msg interface{}) error {
+	mpl, err := message.ToPayload(msg)
+	if err != nil {
+		return err
+	}
+	name, err := mpl.SendQueueName()
+	if err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("[AMQ-Memory-%s]消息的目标队列为空:msgId=%s", p.node.String(), mpl.MsgId)
+	}
+	data, err := message.Marshal(p.codec, mpl)
+	if err != nil {
+		return err
+	}
+	q := getQueue(name)
+	if delay := time.Until(time.Unix(0, mpl.DeliverAt*int64(time.Millisecond))); mpl.DeliverAt > 0 && delay > 0 {
+		return p.pushAfter(q, data, delay)
+	}
+	q.push(data)
+	return nil
+}
+
+/**
+ * 投递时间到达后将消息放入队列，provider关闭时取消尚未到期的投递。
+ */
+func (p *memoryProvider) pushAfter(q *queue, data []byte, delay time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return fmt.Errorf("[AMQ-Memory-%s]提供器已关闭", p.node.String())
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		_, ok := p.timers[timer]
+		delete(p.timers, timer)
+		p.mu.Unlock()
+		if ok {
+			q.push(data)
+		}
+	})
+	p.timers[timer] = struct{}{}
+	return nil
+}
+
+func (p *memoryProvider) SupportsDelay() bool {
+	return true
+}
+
+func (p *memoryProvider) SupportsAsync() bool {
+	return true
+}
+
+func (p *memoryProvider) Close() {
+	p.mu.Lock()
+	p.closed = true
+	for timer := range p.timers {
+		timer.Stop()
+	}
+	p.timers = make(map[*time.Timer]struct{})
+	names := make([]string, 0, len(p.subs))
+	for name := range p.subs {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	for _, name := range names {
+		p.Cancel(name)
+	}
+}
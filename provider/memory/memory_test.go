@@ -0,0 +1,128 @@
+package memory
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+)
+
+/**
+ * 记录收到的消息，前fail次处理失败。
+ */
+type testListener struct {
+	mu       sync.Mutex
+	fail     int
+	received chan string
+}
+
+func (l *testListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	l.received <- msg.(*message.NoticeMessage).Body.Get("id")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fail > 0 {
+		l.fail--
+		return nil, errors.New("处理失败")
+	}
+	return nil, nil
+}
+
+func (l *testListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (l *testListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func newTestProvider(t *testing.T) *memoryProvider {
+	p := (&memoryProvider{}).New(node.BIZ, map[string]string{}).(*memoryProvider)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func notice(msgId, queue string) *message.MsgPayload {
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("test")
+	nm.SetBody(message.NewMessageBody().Add("id", msgId))
+	nm.Destination = queue
+	return message.NoticePayload(nm)
+}
+
+func expectReceived(t *testing.T, l *testListener, want string) {
+	t.Helper()
+	select {
+	case msgId := <-l.received:
+		if msgId != want {
+			t.Fatalf("期望收到消息%s，实际为%s", want, msgId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待收到消息%s超时", want)
+	}
+}
+
+func expectNothing(t *testing.T, l *testListener, wait time.Duration) {
+	t.Helper()
+	select {
+	case msgId := <-l.received:
+		t.Fatalf("不应收到消息%s", msgId)
+	case <-time.After(wait):
+	}
+}
+
+func TestRequeueFailedMessage(t *testing.T) {
+	p := newTestProvider(t)
+	l := &testListener{fail: 1, received: make(chan string, 8)}
+	if _, err := p.Listen("memory_q1", l); err != nil {
+		t.Fatal(err)
+	}
+	for _, msgId := range []string{"m1", "m2"} {
+		if err := p.Send(notice(msgId, "memory_q1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 处理失败的消息放回队首，重新投递时仍在后续消息之前
+	expectReceived(t, l, "m1")
+	expectReceived(t, l, "m1")
+	expectReceived(t, l, "m2")
+}
+
+func TestDropRejectedMessage(t *testing.T) {
+	p := newTestProvider(t)
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := p.Listen("memory_q2", l); err != nil {
+		t.Fatal(err)
+	}
+	tampered := notice("m3", "memory_q2")
+	tampered.Sign = "tampered"
+	if err := p.Send(tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(notice("m4", "memory_q2")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m4")
+	expectNothing(t, l, 100*time.Millisecond)
+}
+
+func TestCancelDelayedMessageOnClose(t *testing.T) {
+	p := (&memoryProvider{}).New(node.BIZ, map[string]string{}).(*memoryProvider)
+	delayed := notice("m5", "memory_q3")
+	delayed.DeliverAt = time.Now().Add(50*time.Millisecond).UnixNano() / int64(time.Millisecond)
+	if err := p.Send(delayed); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if err := p.Send(delayed); err == nil {
+		t.Fatal("期望关闭后发送延迟消息失败")
+	}
+	other := newTestProvider(t)
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := other.Listen("memory_q3", l); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, l, 200*time.Millisecond)
+}
@@ -1,10 +1,12 @@
 package provider
 
 import (
+	"database/sql"
 	"sync"
 
 	"github.com/aluka-7/amq/message"
 	"github.com/aluka-7/amq/node"
+	"github.com/rs/zerolog/log"
 )
 
 /**
@@ -41,6 +43,22 @@ func Read(key string) Provider {
 	return p
 }
 
+/**
+ * 获取初始化参数中指定的消息编码(codec)，未配置时使用JSON编码，参看{@link message.Codec}。
+ *
+ * @param node
+ * @param cfg
+ * @return
+ */
+func GetCodec(node node.Node, cfg map[string]string) message.Codec {
+	codec, err := message.GetCodec(cfg["codec"])
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Provider-%s]消息编码配置错误，使用默认的JSON编码", node.String())
+		return message.JSONCodec
+	}
+	return codec
+}
+
 type Provider interface {
 	// 初始化客户端接口
 	New(node node.Node, cfg map[string]string) Provider
@@ -80,6 +98,43 @@ type Provider interface {
 	Close()
 }
 
+/**
+ * 可选接口，基于数据库实现的provider可实现该接口，使消息的发送参与到业务系统的数据库事务中，
+ * 业务数据和消息一起提交或回滚。
+ */
+type TxSender interface {
+	/**
+	 * 在给定的事务中发送AMQ消息，消息在事务提交后才会被投递。
+	 *
+	 * @param tx
+	 * @param message
+	 * @throws error
+	 */
+	SendTx(tx *sql.Tx, message interface{}) error
+}
+
+/**
+ * 可选接口，能够自行延迟投递消息的provider实现该接口，其{@link Provider#Send}方法保证消息在
+ * {@link message.MsgPayload#DeliverAt}之前不会被投递给监听器；未实现该接口的provider由客户端的调度器在投递时间到达后再发送。
+ */
+type DelaySender interface {
+	/**
+	 * 是否支持延迟投递，返回false时等同于未实现该接口。
+	 */
+	SupportsDelay() bool
+}
+
+/**
+ * 可选接口，通过{@link amq.DispatchAsync}在消息处理完成时才确认、能够同时投递多条未确认消息的provider实现该接口。
+ * 客户端配置了并发处理时要求provider实现该接口，逐条同步确认消息的provider即使并发处理也只是增加一次协程切换，不会提高吞吐量。
+ */
+type AsyncDispatcher interface {
+	/**
+	 * 是否支持并发处理，返回false时等同于未实现该接口。
+	 */
+	SupportsAsync() bool
+}
+
 /**
  * AMQ消息的监听器接口定义。
  */
@@ -0,0 +1,406 @@
+package rabbit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 基于RabbitMQ(AMQP 0-9-1协议)实现的AMQ提供器，注册名称为<b>Rabbit</b>(兼容小写<b>rabbit</b>)，初始化参数如下：
+ * <pre>
+ * {
+ *   "provider" : "Rabbit",
+ *   "parameter" : {
+ *     "username" : "guest",          // 登录用户名
+ *     "password" : "guest",          // 登录密码
+ *     "brokerURL" : "localhost:5672", // 服务地址，也可以是完整的amqp://地址
+ *     "vhost" : "/",                 // 虚拟主机(可选)
+ *     "codec" : "json",              // 消息编码(可选，默认使用节点配置的codec)
+ *     "prefetch" : "1"               // 每个监听同时投递的未确认消息数量(可选，默认1)，配合客户端的并发处理配置使用
+ *   },
+ *   "partitions" : 1
+ * }
+ * </pre>
+ * 为满足{@link provider.Provider}中对消息顺序性、唯一消费和消息通知的要求，所有队列均声明为持久化队列，消息以持久化方式
+ * 通过默认交换机投递并等待服务端确认；监听时使用独占消费者以及手动应答，只有在消息处理完成(包括应答消息发送成功)后才向服务端确认。
+ * 处理失败或应答消息发送失败的消息等待一段时间后重新入队，被拒绝的消息(参看{@link amq.Rejected})确认后丢弃。
+ * prefetch大于1时消息由客户端的协程池并发处理，分区键相同的消息仍按顺序处理，重新入队的消息排到队尾。
+ */
+func init() {
+	provider.Register("Rabbit", &rabbitProvider{})
+	provider.Register("rabbit", &rabbitProvider{})
+}
+
+const (
+	reconnectInterval = 5 * time.Second // 连接断开后重新监听的间隔
+	requeueInterval   = time.Second     // 处理失败的消息重新入队前等待的时间
+)
+
+type rabbitProvider struct {
+	node     node.Node
+	url      string
+	codec    message.Codec
+	prefetch int
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	sendCh   *amqp.Channel
+	declared map[string]bool
+	subs     map[string]*subscription
+	closed   bool
+}
+
+/**
+ * 队列上的一个监听。
+ */
+type subscription struct {
+	name     string
+	tag      string
+	listener provider.MessageListener
+	channel  *amqp.Channel
+	stop     chan struct{}
+	done     chan struct{}
+	pending  sync.WaitGroup // 已投递但尚未确认的消息
+}
+
+func (p *rabbitProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	rp := &rabbitProvider{
+		node:     node,
+		url:      buildURL(cfg),
+		codec:    provider.GetCodec(node, cfg),
+		prefetch: 1,
+		declared: make(map[string]bool),
+		subs:     make(map[string]*subscription),
+	}
+	if v, err := strconv.Atoi(cfg["prefetch"]); err == nil && v > 0 {
+		rp.prefetch = v
+	}
+	return rp
+}
+
+/**
+ * 根据初始化参数构建AMQP连接地址。
+ */
+func buildURL(cfg map[string]string) string {
+	broker := cfg["brokerURL"]
+	if strings.HasPrefix(broker, "amqp://") || strings.HasPrefix(broker, "amqps://") {
+		return broker
+	}
+	if len(broker) == 0 {
+		broker = "localhost:5672"
+	}
+	u := &url.URL{Scheme: "amqp", Host: broker, Path: "/"}
+	if username := cfg["username"]; len(username) > 0 {
+		u.User = url.UserPassword(username, cfg["password"])
+	}
+	if vhost := cfg["vhost"]; len(vhost) > 0 && vhost != "/" {
+		u.Path = "/" + strings.TrimPrefix(vhost, "/")
+	}
+	return u.String()
+}
+
+/**
+ * 获取到RabbitMQ的连接，如果连接不存在或已断开则重新建立，调用方需持有p.mu。
+ */
+func (p *rabbitProvider) connection() (*amqp.Connection, error) {
+	if p.closed {
+		return nil, fmt.Errorf("[AMQ-Rabbit-%s]提供器已关闭", p.node.String())
+	}
+	if p.conn != nil && !p.conn.IsClosed() {
+		return p.conn, nil
+	}
+	conn, err := amqp.Dial(p.url)
+	if err != nil {
+		return nil, fmt.Errorf("[AMQ-Rabbit-%s]连接RabbitMQ失败:%v", p.node.String(), err)
+	}
+	p.conn = conn
+	p.sendCh = nil
+	p.declared = make(map[string]bool)
+	return conn, nil
+}
+
+/**
+ * 声明持久化队列，队列名称由客户端按照sys_amq_{systemId}_{node}[_p{partition}]的格式构建。
+ */
+func declare(ch *amqp.Channel, name string) error {
+	_, err := ch.QueueDeclare(name, true, false, false, false, nil)
+	return err
+}
+
+func (p *rabbitProvider) Listen(name string, listener provider.MessageListener) (closer func(), err error) {
+	p.mu.Lock()
+	if _, ok := p.subs[name]; ok {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("[AMQ-Rabbit-%s]消息队列已存在监听器:%s", p.node.String(), name)
+	}
+	sub := &subscription{
+		name:     name,
+		tag:      fmt.Sprintf("amq-%s-%d", name, time.Now().UnixNano()),
+		listener: listener,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	deliveries, err := p.subscribe(sub)
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.subs[name] = sub
+	p.mu.Unlock()
+
+	go p.consume(sub, deliveries)
+	return func() { p.Cancel(name) }, nil
+}
+
+/**
+ * 为监听打开独立的通道并开始消费，调用方需持有p.mu。
+ */
+func (p *rabbitProvider) subscribe(sub *subscription) (<-chan amqp.Delivery, error) {
+	conn, err := p.connection()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err = declare(ch, sub.name); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	// 限制未确认的消息数量，默认每次只投递一条，保证消息按顺序逐条处理
+	if err = ch.Qos(p.prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	deliveries, err := ch.Consume(sub.name, sub.tag, false, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	sub.channel = ch
+	return deliveries, nil
+}
+
+/**
+ * 按顺序分发投递的消息，连接断开时自动重新监听，直到监听被取消。
+ */
+func (p *rabbitProvider) consume(sub *subscription, deliveries <-chan amqp.Delivery) {
+	defer close(sub.done)
+	for {
+		if deliveries != nil {
+			for d := range deliveries {
+				p.handle(sub, d)
+			}
+		}
+		select {
+		case <-sub.stop:
+			return
+		case <-time.After(reconnectInterval):
+		}
+		p.mu.Lock()
+		if p.subs[sub.name] != sub {
+			p.mu.Unlock()
+			return
+		}
+		var err error
+		deliveries, err = p.subscribe(sub)
+		p.mu.Unlock()
+		if err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Rabbit-%s]重新监听消息队列失败:queue=%s", p.node.String(), sub.name)
+			continue
+		}
+		log.Info().Msgf("[AMQ-Rabbit-%s]重新监听消息队列成功:queue=%s", p.node.String(), sub.name)
+	}
+}
+
+func (p *rabbitProvider) handle(sub *subscription, d amqp.Delivery) {
+	mpl, err := message.Unmarshal(d.Body)
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Rabbit-%s]消息解析失败:queue=%s", p.node.String(), sub.name)
+		_ = d.Reject(false)
+		return
+	}
+	// 连接断开等情况下未确认的消息由broker重新投递，重放检查不再按发送时间拒绝
+	mpl.Redelivered = d.Redelivered
+	sub.pending.Add(1)
+	amq.DispatchAsync(mpl, sub.listener, func(rsp *message.MsgPayload, err error) {
+		defer sub.pending.Done()
+		p.complete(sub, d, mpl, rsp, err)
+	})
+}
+
+/**
+ * 消息处理完成后发送应答消息并向服务端确认，处理失败时重新入队。
+ */
+func (p *rabbitProvider) complete(sub *subscription, d amqp.Delivery, mpl *message.MsgPayload, rsp *message.MsgPayload, err error) {
+	if err != nil {
+		if !amq.Rejected(err) {
+			log.Error().Err(err).Msgf("[AMQ-Rabbit-%s]消息处理失败，重新入队:queue=%s,msgId=%s", p.node.String(), sub.name, mpl.MsgId)
+			p.requeue(sub, d, mpl)
+			return
+		}
+		log.Error().Err(err).Msgf("[AMQ-Rabbit-%s]消息被拒绝，丢弃该消息:queue=%s,msgId=%s", p.node.String(), sub.name, mpl.MsgId)
+	}
+	if rsp != nil {
+		if err := p.Send(rsp); err != nil {
+			// 应答消息未能送达时重新入队，避免事务消息的应答丢失
+			log.Error().Err(err).Msgf("[AMQ-Rabbit-%s]应答消息发送失败:msgId=%s", p.node.String(), rsp.MsgId)
+			p.requeue(sub, d, mpl)
+			return
+		}
+	}
+	_ = d.Ack(false)
+}
+
+/**
+ * 等待一段时间(监听被取消时立即)后将消息重新入队，避免处理失败的消息被立即重新投递。
+ */
+func (p *rabbitProvider) requeue(sub *subscription, d amqp.Delivery, mpl *message.MsgPayload) {
+	amq.Requeue(mpl, sub.listener)
+	timer := time.NewTimer(requeueInterval)
+	defer timer.Stop()
+	select {
+	case <-sub.stop:
+	case <-timer.C:
+	}
+	_ = d.Nack(false, true)
+}
+
+func (p *rabbitProvider) Cancel(name string) {
+	p.mu.Lock()
+	sub, ok := p.subs[name]
+	delete(p.subs, name)
+	var ch *amqp.Channel
+	if ok {
+		ch = sub.channel
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(sub.stop)
+	if ch != nil {
+		_ = ch.Cancel(sub.tag, false)
+	}
+	<-sub.done
+	// 等待处理中的消息确认后再关闭通道
+	sub.pending.Wait()
+	if ch != nil {
+		_ = ch.Close()
+	}
+}
+
+/**
+ * 消息处理完成后才确认，配合prefetch参数可以同时投递多条未确认的消息。
+ */
+func (p *rabbitProvider) SupportsAsync() bool {
+	return true
+}
+
+func (p *rabbitProvider) Send(msg interface{}) error {
+	mpl, err := message.ToPayload(msg)
+	if err != nil {
+		return err
+	}
+	name, err := mpl.SendQueueName()
+	if err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("[AMQ-Rabbit-%s]消息的目标队列为空:msgId=%s", p.node.String(), mpl.MsgId)
+	}
+	data, err := message.Marshal(p.codec, mpl)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, err := p.sendChannel()
+	if err != nil {
+		return err
+	}
+	if !p.declared[name] {
+		if err = declare(ch, name); err != nil {
+			p.sendCh = nil
+			return err
+		}
+		p.declared[name] = true
+	}
+	dc, err := ch.PublishWithDeferredConfirmWithContext(context.Background(), "", name, false, false, amqp.Publishing{
+		ContentType:  p.codec.ContentType(),
+		DeliveryMode: amqp.Persistent,
+		MessageId:    mpl.MsgId,
+		Type:         mpl.Genre,
+		Timestamp:    time.Unix(mpl.SendTime, 0),
+		Body:         data,
+	})
+	if err != nil {
+		p.sendCh = nil
+		return err
+	}
+	if !dc.Wait() {
+		return fmt.Errorf("[AMQ-Rabbit-%s]消息未被服务端确认:queue=%s,msgId=%s", p.node.String(), name, mpl.MsgId)
+	}
+	return nil
+}
+
+/**
+ * 获取开启了发布确认的发送通道，调用方需持有p.mu。
+ */
+func (p *rabbitProvider) sendChannel() (*amqp.Channel, error) {
+	conn, err := p.connection()
+	if err != nil {
+		return nil, err
+	}
+	if p.sendCh != nil && !p.sendCh.IsClosed() {
+		return p.sendCh, nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	p.sendCh = ch
+	p.declared = make(map[string]bool)
+	return ch, nil
+}
+
+func (p *rabbitProvider) Close() {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.subs))
+	for name := range p.subs {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	for _, name := range names {
+		p.Cancel(name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.sendCh != nil {
+		_ = p.sendCh.Close()
+		p.sendCh = nil
+	}
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+}
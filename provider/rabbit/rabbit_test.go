@@ -0,0 +1,495 @@
+package rabbit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+)
+
+/**
+ * 测试用的AMQP 0-9-1服务端，只实现了rabbitProvider用到的方法，所有连接共享同一组队列，每个消费者最多只有一条未确认的消息。
+ */
+type fakeBroker struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	queues map[string]*fakeQueue
+	events chan string // 消费者对投递的应答:ack、nack、nack-requeue、reject、reject-requeue
+}
+
+type fakeQueue struct {
+	name     string
+	ready    []fakeMessage
+	consumer *fakeChannel
+}
+
+type fakeMessage struct {
+	body        []byte
+	redelivered bool
+}
+
+/**
+ * 已投递但尚未确认的消息。
+ */
+type fakeDelivery struct {
+	queue *fakeQueue
+	body  []byte
+}
+
+type fakeConn struct {
+	broker   *fakeBroker
+	conn     net.Conn
+	wmu      sync.Mutex
+	channels map[uint16]*fakeChannel
+}
+
+type fakeChannel struct {
+	conn    *fakeConn
+	id      uint16
+	confirm bool
+	seq     uint64
+	tag     string
+	queue   *fakeQueue
+	unacked map[uint64]*fakeDelivery
+	last    uint64
+	// 正在接收的消息
+	routingKey string
+	size       uint64
+	body       []byte
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, queues: make(map[string]*fakeQueue), events: make(chan string, 64)}
+	go b.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "amqp://guest:guest@" + b.ln.Addr().String() + "/"
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{broker: b, conn: conn, channels: make(map[uint16]*fakeChannel)}
+		go c.serve()
+	}
+}
+
+func (b *fakeBroker) queue(name string) *fakeQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &fakeQueue{name: name}
+		b.queues[name] = q
+	}
+	return q
+}
+
+/**
+ * 将队列中的下一条消息投递给消费者，调用方需持有b.mu。
+ */
+func (b *fakeBroker) deliver(q *fakeQueue) {
+	ch := q.consumer
+	if ch == nil || len(q.ready) == 0 || len(ch.unacked) > 0 {
+		return
+	}
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	ch.last++
+	ch.unacked[ch.last] = &fakeDelivery{queue: q, body: m.body}
+	redelivered := byte(0)
+	if m.redelivered {
+		redelivered = 1
+	}
+	var frames bytes.Buffer
+	frames.Write(frame(1, ch.id, method(60, 60, shortstr(ch.tag), longlong(ch.last), []byte{redelivered}, shortstr(""), shortstr(q.name))))
+	frames.Write(frame(2, ch.id, header(len(m.body))))
+	frames.Write(frame(3, ch.id, m.body))
+	_ = ch.conn.write(frames.Bytes())
+}
+
+/**
+ * 将通道上未确认的消息重新放回队列头部并移除消费者，调用方需持有b.mu。
+ */
+func (b *fakeBroker) release(ch *fakeChannel) {
+	for tag := range ch.unacked {
+		b.settle(ch, tag, true)
+	}
+	if ch.queue != nil && ch.queue.consumer == ch {
+		ch.queue.consumer = nil
+	}
+	ch.queue = nil
+}
+
+/**
+ * 确认或拒绝投递的消息，requeue为true时将消息重新放回队列头部，调用方需持有b.mu。
+ */
+func (b *fakeBroker) settle(ch *fakeChannel, tag uint64, requeue bool) {
+	d := ch.unacked[tag]
+	delete(ch.unacked, tag)
+	if requeue {
+		d.queue.ready = append([]fakeMessage{{body: d.body, redelivered: true}}, d.queue.ready...)
+	}
+}
+
+func (c *fakeConn) serve() {
+	defer c.close()
+	proto := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, proto); err != nil {
+		return
+	}
+	_ = c.write(frame(1, 0, method(10, 10, []byte{0, 9}, table(), longstr("PLAIN"), longstr("en_US"))))
+	head := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(c.conn, head); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return
+		}
+		if !c.handle(head[0], binary.BigEndian.Uint16(head[1:]), payload[:len(payload)-1]) {
+			return
+		}
+	}
+}
+
+func (c *fakeConn) close() {
+	c.broker.mu.Lock()
+	for _, ch := range c.channels {
+		c.broker.release(ch)
+	}
+	for _, q := range c.broker.queues {
+		c.broker.deliver(q)
+	}
+	c.broker.mu.Unlock()
+	_ = c.conn.Close()
+}
+
+func (c *fakeConn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *fakeConn) reply(channel uint16, class, id uint16, args ...[]byte) {
+	_ = c.write(frame(1, channel, method(class, id, args...)))
+}
+
+func (c *fakeConn) handle(typ byte, channel uint16, payload []byte) bool {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := c.channels[channel]
+	switch typ {
+	case 2:
+		r := &reader{b: payload}
+		r.short()
+		r.short()
+		ch.size = r.longlong()
+		ch.body = nil
+		if ch.size == 0 {
+			c.publish(ch)
+		}
+		return true
+	case 3:
+		ch.body = append(ch.body, payload...)
+		if uint64(len(ch.body)) >= ch.size {
+			c.publish(ch)
+		}
+		return true
+	case 8:
+		return true
+	}
+	r := &reader{b: payload}
+	class, id := r.short(), r.short()
+	switch {
+	case class == 10 && id == 11:
+		c.reply(0, 10, 30, short(0), long(131072), short(0))
+	case class == 10 && id == 40:
+		c.reply(0, 10, 41, shortstr(""))
+	case class == 10 && id == 50:
+		c.reply(0, 10, 51)
+		return false
+	case class == 10 && id == 51:
+		return false
+	case class == 20 && id == 10:
+		c.channels[channel] = &fakeChannel{conn: c, id: channel, unacked: make(map[uint64]*fakeDelivery)}
+		c.reply(channel, 20, 11, longstr(""))
+	case class == 20 && id == 40:
+		if ch != nil {
+			q := ch.queue
+			b.release(ch)
+			delete(c.channels, channel)
+			if q != nil {
+				b.deliver(q)
+			}
+		}
+		c.reply(channel, 20, 41)
+	case class == 50 && id == 10:
+		r.short()
+		name := r.shortstr()
+		q := b.queue(name)
+		c.reply(channel, 50, 11, shortstr(name), long(uint32(len(q.ready))), long(0))
+	case class == 60 && id == 10:
+		c.reply(channel, 60, 11)
+	case class == 60 && id == 20:
+		r.short()
+		q := b.queue(r.shortstr())
+		ch.tag = r.shortstr()
+		ch.queue = q
+		q.consumer = ch
+		c.reply(channel, 60, 21, shortstr(ch.tag))
+		b.deliver(q)
+	case class == 60 && id == 30:
+		tag := r.shortstr()
+		if ch.queue != nil && ch.queue.consumer == ch {
+			ch.queue.consumer = nil
+		}
+		c.reply(channel, 60, 31, shortstr(tag))
+	case class == 60 && id == 40:
+		r.short()
+		r.shortstr()
+		ch.routingKey = r.shortstr()
+	case class == 60 && (id == 80 || id == 90 || id == 120):
+		tag := r.longlong()
+		bits := r.octet()
+		requeue := (id == 90 && bits&1 != 0) || (id == 120 && bits&2 != 0)
+		d, ok := ch.unacked[tag]
+		if !ok {
+			return true
+		}
+		event := map[uint16]string{80: "ack", 90: "reject", 120: "nack"}[id]
+		if requeue {
+			event += "-requeue"
+		}
+		b.settle(ch, tag, requeue)
+		b.events <- event
+		b.deliver(d.queue)
+	case class == 85 && id == 10:
+		ch.confirm = true
+		c.reply(channel, 85, 11)
+	}
+	return true
+}
+
+/**
+ * 接收完一条消息后放入目标队列，开启了发布确认的通道同时向发送方确认。
+ */
+func (c *fakeConn) publish(ch *fakeChannel) {
+	q := c.broker.queue(ch.routingKey)
+	q.ready = append(q.ready, fakeMessage{body: ch.body})
+	ch.body = nil
+	if ch.confirm {
+		ch.seq++
+		c.reply(ch.id, 60, 80, longlong(ch.seq), []byte{0})
+	}
+	c.broker.deliver(q)
+}
+
+func frame(typ byte, channel uint16, payload []byte) []byte {
+	buf := make([]byte, 7, 8+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:], channel)
+	binary.BigEndian.PutUint32(buf[3:], uint32(len(payload)))
+	buf = append(buf, payload...)
+	return append(buf, 0xCE)
+}
+
+func method(class, id uint16, args ...[]byte) []byte {
+	buf := append(short(class), short(id)...)
+	for _, arg := range args {
+		buf = append(buf, arg...)
+	}
+	return buf
+}
+
+func header(size int) []byte {
+	return method(60, 0, longlong(uint64(size)), short(0))
+}
+
+func short(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func long(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func longlong(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func shortstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func longstr(s string) []byte {
+	return append(long(uint32(len(s))), s...)
+}
+
+func table() []byte {
+	return long(0)
+}
+
+type reader struct {
+	b []byte
+}
+
+func (r *reader) octet() byte {
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) short() uint16 {
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) longlong() uint64 {
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *reader) shortstr() string {
+	n := int(r.octet())
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+/**
+ * 记录收到的消息，前fail次处理失败。
+ */
+type testListener struct {
+	mu       sync.Mutex
+	fail     int
+	received chan string
+}
+
+func (l *testListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	l.received <- msg.(*message.NoticeMessage).Body.Get("id")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fail > 0 {
+		l.fail--
+		return nil, errors.New("处理失败")
+	}
+	return nil, nil
+}
+
+func (l *testListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (l *testListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func notice(msgId, queue string) *message.MsgPayload {
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("test")
+	nm.SetBody(message.NewMessageBody().Add("id", msgId))
+	nm.Destination = queue
+	return message.NoticePayload(nm)
+}
+
+func expectEvent(t *testing.T, b *fakeBroker, want string) {
+	t.Helper()
+	select {
+	case event := <-b.events:
+		if event != want {
+			t.Fatalf("期望服务端收到%s，实际为%s", want, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待服务端收到%s超时", want)
+	}
+}
+
+func expectReceived(t *testing.T, l *testListener, want string) {
+	t.Helper()
+	select {
+	case msgId := <-l.received:
+		if msgId != want {
+			t.Fatalf("期望收到消息%s，实际为%s", want, msgId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待收到消息%s超时", want)
+	}
+}
+
+func TestAckHandledMessage(t *testing.T) {
+	b := newFakeBroker(t)
+	p := (&rabbitProvider{}).New(node.BIZ, map[string]string{"brokerURL": b.url()})
+	defer p.Close()
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := p.Listen("q0", l); err != nil {
+		t.Fatal(err)
+	}
+	for _, msgId := range []string{"m0", "m1"} {
+		if err := p.Send(notice(msgId, "q0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectReceived(t, l, "m0")
+	expectEvent(t, b, "ack")
+	expectReceived(t, l, "m1")
+	expectEvent(t, b, "ack")
+}
+
+func TestRequeueFailedMessage(t *testing.T) {
+	b := newFakeBroker(t)
+	p := (&rabbitProvider{}).New(node.BIZ, map[string]string{"brokerURL": b.url()})
+	defer p.Close()
+	l := &testListener{fail: 1, received: make(chan string, 8)}
+	if _, err := p.Listen("q1", l); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(notice("m1", "q1")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m1")
+	expectEvent(t, b, "nack-requeue")
+	expectReceived(t, l, "m1")
+	expectEvent(t, b, "ack")
+}
+
+func TestAckRejectedMessage(t *testing.T) {
+	b := newFakeBroker(t)
+	p := (&rabbitProvider{}).New(node.BIZ, map[string]string{"brokerURL": b.url()})
+	defer p.Close()
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := p.Listen("q2", l); err != nil {
+		t.Fatal(err)
+	}
+	tampered := notice("m2", "q2")
+	tampered.Sign = "tampered"
+	if err := p.Send(tampered); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, b, "ack")
+	if err := p.Send(notice("m3", "q2")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m3")
+	expectEvent(t, b, "ack")
+}
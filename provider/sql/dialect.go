@@ -0,0 +1,39 @@
+package sql
+
+import (
+	"github.com/aluka-7/amq/internal/sqldialect"
+)
+
+/**
+ * SQL方言以及对应的消息表建表语句。
+ */
+type dialect struct {
+	*sqldialect.Dialect
+	// 建表语句，参数为表名
+	schema []string
+}
+
+var schemas = map[string][]string{
+	"postgres": {
+		"CREATE TABLE IF NOT EXISTS %[1]s (id BIGSERIAL PRIMARY KEY, queue VARCHAR(255) NOT NULL, msg_id VARCHAR(64) NOT NULL, payload TEXT NOT NULL, created_at BIGINT NOT NULL, deliver_at BIGINT NOT NULL DEFAULT 0)",
+		"CREATE INDEX IF NOT EXISTS %[1]s_queue_idx ON %[1]s (queue, id)",
+	},
+	"mysql": {
+		"CREATE TABLE IF NOT EXISTS %[1]s (id BIGINT AUTO_INCREMENT PRIMARY KEY, queue VARCHAR(255) NOT NULL, msg_id VARCHAR(64) NOT NULL, payload LONGTEXT NOT NULL, created_at BIGINT NOT NULL, deliver_at BIGINT NOT NULL DEFAULT 0, INDEX %[1]s_queue_idx (queue, id)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	},
+	"sqlite": {
+		"CREATE TABLE IF NOT EXISTS %[1]s (id INTEGER PRIMARY KEY AUTOINCREMENT, queue VARCHAR(255) NOT NULL, msg_id VARCHAR(64) NOT NULL, payload TEXT NOT NULL, created_at BIGINT NOT NULL, deliver_at BIGINT NOT NULL DEFAULT 0)",
+		"CREATE INDEX IF NOT EXISTS %[1]s_queue_idx ON %[1]s (queue, id)",
+	},
+}
+
+/**
+ * 根据配置的方言名称或驱动名称获取对应的方言。
+ */
+func getDialect(name, driver string) (*dialect, error) {
+	d, err := sqldialect.Get(name, driver)
+	if err != nil {
+		return nil, err
+	}
+	return &dialect{Dialect: d, schema: schemas[d.Name]}, nil
+}
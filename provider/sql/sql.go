@@ -0,0 +1,359 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 基于关系型数据库(database/sql)实现的AMQ提供器，注册名称为<b>sql</b>，每个队列对应消息表中queue字段相同的一组记录，
+ * 数据库驱动需由业务系统自行引入(如SQLite、Postgres、MySQL)，初始化参数如下：
+ * <pre>
+ * {
+ *   "provider" : "sql",
+ *   "parameter" : {
+ *     "driver" : "postgres",             // database/sql的驱动名称
+ *     "dsn" : "postgres://...",          // 数据源
+ *     "dialect" : "postgres",            // SQL方言(可选，postgres/mysql/sqlite，默认根据驱动名称推断)
+ *     "table" : "amq_message",           // 消息表名(可选，默认amq_message)
+ *     "autoCreate" : "true",             // 是否自动建表(可选，默认true)
+ *     "pollInterval" : "200",            // 监听方轮询新消息的间隔(毫秒，可选，默认200)
+ *     "codec" : "json"                   // 消息编码(可选，默认使用节点配置的codec)，非JSON编码以Base64文本保存
+ *   },
+ *   "partitions" : 1
+ * }
+ * </pre>
+ * 监听方在一个数据库事务中使用SELECT ... FOR UPDATE SKIP LOCKED锁定队列中最早的一条消息，处理完成后在同一事务中写入应答消息并删除
+ * 该消息，任何一步失败(包括消息处理失败)都会回滚，等待一段时间后重新处理，从而保证消息不会丢失；被拒绝的消息(参看{@link amq.Rejected})
+ * 和无法解析的消息直接删除。另外可通过{@link #SendTx}在业务系统的事务中发送消息，使业务数据和消息一起提交。
+ * 延迟投递的消息记录投递时间(deliver_at字段)，投递时间到达之前不会被监听方读取，旧版本创建的消息表会自动增加该字段。
+ */
+func init() {
+	provider.Register("sql", &sqlProvider{})
+}
+
+const (
+	defaultTable        = "amq_message"
+	defaultPollInterval = 200 * time.Millisecond
+	retryInterval       = time.Second // 消息处理失败或数据库出错后重新读取消息前等待的时间
+)
+
+var tablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type sqlProvider struct {
+	node         node.Node
+	codec        message.Codec
+	driver       string
+	dsn          string
+	dialectName  string
+	table        string
+	autoCreate   bool
+	pollInterval time.Duration
+
+	mu      sync.Mutex
+	db      *sql.DB
+	dialect *dialect
+	subs    map[string]*subscription
+}
+
+/**
+ * 队列上的一个监听。
+ */
+type subscription struct {
+	name     string
+	listener provider.MessageListener
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (p *sqlProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	sp := &sqlProvider{
+		node:         node,
+		codec:        provider.GetCodec(node, cfg),
+		driver:       cfg["driver"],
+		dsn:          cfg["dsn"],
+		dialectName:  cfg["dialect"],
+		table:        cfg["table"],
+		autoCreate:   true,
+		pollInterval: defaultPollInterval,
+		subs:         make(map[string]*subscription),
+	}
+	if len(sp.table) == 0 {
+		sp.table = defaultTable
+	}
+	if v, err := strconv.ParseBool(cfg["autoCreate"]); err == nil {
+		sp.autoCreate = v
+	}
+	if v, err := strconv.Atoi(cfg["pollInterval"]); err == nil && v > 0 {
+		sp.pollInterval = time.Duration(v) * time.Millisecond
+	}
+	return sp
+}
+
+/**
+ * 打开数据库连接并按需创建消息表，只会执行一次。
+ */
+func (p *sqlProvider) open() (*sql.DB, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db != nil {
+		return p.db, nil
+	}
+	if !tablePattern.MatchString(p.table) {
+		return nil, fmt.Errorf("[AMQ-SQL-%s]无效的消息表名:%s", p.node.String(), p.table)
+	}
+	d, err := getDialect(p.dialectName, p.driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(p.driver, p.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("[AMQ-SQL-%s]打开数据库失败:%v", p.node.String(), err)
+	}
+	if p.autoCreate {
+		for _, stmt := range d.schema {
+			if _, err = db.Exec(fmt.Sprintf(stmt, p.table)); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("[AMQ-SQL-%s]创建消息表失败:%v", p.node.String(), err)
+			}
+		}
+		// 旧版本创建的消息表没有投递时间字段
+		if _, err = db.Exec(fmt.Sprintf("SELECT deliver_at FROM %s WHERE 1 = 0", p.table)); err != nil {
+			if _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN deliver_at BIGINT NOT NULL DEFAULT 0", p.table)); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("[AMQ-SQL-%s]升级消息表失败:%v", p.node.String(), err)
+			}
+		}
+	}
+	p.db, p.dialect = db, d
+	return db, nil
+}
+
+func (p *sqlProvider) Listen(name string, listener provider.MessageListener) (closer func(), err error) {
+	if _, err = p.open(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if _, ok := p.subs[name]; ok {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("[AMQ-SQL-%s]消息队列已存在监听器:%s", p.node.String(), name)
+	}
+	sub := &subscription{name: name, listener: listener, stop: make(chan struct{}), done: make(chan struct{})}
+	p.subs[name] = sub
+	p.mu.Unlock()
+
+	go p.consume(sub)
+	return func() { p.Cancel(name) }, nil
+}
+
+/**
+ * 轮询并逐条消费队列中的消息，队列为空时等待一个轮询间隔，直到监听被取消。
+ */
+func (p *sqlProvider) consume(sub *subscription) {
+	defer close(sub.done)
+	for {
+		select {
+		case <-sub.stop:
+			return
+		default:
+		}
+		ok, err := p.poll(sub)
+		interval := p.pollInterval
+		if err != nil {
+			log.Error().Err(err).Msgf("[AMQ-SQL-%s]消费消息失败:queue=%s", p.node.String(), sub.name)
+			interval = retryInterval
+		} else if ok {
+			continue
+		}
+		select {
+		case <-sub.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+/**
+ * 在一个事务中锁定并处理队列中最早的一条消息，返回是否处理了消息，消息处理失败时回滚事务并返回错误。
+ */
+func (p *sqlProvider) poll(sub *subscription) (bool, error) {
+	ctx := context.Background()
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := p.dialect.Rebind(fmt.Sprintf("SELECT id, payload FROM %s WHERE queue = ? AND deliver_at <= ? ORDER BY id LIMIT 1", p.table)) + p.dialect.LockClause
+	var (
+		id   int64
+		data string
+	)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if err = tx.QueryRowContext(ctx, query, sub.name, now).Scan(&id, &data); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	mpl, err := decode(data)
+	var rsp *message.MsgPayload
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-SQL-%s]消息解析失败:queue=%s,id=%d", p.node.String(), sub.name, id)
+	} else if rsp, err = amq.Dispatch(mpl, sub.listener); err != nil {
+		if !amq.Rejected(err) {
+			// 事务回滚后消息保留在队列头部，稍后重新处理
+			amq.Requeue(mpl, sub.listener)
+			return false, fmt.Errorf("[AMQ-SQL-%s]消息处理失败:msgId=%s,%v", p.node.String(), mpl.MsgId, err)
+		}
+		log.Error().Err(err).Msgf("[AMQ-SQL-%s]消息被拒绝，删除该消息:queue=%s,msgId=%s", p.node.String(), sub.name, mpl.MsgId)
+	}
+	if err = p.complete(ctx, tx, id, rsp); err != nil {
+		// 事务回滚后消息会被重新投递
+		if mpl != nil {
+			amq.Requeue(mpl, sub.listener)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+/**
+ * 在同一个事务中写入应答消息(如果有)并删除已处理的消息后提交。
+ */
+func (p *sqlProvider) complete(ctx context.Context, tx *sql.Tx, id int64, rsp *message.MsgPayload) error {
+	if rsp != nil {
+		if err := p.insert(ctx, tx, rsp); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, p.dialect.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", p.table)), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *sqlProvider) Cancel(name string) {
+	p.mu.Lock()
+	sub, ok := p.subs[name]
+	delete(p.subs, name)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(sub.stop)
+	<-sub.done
+}
+
+/**
+ * 数据库连接和事务的公共接口。
+ */
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+/**
+ * 将消息写入消息表。
+ */
+func (p *sqlProvider) insert(ctx context.Context, db execer, msg interface{}) error {
+	mpl, err := message.ToPayload(msg)
+	if err != nil {
+		return err
+	}
+	name, err := mpl.SendQueueName()
+	if err != nil {
+		return err
+	}
+	if len(name) == 0 {
+		return fmt.Errorf("[AMQ-SQL-%s]消息的目标队列为空:msgId=%s", p.node.String(), mpl.MsgId)
+	}
+	data, err := encode(p.codec, mpl)
+	if err != nil {
+		return err
+	}
+	query := p.dialect.Rebind(fmt.Sprintf("INSERT INTO %s (queue, msg_id, payload, created_at, deliver_at) VALUES (?, ?, ?, ?, ?)", p.table))
+	_, err = db.ExecContext(ctx, query, name, mpl.MsgId, data, time.Now().Unix(), mpl.DeliverAt)
+	return err
+}
+
+/**
+ * 消息表的payload字段为文本类型，JSON编码的消息原样保存，其他编码的二进制内容以Base64编码保存。
+ */
+func encode(codec message.Codec, mpl *message.MsgPayload) (string, error) {
+	data, err := message.Marshal(codec, mpl)
+	if err != nil {
+		return "", err
+	}
+	if codec == nil || codec == message.JSONCodec {
+		return string(data), nil
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func decode(data string) (*message.MsgPayload, error) {
+	if len(data) > 0 && data[0] == '{' {
+		return message.Unmarshal([]byte(data))
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	return message.Unmarshal(raw)
+}
+
+func (p *sqlProvider) SupportsDelay() bool {
+	return true
+}
+
+func (p *sqlProvider) Send(msg interface{}) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	return p.insert(context.Background(), db, msg)
+}
+
+/**
+ * 在业务系统提供的事务中发送消息，消息只有在事务提交后才对监听方可见，事务回滚则消息一并撤销。
+ * 注意该事务必须和当前提供器连接的是同一个数据库。
+ *
+ * @param tx
+ * @param msg
+ * @return
+ */
+func (p *sqlProvider) SendTx(tx *sql.Tx, msg interface{}) error {
+	if _, err := p.open(); err != nil {
+		return err
+	}
+	return p.insert(context.Background(), tx, msg)
+}
+
+func (p *sqlProvider) Close() {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.subs))
+	for name := range p.subs {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	for _, name := range names {
+		p.Cancel(name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db != nil {
+		p.db.Close()
+		p.db = nil
+	}
+}
@@ -0,0 +1,172 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/**
+ * 记录收到的消息，前fail次处理失败。
+ */
+type testListener struct {
+	mu       sync.Mutex
+	fail     int
+	received chan string
+}
+
+func (l *testListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	l.received <- msg.(*message.NoticeMessage).Body.Get("id")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fail > 0 {
+		l.fail--
+		return nil, errors.New("处理失败")
+	}
+	return nil, nil
+}
+
+func (l *testListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (l *testListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func newTestProvider(t *testing.T) (*sqlProvider, string) {
+	dsn := fmt.Sprintf("file:%s/amq.db?_busy_timeout=5000&_journal_mode=WAL", t.TempDir())
+	p := (&sqlProvider{}).New(node.BIZ, map[string]string{"driver": "sqlite3", "dsn": dsn, "pollInterval": "10"}).(*sqlProvider)
+	t.Cleanup(p.Close)
+	return p, dsn
+}
+
+func notice(msgId, queue string) *message.MsgPayload {
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("test")
+	nm.SetBody(message.NewMessageBody().Add("id", msgId))
+	nm.Destination = queue
+	return message.NoticePayload(nm)
+}
+
+func expectReceived(t *testing.T, l *testListener, want string) {
+	t.Helper()
+	select {
+	case msgId := <-l.received:
+		if msgId != want {
+			t.Fatalf("期望收到消息%s，实际为%s", want, msgId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待收到消息%s超时", want)
+	}
+}
+
+/**
+ * 等待队列中的消息被删除。
+ */
+func expectEmpty(t *testing.T, p *sqlProvider, queue string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		if err := p.db.QueryRow("SELECT COUNT(*) FROM amq_message WHERE queue = ?", queue).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("队列中仍有%d条消息", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeleteHandledMessage(t *testing.T) {
+	p, _ := newTestProvider(t)
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := p.Listen("q0", l); err != nil {
+		t.Fatal(err)
+	}
+	for _, msgId := range []string{"m0", "m1"} {
+		if err := p.Send(notice(msgId, "q0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectReceived(t, l, "m0")
+	expectReceived(t, l, "m1")
+	expectEmpty(t, p, "q0")
+}
+
+func TestRollbackFailedMessage(t *testing.T) {
+	p, _ := newTestProvider(t)
+	l := &testListener{fail: 1, received: make(chan string, 8)}
+	if _, err := p.Listen("q1", l); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(notice("m1", "q1")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m1")
+	expectReceived(t, l, "m1")
+	expectEmpty(t, p, "q1")
+}
+
+func TestDeleteRejectedMessage(t *testing.T) {
+	p, _ := newTestProvider(t)
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := p.Listen("q2", l); err != nil {
+		t.Fatal(err)
+	}
+	tampered := notice("m2", "q2")
+	tampered.Sign = "tampered"
+	if err := p.Send(tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(notice("m3", "q2")); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m3")
+	expectEmpty(t, p, "q2")
+}
+
+func TestSendTx(t *testing.T) {
+	p, dsn := newTestProvider(t)
+	l := &testListener{received: make(chan string, 8)}
+	if _, err := p.Listen("q3", l); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SendTx(tx, notice("m4", "q3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err = db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SendTx(tx, notice("m5", "q3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, l, "m5")
+	expectEmpty(t, p, "q3")
+}
@@ -0,0 +1,408 @@
+package amq
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 重放攻击防护配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "window" : 300,       // 消息发送时间与本地时间允许的最大偏差(秒，默认300)
+ *   "cacheSize" : 100000  // 内存中最多记录的消息数量(默认100000)，记录已满时暂时拒绝新的消息
+ * }
+ * </pre>
+ * 发送时间超出窗口的消息被拒绝(配置了隔离队列时转发到隔离队列)，窗口内同一个消息ID和阶段只会被处理一次；
+ * provider重新投递的消息(处理失败后调用了{@link Requeue}或者broker标记为重新投递)不检查发送时间，去重记录中已处理的消息不做重放检查。
+ */
+type ReplayConfig struct {
+	Window    int `json:"window"`
+	CacheSize int `json:"cacheSize"`
+}
+
+const (
+	defaultReplayWindow    = 300
+	defaultNonceCacheSize  = 100000
+	nonceCompactThreshold  = 1024
+	nonceRemovedExpireTime = "-"
+	// 等待重新投递的消息记录保留的最长时间，超过后按发送时间检查
+	requeuedRetention = 24 * time.Hour
+)
+
+/**
+ * 消息被重放时返回的错误。
+ */
+type ReplayError struct {
+	MsgId       string
+	Phase       string
+	Reason      string
+	OutOfWindow bool // 发送时间超出允许范围，而不是消息已处理
+}
+
+/**
+ * 内存中未过期的nonce达到上限时返回的错误。
+ */
+var errNonceCacheFull = errors.New("消息记录已满，暂时无法接收新的消息")
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("拒绝重放的AMQ消息:msgId=%s,phase=%s,%s", e.MsgId, e.Phase, e.Reason)
+}
+
+/**
+ * 已处理消息的记录(nonce)存储接口，可自行实现后通过{@link Client#SetNonceStore}替换默认的内存存储。
+ */
+type NonceStore interface {
+	/**
+	 * 记录nonce直到expireAt，如果该nonce已存在且未过期则返回false。
+	 */
+	Add(nonce string, expireAt time.Time) (bool, error)
+
+	/**
+	 * 删除nonce，使该消息可以被再次处理。
+	 */
+	Remove(nonce string) error
+
+	Close() error
+}
+
+/**
+ * 基于内存的nonce存储，最多保存capacity条记录，已过期的记录会被淘汰；未过期的记录达到capacity时拒绝记录新的nonce并返回错误，
+ * 而不是淘汰未过期的记录，以免重新放开重放窗口，对应的消息由provider稍后重新投递。
+ */
+type memoryNonceStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // 按记录顺序排列的nonce
+	nonces   map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce    string
+	expireAt int64
+}
+
+func NewMemoryNonceStore(capacity int) NonceStore {
+	return newMemoryNonceStore(capacity)
+}
+
+func newMemoryNonceStore(capacity int) *memoryNonceStore {
+	if capacity <= 0 {
+		capacity = defaultNonceCacheSize
+	}
+	return &memoryNonceStore{capacity: capacity, order: list.New(), nonces: make(map[string]*list.Element)}
+}
+
+func (s *memoryNonceStore) Add(nonce string, expireAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(nonce, expireAt.Unix(), time.Now().Unix())
+}
+
+/**
+ * 调用方需持有s.mu。
+ */
+func (s *memoryNonceStore) add(nonce string, expireAt, now int64) (bool, error) {
+	if e, ok := s.nonces[nonce]; ok {
+		if e.Value.(*nonceEntry).expireAt >= now {
+			return false, nil
+		}
+		s.order.Remove(e)
+		delete(s.nonces, nonce)
+	}
+	for s.order.Len() > 0 {
+		front := s.order.Front()
+		if entry := front.Value.(*nonceEntry); entry.expireAt < now {
+			s.order.Remove(front)
+			delete(s.nonces, entry.nonce)
+			continue
+		}
+		break
+	}
+	if s.order.Len() >= s.capacity {
+		// 过期时间并不严格按照记录顺序排列，已满时再完整清理一次
+		for e := s.order.Front(); e != nil; {
+			next := e.Next()
+			if entry := e.Value.(*nonceEntry); entry.expireAt < now {
+				s.order.Remove(e)
+				delete(s.nonces, entry.nonce)
+			}
+			e = next
+		}
+		if s.order.Len() >= s.capacity {
+			return false, errNonceCacheFull
+		}
+	}
+	s.nonces[nonce] = s.order.PushBack(&nonceEntry{nonce: nonce, expireAt: expireAt})
+	return true, nil
+}
+
+func (s *memoryNonceStore) Remove(nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(nonce)
+	return nil
+}
+
+func (s *memoryNonceStore) remove(nonce string) bool {
+	e, ok := s.nonces[nonce]
+	if ok {
+		s.order.Remove(e)
+		delete(s.nonces, nonce)
+	}
+	return ok
+}
+
+func (s *memoryNonceStore) Close() error {
+	return nil
+}
+
+/**
+ * 基于本地文件的nonce存储，每次变更追加写入文件，进程重启后重新加载未过期的记录，记录数增长到一定程度后自动压缩文件。
+ */
+type fileNonceStore struct {
+	*memoryNonceStore
+	path    string
+	file    *os.File
+	written int
+}
+
+/**
+ * 打开指定路径的nonce存储文件，文件不存在时自动创建。
+ *
+ * @param path
+ * @param capacity 最多保存的记录数量，小于等于0时使用默认值
+ * @return
+ */
+func NewFileNonceStore(path string, capacity int) (NonceStore, error) {
+	s := &fileNonceStore{memoryNonceStore: newMemoryNonceStore(capacity), path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/**
+ * 加载文件中的记录，每行的格式为：{过期时间(秒)}\t{nonce}，过期时间为"-"表示该nonce已被删除。
+ */
+func (s *fileNonceStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now().Unix()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == nonceRemovedExpireTime {
+			s.remove(parts[1])
+			continue
+		}
+		if expireAt, err := strconv.ParseInt(parts[0], 10, 64); err == nil && expireAt >= now {
+			s.remove(parts[1])
+			_, _ = s.add(parts[1], expireAt, now)
+		}
+	}
+	return scanner.Err()
+}
+
+/**
+ * 将当前所有记录写入临时文件后原子替换，调用方需持有s.mu。
+ */
+func (s *fileNonceStore) compact() error {
+	var b strings.Builder
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*nonceEntry)
+		fmt.Fprintf(&b, "%d\t%s\n", entry.expireAt, entry.nonce)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.file, s.written = f, s.order.Len()
+	return nil
+}
+
+/**
+ * 追加一条记录，调用方需持有s.mu。
+ */
+func (s *fileNonceStore) append(line string) error {
+	if _, err := s.file.WriteString(line); err != nil {
+		return err
+	}
+	s.written++
+	if s.written > 2*s.order.Len()+nonceCompactThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *fileNonceStore) Add(nonce string, expireAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok, err := s.add(nonce, expireAt.Unix(), time.Now().Unix()); !ok {
+		return false, err
+	}
+	return true, s.append(fmt.Sprintf("%d\t%s\n", expireAt.Unix(), nonce))
+}
+
+func (s *fileNonceStore) Remove(nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.remove(nonce) {
+		return nil
+	}
+	return s.append(nonceRemovedExpireTime + "\t" + nonce + "\n")
+}
+
+func (s *fileNonceStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+/**
+ * 根据消息的发送时间和已处理消息的记录拒绝重放的消息。
+ */
+type replayGuard struct {
+	client   *Client
+	window   time.Duration
+	store    NonceStore
+	capacity int
+	mu       sync.Mutex
+	requeued map[string]time.Time // 等待provider重新投递的消息及其记录时间
+}
+
+func nonceOf(mpl *message.MsgPayload) string {
+	return mpl.MsgId + "@" + string(mpl.Phase)
+}
+
+/**
+ * 检查消息是否为重放的消息，首次收到的消息会被记录下来，需要在签名校验通过之后调用，避免发送时间被篡改。
+ */
+func (g *replayGuard) check(mpl *message.MsgPayload) error {
+	if g == nil {
+		return nil
+	}
+	now := time.Now()
+	sent := time.Unix(mpl.SendTime, 0)
+	// 延迟投递的消息从投递时间开始计算
+	if deliverAt := time.Unix(0, mpl.DeliverAt*int64(time.Millisecond)); deliverAt.After(sent) {
+		sent = deliverAt
+	}
+	nonce := nonceOf(mpl)
+	expireAt := sent.Add(g.window)
+	// 重新投递的消息可能因为反复处理失败或消费者长时间断开而超出窗口，不按发送时间拒绝，记录保留到当前时间之后的一个窗口
+	if g.redelivered(nonce) || mpl.Redelivered {
+		if latest := now.Add(g.window); latest.After(expireAt) {
+			expireAt = latest
+		}
+	} else if sent.Before(now.Add(-g.window)) || sent.After(now.Add(g.window)) {
+		return &ReplayError{MsgId: mpl.MsgId, Phase: mpl.Phase.String(), Reason: "发送时间超出允许范围:sendTime=" + strconv.FormatInt(mpl.SendTime, 10), OutOfWindow: true}
+	}
+	ok, err := g.store.Add(nonce, expireAt)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &ReplayError{MsgId: mpl.MsgId, Phase: mpl.Phase.String(), Reason: "消息已处理"}
+	}
+	return nil
+}
+
+/**
+ * 消息处理失败时删除记录，使消息重新投递后可以被再次处理。
+ */
+func (g *replayGuard) forget(mpl *message.MsgPayload) {
+	if g == nil {
+		return
+	}
+	if err := g.store.Remove(nonceOf(mpl)); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]删除消息记录失败:msgId=%s", g.client.node.String(), mpl.MsgId)
+	}
+}
+
+/**
+ * provider将重新投递消息时删除记录，并记住该消息，重新投递时不再按发送时间拒绝。
+ * 等待重新投递的消息达到nonce存储的容量时先清理超过{@link requeuedRetention}的记录，仍然已满时不再记录，该消息重新投递时按发送时间检查。
+ */
+func (g *replayGuard) requeue(mpl *message.MsgPayload) {
+	if g == nil {
+		return
+	}
+	g.forget(mpl)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.requeued == nil {
+		g.requeued = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if len(g.requeued) >= g.capacity {
+		for nonce, at := range g.requeued {
+			if now.Sub(at) > requeuedRetention {
+				delete(g.requeued, nonce)
+			}
+		}
+		if len(g.requeued) >= g.capacity {
+			log.Warn().Msgf("[AMQ-Client-%s]等待重新投递的消息过多，重新投递时按发送时间检查:msgId=%s", g.client.node.String(), mpl.MsgId)
+			return
+		}
+	}
+	g.requeued[nonceOf(mpl)] = now
+}
+
+/**
+ * 判断消息是否为调用了{@link #requeue}后重新投递的消息，同时删除该记录。
+ */
+func (g *replayGuard) redelivered(nonce string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.requeued[nonce]
+	delete(g.requeued, nonce)
+	return ok
+}
+
+func (g *replayGuard) close() {
+	if err := g.store.Close(); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭消息记录存储失败", g.client.node.String())
+	}
+}
@@ -0,0 +1,99 @@
+package amq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+)
+
+/**
+ * 记录转发到队列中的原始消息ID。
+ */
+type captureListener struct {
+	received chan string
+}
+
+func (l *captureListener) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	l.received <- message.GetMsgId(msg)
+	return nil, nil
+}
+
+func (l *captureListener) OnRecipientAckReceived(genre, msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (l *captureListener) OnSenderAckReceived(genre, msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func TestRedeliveredSimplexGetsAck(t *testing.T) {
+	sender := newTestClient(t, "1093", `{"provider":"memory"}`)
+	receiver := newTestClient(t, "1094", `{"provider":"memory","replay":{"window":300},"dedup":{"cacheSize":100}}`)
+	sp, rp := newTestProcessor("replay", 0), newTestProcessor("replay", 0)
+	startClient(t, sender, sp)
+	startClient(t, receiver, rp)
+
+	msgId := sender.NewMsgId()
+	sm := message.NewSimplexMessage(msgId)
+	sm.SetType("replay")
+	sm.SetBody(message.NewMessageBody())
+	sm.Source = sender.BuildQueueName("1093")
+	sm.Destination = receiver.BuildQueueName("1094")
+	mpl := message.SimplexPayload(sm)
+	// broker在确认前重新投递同一条消息，接收方只处理一次，但每次都应答
+	raw := newRawProvider(t)
+	for i := 0; i < 2; i++ {
+		if err := raw.Send(mpl); err != nil {
+			t.Fatal(err)
+		}
+		expectValue(t, sp.acks, "ok:"+msgId)
+	}
+	expectValue(t, rp.received, msgId)
+	expectNone(t, rp.received, 200*time.Millisecond)
+}
+
+func TestRequeuedMessageOutsideWindow(t *testing.T) {
+	receiver := newTestClient(t, "1095", `{"provider":"memory","replay":{"window":1}}`)
+	rp := newTestProcessor("replay", 1)
+	startClient(t, receiver, rp)
+
+	msgId := receiver.NewMsgId()
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("replay")
+	nm.SetBody(message.NewMessageBody())
+	nm.Destination = receiver.BuildQueueName("1095")
+	if err := newRawProvider(t).Send(message.NoticePayload(nm)); err != nil {
+		t.Fatal(err)
+	}
+	// 处理失败后重新投递时已超出1秒的窗口，仍然应该再次处理
+	expectValue(t, rp.received, msgId)
+	expectValue(t, rp.received, msgId)
+}
+
+func TestStaleMessageQuarantined(t *testing.T) {
+	quarantine := "sys_amq_1096_biz_quarantine"
+	receiver := newTestClient(t, "1096", `{"provider":"memory","replay":{"window":300},"quarantineQueue":"`+quarantine+`"}`)
+	rp := newTestProcessor("replay", 0)
+	startClient(t, receiver, rp)
+	raw := newRawProvider(t)
+	captured := &captureListener{received: make(chan string, 1)}
+	if _, err := raw.Listen(quarantine, captured); err != nil {
+		t.Fatal(err)
+	}
+
+	msgId := receiver.NewMsgId()
+	nm := message.NewNoticeMessage(msgId)
+	nm.SetType("replay")
+	nm.SetBody(message.NewMessageBody())
+	nm.Destination = receiver.BuildQueueName("1096")
+	mpl := message.NoticePayload(nm)
+	mpl.SendTime = time.Now().Add(-time.Hour).Unix()
+	mpl.Sign = message.Signature(mpl)
+	if err := raw.Send(mpl); err != nil {
+		t.Fatal(err)
+	}
+	// 超出窗口的消息不交给处理器，转发到隔离队列而不是直接丢弃
+	expectValue(t, captured.received, msgId)
+	expectNone(t, rp.received, 200*time.Millisecond)
+}
@@ -0,0 +1,72 @@
+package amq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 以同步请求/应答的方式发送单向事务消息，发送后阻塞直到收到接收方的应答消息或者ctx超时/取消，返回接收方的应答消息体。
+ * 应答消息按照消息ID进行关联，如果当前客户端定义了该消息类型的处理器，则收到应答时仍然会回调{@link Processor#OnRecipientAckReceived}。
+ * 请求在接收方处理之前已过期时返回{@link ExpiredError}。
+ * 该方法要求客户端已经启动监听，并且消息的Source为当前客户端监听的队列，单分区节点未设置Source时默认使用当前系统的队列。
+ *
+ * @param ctx
+ * @param message
+ * @return
+ * @throws AMQException
+ */
+func (c *Client) Request(ctx context.Context, msg *message.SimplexMessage) (*message.MsgBody, error) {
+	if !c.started {
+		return nil, fmt.Errorf("[AMQ-Client-%s]客户端未启动，无法接收应答消息", c.node.String())
+	}
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+	if len(msg.Source) == 0 {
+		if c.IsMultiplePartition() {
+			return nil, fmt.Errorf("[AMQ-Client-%s]多分区节点请指定应答队列", c.node.String())
+		}
+		msg.Source = c.BuildQueueName(c.systemId)
+	}
+	msgId := message.GetMsgId(msg)
+	reply := make(chan *message.MsgBody, 1)
+	c.repliesMu.Lock()
+	if _, ok := c.replies[msgId]; ok {
+		c.repliesMu.Unlock()
+		return nil, fmt.Errorf("[AMQ-Client-%s]重复的请求消息ID:%s", c.node.String(), msgId)
+	}
+	c.replies[msgId] = reply
+	c.repliesMu.Unlock()
+	defer c.takeReply(msgId)
+
+	if err := c.Send(msg); err != nil {
+		return nil, err
+	}
+	select {
+	case rsp, ok := <-reply:
+		if !ok {
+			return nil, &ExpiredError{MsgId: msgId}
+		}
+		return rsp, nil
+	case <-ctx.Done():
+		log.Warn().Msgf("[AMQ-Client-%s]等待应答消息超时:msgId=%s", c.node.String(), msgId)
+		return nil, ctx.Err()
+	}
+}
+
+/**
+ * 取出等待指定消息应答的同步请求，不存在则返回nil。
+ */
+func (c *Client) takeReply(msgId string) chan *message.MsgBody {
+	c.repliesMu.Lock()
+	defer c.repliesMu.Unlock()
+	reply, ok := c.replies[msgId]
+	if ok {
+		delete(c.replies, msgId)
+	}
+	return reply
+}
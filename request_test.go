@@ -0,0 +1,57 @@
+package amq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+)
+
+func TestRequestReturnsReply(t *testing.T) {
+	requester := newTestClient(t, "1113", `{"provider":"memory"}`)
+	responder := newTestClient(t, "1114", `{"provider":"memory"}`)
+	sp := newTestProcessor("request", 0)
+	startClient(t, requester, sp)
+	startClient(t, responder, newTestProcessor("request", 0))
+
+	msgId := requester.NewMsgId()
+	sm := message.NewSimplexMessage(msgId)
+	sm.SetType("request")
+	sm.SetBody(message.NewMessageBody())
+	sm.Destination = responder.BuildQueueName("1114")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rsp, err := requester.Request(ctx, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Get("result") != "ok:"+msgId {
+		t.Fatalf("应答消息体错误:%s", rsp.ToString())
+	}
+	// 定义了该消息类型的处理器时仍然回调应答
+	expectValue(t, sp.acks, "ok:"+msgId)
+	// 请求完成后不再占用消息ID，可以使用同一条消息再次请求
+	if _, err = requester.Request(ctx, sm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	requester := newTestClient(t, "1115", `{"provider":"memory"}`)
+	sm := message.NewSimplexMessage(requester.NewMsgId())
+	sm.SetType("request")
+	sm.SetBody(message.NewMessageBody())
+	sm.Destination = requester.BuildQueueName("1116")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := requester.Request(ctx, sm); err == nil {
+		t.Fatal("客户端未启动时应返回错误")
+	}
+	startClient(t, requester)
+	// 没有接收方监听时等待到ctx超时
+	if _, err := requester.Request(ctx, sm); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("期望返回超时错误，实际为%v", err)
+	}
+}
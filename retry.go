@@ -0,0 +1,202 @@
+package amq
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 重试策略，用于发送消息失败以及处理器处理消息失败时的重试，格式如下：
+ * <pre>
+ * {
+ *   "maxAttempts" : 3,  // 最多尝试的次数，包含第一次(默认3)
+ *   "baseDelay" : 100,  // 首次重试的间隔(毫秒，默认100)，之后每次翻倍
+ *   "maxDelay" : 10000, // 重试间隔的上限(毫秒，默认10000)
+ *   "jitter" : 0.2      // 重试间隔的随机抖动比例，0到1之间(默认0.2)
+ * }
+ * </pre>
+ * 是否可以重试由Retryable决定，只能通过{@link Client#SetRetryPolicy}设置，未设置时除了没有对应处理器的错误以外都会重试。
+ */
+type RetryPolicy struct {
+	MaxAttempts int                  `json:"maxAttempts"`
+	BaseDelay   int                  `json:"baseDelay"`
+	MaxDelay    int                  `json:"maxDelay"`
+	Jitter      float64              `json:"jitter"`
+	Retryable   func(err error) bool `json:"-"`
+}
+
+/**
+ * 重试配置，和节点的其他配置一起保存在/system/base/amq/{node}中，节点默认的策略之外还可以按照消息类型单独配置，格式如下：
+ * <pre>
+ * {
+ *   "maxAttempts" : 3,
+ *   "baseDelay" : 100,
+ *   "genres" : {                        // 按消息类型覆盖节点默认的策略(可选)
+ *     "order" : {"maxAttempts" : 5, "baseDelay" : 1000}
+ *   }
+ * }
+ * </pre>
+ * 按消息类型的策略只需配置与节点默认策略不同的字段，未配置的字段(包括Retryable)继承节点默认的策略；
+ * 节点未配置任何字段时没有默认策略，只有genres中的消息类型会重试。
+ */
+type RetryConfig struct {
+	RetryPolicy
+	Genres map[string]*RetryPolicy `json:"genres"`
+}
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = 100
+	defaultRetryMaxDelay    = 10000
+	defaultRetryJitter      = 0.2
+)
+
+/**
+ * 返回填充了默认值的策略副本。
+ */
+func (p RetryPolicy) normalize() *RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = defaultRetryJitter
+	}
+	return &p
+}
+
+/**
+ * 判断出错后是否可以重试。
+ */
+func (p *RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, errNoProcessor) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+/**
+ * 第n次尝试失败后到下一次重试的间隔，在指数退避的基础上增加随机抖动。
+ */
+func (p *RetryPolicy) delay(n int) time.Duration {
+	delay := float64(p.BaseDelay)
+	for i := 1; i < n && delay < float64(p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+/**
+ * 以base为基础，返回用当前策略中已设置的字段覆盖后的策略副本。
+ */
+func (p RetryPolicy) inherit(base *RetryPolicy) RetryPolicy {
+	if base == nil {
+		return p
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = base.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = base.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = base.MaxDelay
+	}
+	if p.Jitter <= 0 {
+		p.Jitter = base.Jitter
+	}
+	if p.Retryable == nil {
+		p.Retryable = base.Retryable
+	}
+	return p
+}
+
+/**
+ * 根据重试配置创建各消息类型未填充默认值的重试策略，key为空字符串的策略为节点默认的策略，节点未配置任何字段时不创建。
+ */
+func newRetryPolicies(cfg *RetryConfig) map[string]*RetryPolicy {
+	policies := make(map[string]*RetryPolicy)
+	if cfg == nil {
+		return policies
+	}
+	if p := cfg.RetryPolicy; p.MaxAttempts > 0 || p.BaseDelay > 0 || p.MaxDelay > 0 || p.Jitter > 0 {
+		policies[""] = &p
+	}
+	for genre, p := range cfg.Genres {
+		if p != nil {
+			cp := *p
+			policies[genre] = &cp
+		}
+	}
+	return policies
+}
+
+/**
+ * 设置重试策略，需要确保该方法在{@link #start()}方法之前调用，可用于设置无法通过配置指定的Retryable，
+ * 消息类型的策略中未设置的字段继承节点默认的策略。
+ *
+ * @param genre  消息类型，为空时设置节点默认的策略
+ * @param policy 为nil时删除该策略
+ */
+func (c *Client) SetRetryPolicy(genre string, policy *RetryPolicy) {
+	if c.started {
+		fmt.Printf("[AMQ-Client-%s]该客户端已启动，无法设置重试策略\n", c.node.String())
+	} else if policy == nil {
+		delete(c.retryPolicies, genre)
+	} else {
+		p := *policy
+		c.retryPolicies[genre] = &p
+	}
+}
+
+/**
+ * 获取指定消息类型填充了默认值的重试策略，消息类型的策略继承节点默认的策略，都没有配置时返回nil。
+ */
+func (c *Client) retryPolicy(genre string) *RetryPolicy {
+	base := c.retryPolicies[""]
+	if p, ok := c.retryPolicies[genre]; ok && len(genre) > 0 {
+		return p.inherit(base).normalize()
+	}
+	if base == nil {
+		return nil
+	}
+	return base.normalize()
+}
+
+/**
+ * 按照消息类型的重试策略发送消息，没有配置重试策略时只发送一次。
+ */
+func (c *Client) sendWithRetry(mpl *message.MsgPayload) error {
+	policy := c.retryPolicy(mpl.Genre)
+	for n := 1; ; n++ {
+		err := c.provider.Send(mpl)
+		if err == nil || policy == nil || n >= policy.MaxAttempts || !policy.retryable(err) {
+			return err
+		}
+		delay := policy.delay(n)
+		log.Warn().Err(err).Msgf("[AMQ-Client-%s]消息发送失败，%v后重试:msgId=%s,attempts=%d", c.node.String(), delay, mpl.MsgId, n)
+		if !c.wait(delay) {
+			return err
+		}
+	}
+}
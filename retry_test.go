@@ -0,0 +1,91 @@
+package amq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+)
+
+func TestRetryDelayBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100, MaxDelay: 1000, Jitter: 0.2}.normalize()
+	for n, want := range map[int]time.Duration{1: 100, 2: 200, 3: 400, 4: 800, 5: 1000, 30: 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := p.delay(n); d < want*8/10 || d > want*12/10 {
+				t.Fatalf("第%d次失败后的重试间隔为%v，期望为%v±20%%", n, d, want)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyInherit(t *testing.T) {
+	c := &Client{retryPolicies: newRetryPolicies(&RetryConfig{
+		RetryPolicy: RetryPolicy{MaxAttempts: 5, BaseDelay: 50},
+		Genres:      map[string]*RetryPolicy{"order": {BaseDelay: 1000}},
+	})}
+	retryable := func(err error) bool { return false }
+	c.SetRetryPolicy("", &RetryPolicy{MaxAttempts: 5, BaseDelay: 50, Retryable: retryable})
+	p := c.retryPolicy("order")
+	if p.MaxAttempts != 5 || p.BaseDelay != 1000 || p.MaxDelay != defaultRetryMaxDelay || p.Retryable == nil {
+		t.Fatalf("消息类型的策略未继承节点默认的策略:%+v", p)
+	}
+	if p = c.retryPolicy("other"); p.BaseDelay != 50 {
+		t.Fatalf("未配置的消息类型应使用节点默认的策略:%+v", p)
+	}
+	if p = (&Client{retryPolicies: newRetryPolicies(&RetryConfig{Genres: map[string]*RetryPolicy{"order": {}}})}).retryPolicy("other"); p != nil {
+		t.Fatalf("节点没有默认策略时其他消息类型不应重试:%+v", p)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	temporary := errors.New("temporary")
+	p := RetryPolicy{Retryable: func(err error) bool { return errors.Is(err, temporary) }}.normalize()
+	if !p.retryable(temporary) || p.retryable(errors.New("permanent")) {
+		t.Fatal("应按照Retryable判断是否重试")
+	}
+	if (RetryPolicy{}).normalize().retryable(errNoProcessor) {
+		t.Fatal("没有对应处理器的错误不应重试")
+	}
+}
+
+/**
+ * 前failures次发送失败的provider。
+ */
+type flakyProvider struct {
+	recordingProvider
+	failures int
+	attempts int
+}
+
+func (p *flakyProvider) Send(msg interface{}) error {
+	p.attempts++
+	if p.attempts <= p.failures {
+		return errors.New("发送失败")
+	}
+	return p.recordingProvider.Send(msg)
+}
+
+func TestSendWithRetry(t *testing.T) {
+	newClient := func(p *flakyProvider, retryable func(error) bool) *Client {
+		c := &Client{node: node.BIZ, provider: p, abandoned: make(chan struct{}), retryPolicies: make(map[string]*RetryPolicy)}
+		c.SetRetryPolicy("", &RetryPolicy{MaxAttempts: 3, BaseDelay: 1, Retryable: retryable})
+		return c
+	}
+	mpl := &message.MsgPayload{MsgId: "10012024010112000000000001"}
+
+	p := &flakyProvider{failures: 2}
+	if err := newClient(p, nil).sendWithRetry(mpl); err != nil || p.attempts != 3 {
+		t.Fatalf("第3次应发送成功:attempts=%d,%v", p.attempts, err)
+	}
+	p = &flakyProvider{failures: 3}
+	if err := newClient(p, nil).sendWithRetry(mpl); err == nil || p.attempts != 3 {
+		t.Fatalf("超过最大次数后应返回错误:attempts=%d,%v", p.attempts, err)
+	}
+	p = &flakyProvider{failures: 1}
+	if err := newClient(p, func(error) bool { return false }).sendWithRetry(mpl); err == nil || p.attempts != 1 {
+		t.Fatalf("不可重试的错误不应重试:attempts=%d,%v", p.attempts, err)
+	}
+}
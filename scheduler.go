@@ -0,0 +1,501 @@
+package amq
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq/internal/sqldialect"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/provider"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 延迟投递调度器配置，和节点的其他配置一起保存在/system/base/amq/{node}中，格式如下：
+ * <pre>
+ * {
+ *   "interval" : 500,                      // 检查到期消息的间隔(毫秒，默认500)
+ *   "path" : "/data/amq/biz/schedule.log"  // 保存待投递消息的本地文件
+ * }
+ * </pre>
+ * 仅在当前节点的provider不支持延迟投递(未实现{@link provider.DelaySender})时使用，也可以通过{@link Client#SetScheduleStore}指定存储，
+ * 两者都未配置时不启动调度器，发送延迟投递的消息会返回错误，避免消息随进程退出而丢失。
+ */
+type ScheduleConfig struct {
+	Interval int    `json:"interval"`
+	Path     string `json:"path"`
+}
+
+const (
+	defaultScheduleInterval  = 500
+	defaultScheduleBatchSize = 100
+	defaultScheduleTable     = "amq_schedule"
+	scheduleCompactThreshold = 1024
+)
+
+/**
+ * 待投递消息的存储接口，内置了内存、本地文件和数据库三种实现，也可自行实现后通过{@link Client#SetScheduleStore}设置。
+ */
+type ScheduleStore interface {
+	/**
+	 * 保存待投递的消息。
+	 */
+	Add(mpl *message.MsgPayload) error
+
+	/**
+	 * 按照投递时间的先后顺序获取最多limit条投递时间不晚于now(毫秒)的消息，消息在调用{@link #Remove}之前会被重复返回。
+	 */
+	Due(now int64, limit int) ([]*message.MsgPayload, error)
+
+	/**
+	 * 删除已投递的消息。
+	 */
+	Remove(mpl *message.MsgPayload) error
+
+	Close() error
+}
+
+/**
+ * 基于内存的待投递消息存储，消息按照投递时间排序，进程退出后未投递的消息全部丢失。
+ */
+type memoryScheduleStore struct {
+	mu       sync.Mutex
+	payloads []*message.MsgPayload // 按照投递时间排序
+}
+
+func NewMemoryScheduleStore() ScheduleStore {
+	return &memoryScheduleStore{}
+}
+
+func (s *memoryScheduleStore) Add(mpl *message.MsgPayload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(mpl)
+	return nil
+}
+
+/**
+ * 调用方需持有s.mu。
+ */
+func (s *memoryScheduleStore) add(mpl *message.MsgPayload) {
+	s.remove(nonceOf(mpl))
+	i := sort.Search(len(s.payloads), func(i int) bool { return s.payloads[i].DeliverAt > mpl.DeliverAt })
+	s.payloads = append(s.payloads, nil)
+	copy(s.payloads[i+1:], s.payloads[i:])
+	s.payloads[i] = mpl
+}
+
+/**
+ * 调用方需持有s.mu。
+ */
+func (s *memoryScheduleStore) remove(id string) bool {
+	for i, mpl := range s.payloads {
+		if nonceOf(mpl) == id {
+			s.payloads = append(s.payloads[:i], s.payloads[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryScheduleStore) Due(now int64, limit int) ([]*message.MsgPayload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := make([]*message.MsgPayload, 0)
+	for _, mpl := range s.payloads {
+		if mpl.DeliverAt > now || len(due) >= limit {
+			break
+		}
+		due = append(due, mpl)
+	}
+	return due, nil
+}
+
+func (s *memoryScheduleStore) Remove(mpl *message.MsgPayload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(nonceOf(mpl))
+	return nil
+}
+
+func (s *memoryScheduleStore) Close() error {
+	return nil
+}
+
+/**
+ * 待投递消息存储文件中的一条变更，Payload为空表示删除。
+ */
+type scheduleRecord struct {
+	Id      string              `json:"id"`
+	Payload *message.MsgPayload `json:"payload,omitempty"`
+}
+
+/**
+ * 基于本地文件的待投递消息存储，每次变更以一行JSON追加写入文件，进程重启后重新加载未投递的消息，变更增长到一定程度后自动压缩文件。
+ */
+type fileScheduleStore struct {
+	*memoryScheduleStore
+	path    string
+	file    *os.File
+	written int
+}
+
+/**
+ * 打开指定路径的待投递消息存储文件，文件不存在时自动创建。
+ *
+ * @param path
+ * @return
+ */
+func NewFileScheduleStore(path string) (ScheduleStore, error) {
+	s := &fileScheduleStore{memoryScheduleStore: &memoryScheduleStore{}, path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileScheduleStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		record := new(scheduleRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// 忽略进程异常退出时未写完整的记录
+			continue
+		}
+		if record.Payload == nil {
+			s.remove(record.Id)
+		} else {
+			s.add(record.Payload)
+		}
+	}
+	return scanner.Err()
+}
+
+/**
+ * 将当前所有待投递的消息写入临时文件后原子替换，调用方需持有s.mu。
+ */
+func (s *fileScheduleStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, mpl := range s.payloads {
+		data, err := json.Marshal(&scheduleRecord{Id: nonceOf(mpl), Payload: mpl})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	s.written = len(s.payloads)
+	return nil
+}
+
+/**
+ * 追加一条变更，调用方需持有s.mu。
+ */
+func (s *fileScheduleStore) append(record *scheduleRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.written++
+	if s.written > 2*len(s.payloads)+scheduleCompactThreshold {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *fileScheduleStore) Add(mpl *message.MsgPayload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(mpl)
+	return s.append(&scheduleRecord{Id: nonceOf(mpl), Payload: mpl})
+}
+
+func (s *fileScheduleStore) Remove(mpl *message.MsgPayload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := nonceOf(mpl)
+	if !s.remove(id) {
+		return nil
+	}
+	return s.append(&scheduleRecord{Id: id})
+}
+
+func (s *fileScheduleStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+/**
+ * 基于关系型数据库的待投递消息存储，多个实例共享同一个存储时到期的消息可能被重复发送，接收方可开启消息去重。
+ */
+type sqlScheduleStore struct {
+	db      *sql.DB
+	dialect *sqldialect.Dialect
+	table   string
+}
+
+/**
+ * 使用给定的数据库连接创建待投递消息存储，存储表不存在时自动创建。
+ *
+ * @param db
+ * @param dialect SQL方言，postgres、mysql或sqlite
+ * @param table   存储表名，为空时使用amq_schedule
+ * @return
+ */
+func NewSQLScheduleStore(db *sql.DB, dialect, table string) (ScheduleStore, error) {
+	if len(table) == 0 {
+		table = defaultScheduleTable
+	}
+	if !sqlTablePattern.MatchString(table) {
+		return nil, fmt.Errorf("无效的延迟消息表名:%s", table)
+	}
+	d, err := sqldialect.Get(dialect, "")
+	if err != nil {
+		return nil, err
+	}
+	schema := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(128) NOT NULL PRIMARY KEY, deliver_at BIGINT NOT NULL, payload %s NOT NULL)%s",
+		table, d.Text, d.TableOptions)
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("创建延迟消息表失败:%v", err)
+	}
+	return &sqlScheduleStore{db: db, dialect: d, table: table}, nil
+}
+
+func (s *sqlScheduleStore) Add(mpl *message.MsgPayload) error {
+	data, err := message.Marshal(message.JSONCodec, mpl)
+	if err != nil {
+		return err
+	}
+	query := s.dialect.Rebind(fmt.Sprintf("INSERT INTO %s (id, deliver_at, payload) VALUES (?, ?, ?)", s.table))
+	_, err = s.db.Exec(query, nonceOf(mpl), mpl.DeliverAt, string(data))
+	return err
+}
+
+func (s *sqlScheduleStore) Due(now int64, limit int) ([]*message.MsgPayload, error) {
+	query := s.dialect.Rebind(fmt.Sprintf("SELECT payload FROM %s WHERE deliver_at <= ? ORDER BY deliver_at LIMIT ?", s.table))
+	rows, err := s.db.Query(query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	due := make([]*message.MsgPayload, 0)
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		mpl, err := message.Unmarshal([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, mpl)
+	}
+	return due, rows.Err()
+}
+
+func (s *sqlScheduleStore) Remove(mpl *message.MsgPayload) error {
+	_, err := s.db.Exec(s.dialect.Rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table)), nonceOf(mpl))
+	return err
+}
+
+func (s *sqlScheduleStore) Close() error {
+	return nil
+}
+
+/**
+ * 延迟投递调度器，provider不支持延迟投递时，延迟的消息先保存在调度器中，投递时间到达后再发送。
+ * 消息在发送时已经完成签名，签名中包含投递时间，接收方的重放检查从投递时间开始计算。
+ */
+type scheduler struct {
+	client   *Client
+	store    ScheduleStore
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newScheduler(c *Client, store ScheduleStore, cfg *ScheduleConfig) *scheduler {
+	s := &scheduler{client: c, store: store, interval: defaultScheduleInterval * time.Millisecond}
+	if cfg != nil && cfg.Interval > 0 {
+		s.interval = time.Duration(cfg.Interval) * time.Millisecond
+	}
+	return s
+}
+
+/**
+ * 保存延迟投递的消息。
+ */
+func (s *scheduler) add(mpl *message.MsgPayload) error {
+	if err := s.store.Add(mpl); err != nil {
+		return err
+	}
+	log.Debug().Msgf("[AMQ-Client-%s]消息将延迟投递:msgId=%s,deliverAt=%d", s.client.node.String(), mpl.MsgId, mpl.DeliverAt)
+	return nil
+}
+
+/**
+ * 投递时间未到并且provider不支持延迟投递的消息交由调度器保存，返回消息是否已被调度器接管。
+ */
+func (c *Client) schedule(mpl *message.MsgPayload) (bool, error) {
+	if mpl.DeliverAt <= nowMillis() {
+		return false, nil
+	}
+	if ds, ok := c.provider.(provider.DelaySender); ok && ds.SupportsDelay() {
+		return false, nil
+	}
+	if c.scheduler == nil {
+		if c.started {
+			return true, fmt.Errorf("[AMQ-Client-%s]未配置延迟消息存储，无法发送延迟投递的消息", c.node.String())
+		}
+		return true, fmt.Errorf("[AMQ-Client-%s]客户端未启动，无法发送延迟投递的消息", c.node.String())
+	}
+	return true, c.scheduler.add(mpl)
+}
+
+/**
+ * 启动后台任务，定期发送到期的消息。
+ */
+func (s *scheduler) start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.release(s.stop)
+			}
+		}
+	}()
+}
+
+/**
+ * 发送所有到期的消息，按照重试策略重试后仍然发送失败的消息在下一次检查时重新发送，stop关闭后不再发送下一批。
+ */
+func (s *scheduler) release(stop <-chan struct{}) {
+	c := s.client
+	for {
+		due, err := s.store.Due(nowMillis(), defaultScheduleBatchSize)
+		if err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]查询到期的延迟消息失败", c.node.String())
+			return
+		}
+		for _, mpl := range due {
+			if err = c.tracker.begin(mpl); err != nil {
+				log.Error().Err(err).Msgf("[AMQ-Client-%s]保存事务记录失败:msgId=%s", c.node.String(), mpl.MsgId)
+			}
+			if err = c.sendWithRetry(mpl); err != nil {
+				c.tracker.cancel(mpl.MsgId)
+				log.Error().Err(err).Msgf("[AMQ-Client-%s]延迟消息发送失败，稍后重试:msgId=%s", c.node.String(), mpl.MsgId)
+				return
+			}
+			if err = s.store.Remove(mpl); err != nil {
+				log.Error().Err(err).Msgf("[AMQ-Client-%s]删除已发送的延迟消息失败:msgId=%s", c.node.String(), mpl.MsgId)
+				return
+			}
+		}
+		if len(due) < defaultScheduleBatchSize {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+/**
+ * 停止后台任务。
+ */
+func (s *scheduler) halt() {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+}
+
+/**
+ * 停止后台任务并在ctx结束之前发送所有到期的消息，返回内存存储中尚未到期、将随进程退出而丢失的消息数量。
+ */
+func (s *scheduler) flush(ctx context.Context) int {
+	s.halt()
+	s.release(ctx.Done())
+	ms, ok := s.store.(*memoryScheduleStore)
+	if !ok {
+		return 0
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if n := len(ms.payloads); n > 0 {
+		log.Warn().Msgf("[AMQ-Client-%s]延迟消息尚未到期，关闭后将丢失:count=%d", s.client.node.String(), n)
+		return n
+	}
+	return 0
+}
+
+func (s *scheduler) close() {
+	s.halt()
+	if err := s.store.Close(); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭延迟消息存储失败", s.client.node.String())
+	}
+}
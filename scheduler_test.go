@@ -0,0 +1,78 @@
+package amq
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+)
+
+func TestSchedulerRestart(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "schedule.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	stores := map[string]func() ScheduleStore{
+		"file": func() ScheduleStore {
+			s, err := NewFileScheduleStore(filepath.Join(dir, "schedule.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"sql": func() ScheduleStore {
+			s, err := NewSQLScheduleStore(db, "sqlite", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	for name, open := range stores {
+		// 重启前保存两条在重启期间到期的消息(投递时间晚的先保存)和一条尚未到期的消息
+		now := nowMillis()
+		store := open()
+		for msgId, deliverAt := range map[string]int64{
+			"10012024010112000000000001": now - 2000,
+			"10012024010112000000000002": now - 1000,
+			"10012024010112000000000003": now + 60000,
+		} {
+			mpl := &message.MsgPayload{Category: message.NOTICE, MsgId: msgId, Phase: message.SenderReq, DstNewQueue: "sys_amq_1001_biz", DeliverAt: deliverAt}
+			if err = store.Add(mpl); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = store.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// 重启后重新加载，按照投递时间的先后顺序发送到期的消息，发送后从存储中删除
+		p := &recordingProvider{}
+		s := newScheduler(&Client{node: node.BIZ, provider: p}, open(), nil)
+		s.release(nil)
+		p.expectSent(t, "10012024010112000000000001", "10012024010112000000000002")
+		s.close()
+		store = open()
+		due := mustDue(t, store, now+120000)
+		if len(due) != 1 || due[0].MsgId != "10012024010112000000000003" {
+			t.Fatalf("%s再次重启后应只剩下未到期的消息:%v", name, due)
+		}
+		if err = store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func mustDue(t *testing.T, store ScheduleStore, now int64) []*message.MsgPayload {
+	t.Helper()
+	due, err := store.Due(now, defaultScheduleBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return due
+}
@@ -0,0 +1,225 @@
+package amq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/aluka-7/amq/node"
+	"github.com/rs/zerolog/log"
+)
+
+// {@link Client#Close}和{@link Amq#Clean}等待处理中的消息完成的最长时间
+const defaultCloseTimeout = 30 * time.Second
+
+/**
+ * 客户端关闭的结果，记录在关闭超时时被放弃的工作。
+ */
+type ShutdownReport struct {
+	Node      node.Node `json:"node"`
+	Queues    []string  `json:"queues,omitempty"`   // 超时仍未停止监听(仍有处理中的消息)的队列
+	InFlight  []string  `json:"inFlight,omitempty"` // 超时仍在处理中的消息ID
+	Outbox    int       `json:"outbox"`             // 发件箱中仍未发送的消息数量，下次启动后继续发送
+	Scheduled int       `json:"scheduled"`          // 内存中尚未到期、随进程退出而丢失的延迟消息数量
+}
+
+/**
+ * 判断关闭时是否有被放弃的工作。
+ *
+ * @return
+ */
+func (r *ShutdownReport) Abandoned() bool {
+	return len(r.Queues) > 0 || len(r.InFlight) > 0 || r.Outbox > 0 || r.Scheduled > 0
+}
+
+/**
+ * 优雅地关闭客户端：先停止监听所有队列，不再接收新的消息，并等待处理中的消息(包括处理器的调用、失败重试以及应答消息的发送)完成，
+ * 然后转发发件箱和延迟投递调度器中可以发送的消息，最后释放所有资源。ctx超时或取消时不再等待，处理中的重试不再等待重试间隔，
+ * 返回的报告中记录了被放弃的队列和消息，同时返回ctx的错误；被放弃的消息仍在使用provider和各项存储，资源在这些消息处理完成后才在后台释放。
+ * 处理中的消息在等待期间仍然可以发送消息，等待结束后{@link #Send}、{@link #SendInTx}、{@link #Request}等发送方法都返回错误。
+ * 该方法只在第一次调用时生效。注意不要在处理器的回调中同步调用该方法(或{@link #Close})，否则会等待正在执行的回调自身直到ctx超时，
+ * 需要在回调中关闭客户端时请在新的协程中调用。
+ *
+ * @param ctx
+ * @return
+ */
+func (c *Client) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	report := &ShutdownReport{Node: c.node}
+	var errs []error
+	c.shutdownOnce.Do(func() {
+		stopped := c.unlistenAsync()
+		if err := c.awaitStopped(ctx, stopped); err != nil {
+			c.abandon()
+			errs = append(errs, err)
+			report.Queues, report.InFlight = c.unfinished()
+		}
+		atomic.StoreInt32(&c.closed, 1)
+		if c.outbox != nil {
+			n, err := c.outbox.flush(ctx)
+			report.Outbox = n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if c.scheduler != nil {
+			report.Scheduled = c.scheduler.flush(ctx)
+		}
+		if err := ctx.Err(); err != nil && len(errs) == 0 {
+			errs = append(errs, err)
+		}
+		if len(report.Queues) > 0 || len(report.InFlight) > 0 {
+			// 被放弃的消息仍在处理并可能发送应答消息，等待其完成后再关闭provider和各项存储
+			go func() {
+				<-stopped
+				c.release()
+				log.Info().Msgf("[AMQ-Client-%s]被放弃的消息已处理完成，资源已释放", c.node.String())
+			}()
+		} else {
+			c.release()
+		}
+		if report.Abandoned() {
+			log.Warn().Msgf("[AMQ-Client-%s]客户端已关闭，部分工作被放弃:%+v", c.node.String(), report)
+		} else {
+			log.Info().Msgf("[AMQ-Client-%s]客户端已关闭", c.node.String())
+		}
+	})
+	return report, errors.Join(errs...)
+}
+
+/**
+ * 客户端关闭后返回错误。
+ */
+func (c *Client) checkOpen() error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return fmt.Errorf("[AMQ-Client-%s]客户端已关闭，无法发送消息", c.node.String())
+	}
+	return nil
+}
+
+/**
+ * 释放客户端的所有资源。
+ */
+func (c *Client) release() {
+	if c.scheduler != nil {
+		c.scheduler.close()
+	}
+	if c.provider != nil {
+		c.provider.Close()
+	}
+	if c.tracker != nil {
+		c.tracker.close()
+	}
+	if c.replay != nil {
+		c.replay.close()
+	}
+	if c.dedupStore != nil {
+		if err := c.dedupStore.Close(); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭去重存储失败", c.node.String())
+		}
+	}
+	if c.deadLetters != nil {
+		c.deadLetters.close()
+	}
+}
+
+/**
+ * 获取仍未停止监听的队列以及仍在处理中的消息ID。
+ */
+func (c *Client) unfinished() (queues []string, inflight []string) {
+	for _, s := range c.PartitionStatus() {
+		if s.Listening {
+			queues = append(queues, s.Queue)
+		}
+	}
+	c.inflightMu.Lock()
+	for msgId := range c.inflight {
+		inflight = append(inflight, msgId)
+	}
+	c.inflightMu.Unlock()
+	sort.Strings(inflight)
+	return queues, inflight
+}
+
+/**
+ * 记录开始处理的消息。
+ */
+func (c *Client) enter(msgId string) {
+	c.inflightMu.Lock()
+	c.inflight[msgId]++
+	c.inflightMu.Unlock()
+}
+
+/**
+ * 记录处理完成的消息。
+ */
+func (c *Client) leave(msgId string) {
+	c.inflightMu.Lock()
+	if c.inflight[msgId]--; c.inflight[msgId] <= 0 {
+		delete(c.inflight, msgId)
+	}
+	c.inflightMu.Unlock()
+}
+
+/**
+ * 关闭超时，通知处理中的重试不再等待。
+ */
+func (c *Client) abandon() {
+	c.abandonOnce.Do(func() { close(c.abandoned) })
+}
+
+func (c *Client) isAbandoned() bool {
+	select {
+	case <-c.abandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * 等待重试间隔，关闭超时后立即返回false。
+ */
+func (c *Client) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.abandoned:
+		return false
+	}
+}
+
+/**
+ * 优雅地关闭所有已初始化的客户端，各客户端同时关闭并共用ctx的超时时间，返回按照节点排序的各客户端的关闭报告。
+ *
+ * @param ctx
+ * @return
+ */
+func (e *Amq) Shutdown(ctx context.Context) ([]*ShutdownReport, error) {
+	type result struct {
+		report *ShutdownReport
+		err    error
+	}
+	results := make(chan result, len(e.clientMap))
+	for _, c := range e.clientMap {
+		go func(c *Client) {
+			report, err := c.Shutdown(ctx)
+			results <- result{report, err}
+		}(c)
+	}
+	reports := make([]*ShutdownReport, 0, len(e.clientMap))
+	var errs []error
+	for range e.clientMap {
+		r := <-results
+		reports = append(reports, r.report)
+		if r.err != nil {
+			errs = append(errs, r.err)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Node < reports[j].Node })
+	return reports, errors.Join(errs...)
+}
@@ -0,0 +1,91 @@
+package amq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+)
+
+/**
+ * 收到消息后阻塞直到release被关闭。
+ */
+type blockingProcessor struct {
+	received chan string
+	release  chan struct{}
+}
+
+func (p *blockingProcessor) GetType() string {
+	return "block"
+}
+
+func (p *blockingProcessor) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	p.received <- message.GetMsgId(msg)
+	<-p.release
+	return nil, nil
+}
+
+func (p *blockingProcessor) OnRecipientAckReceived(msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (p *blockingProcessor) OnSenderAckReceived(msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func TestShutdownTimeoutReport(t *testing.T) {
+	c := newTestClient(t, "1104", `{"provider":"memory"}`)
+	p := &blockingProcessor{received: make(chan string, 1), release: make(chan struct{})}
+	defer close(p.release)
+	startClient(t, c, p)
+	nm := message.NewNoticeMessage(c.NewMsgId())
+	nm.SetType("block")
+	nm.SetBody(message.NewMessageBody())
+	nm.Destination = c.BuildQueueName("1104")
+	if err := c.Send(nm); err != nil {
+		t.Fatal(err)
+	}
+	msgId := message.GetMsgId(nm)
+	expectValue(t, p.received, msgId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("关闭超时应返回ctx的错误:%v", err)
+	}
+	if !report.Abandoned() || len(report.InFlight) != 1 || report.InFlight[0] != msgId {
+		t.Fatalf("关闭报告中应记录处理中的消息%s:%+v", msgId, report)
+	}
+	if len(report.Queues) != 1 || report.Queues[0] != c.BuildQueueName("1104") {
+		t.Fatalf("关闭报告中应记录未停止监听的队列:%+v", report)
+	}
+}
+
+func TestSendAfterShutdown(t *testing.T) {
+	c := newTestClient(t, "1105", `{"provider":"memory"}`)
+	startClient(t, c, newTestProcessor("notice", 0))
+	report, err := c.Shutdown(context.Background())
+	if err != nil || report.Abandoned() {
+		t.Fatalf("没有处理中的消息时应正常关闭:%+v,%v", report, err)
+	}
+	nm := message.NewNoticeMessage(c.NewMsgId())
+	nm.SetType("notice")
+	nm.SetBody(message.NewMessageBody())
+	nm.Destination = c.BuildQueueName("1105")
+	if err = c.Send(nm); err == nil {
+		t.Fatal("关闭后发送消息应返回错误")
+	}
+	if err = c.SendInTx(nil, nm); err == nil {
+		t.Fatal("关闭后发送事务内消息应返回错误")
+	}
+	sm := message.NewSimplexMessage(c.NewMsgId())
+	sm.SetType("notice")
+	sm.SetBody(message.NewMessageBody())
+	sm.Destination = c.BuildQueueName("1105")
+	if _, err = c.Request(context.Background(), sm); err == nil {
+		t.Fatal("关闭后发送同步请求应返回错误")
+	}
+}
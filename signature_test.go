@@ -0,0 +1,56 @@
+package amq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+)
+
+func TestUnverifiedMessageQuarantined(t *testing.T) {
+	quarantine := "sys_amq_1117_biz_quarantine"
+	receiver := newTestClient(t, "1117", `{"provider":"memory","quarantineQueue":"`+quarantine+`",`+
+		`"signature":{"algorithm":"hmac-sha256","activeKey":"k1","keys":{"k1":"secret1"}}}`)
+	rp := newTestProcessor("signature", 0)
+	startClient(t, receiver, rp)
+	raw := newRawProvider(t)
+	captured := &captureListener{received: make(chan string, 1)}
+	if _, err := raw.Listen(quarantine, captured); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := message.NewHMACSigner("k1", map[string]string{"k1": "secret1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNotice := func() *message.MsgPayload {
+		nm := message.NewNoticeMessage(receiver.NewMsgId())
+		nm.SetType("signature")
+		nm.SetBody(message.NewMessageBody().Add("amount", "100"))
+		nm.Destination = receiver.BuildQueueName("1117")
+		return message.NoticePayload(nm)
+	}
+
+	// 未配置acceptLegacy时旧版本MD5签名的消息不交给处理器，转发到隔离队列
+	legacy := newNotice()
+	if err = raw.Send(legacy); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, captured.received, legacy.MsgId)
+	expectNone(t, rp.received, 100*time.Millisecond)
+
+	// 签名后被篡改的消息同样被拒绝，之后签名正确的消息正常处理
+	tampered, valid := newNotice(), newNotice()
+	for _, mpl := range []*message.MsgPayload{tampered, valid} {
+		if err = signer.Sign(mpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tampered.Body.Add("amount", "10000")
+	for _, mpl := range []*message.MsgPayload{tampered, valid} {
+		if err = raw.Send(mpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectValue(t, rp.received, valid.MsgId)
+	expectNone(t, rp.received, 100*time.Millisecond)
+}
@@ -0,0 +1,454 @@
+package amq
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 单向/双向事务消息记录，发送方等待接收方应答(ReceiverAck)，双向事务的接收方等待发送方应答(SenderAck)。
+ * 收到应答或等待超时后记录保留在存储中，超过保留时间后才被清理。
+ */
+type Transaction struct {
+	MsgId    string        `json:"msgId"`    // 事务消息的唯一ID
+	Genre    string        `json:"type"`     // 消息类型
+	Category string        `json:"category"` // 消息分类，参看{@link message.SIMPLEX}和{@link message.DUPLEX}
+	Expect   string        `json:"expect"`   // 等待中的消息阶段
+	Deadline int64         `json:"deadline"` // 等待应答的截止时间(毫秒)
+	Phases   []PhaseChange `json:"phases"`   // 已经历的消息阶段
+	Status   string        `json:"status"`   // 事务状态，参看{@link TransactionPending}
+	Finished int64         `json:"finished"` // 收到应答或超时的时间(毫秒)，等待中为0
+}
+
+/**
+ * 事务记录的状态。
+ */
+const (
+	TransactionPending   = "pending"   // 等待对方应答
+	TransactionCompleted = "completed" // 已收到等待中的应答
+	TransactionTimedOut  = "timeout"   // 等待应答超时
+)
+
+/**
+ * 事务消息的一次阶段变化。
+ */
+type PhaseChange struct {
+	Phase string `json:"phase"`
+	Time  int64  `json:"time"` // 变化时间(毫秒)
+}
+
+/**
+ * 事务记录的唯一标示，同一个消息ID在发送方和接收方等待的阶段不同，因此使用消息ID和等待阶段共同标示。
+ */
+func (t *Transaction) Key() string {
+	return t.MsgId + "@" + t.Expect
+}
+
+/**
+ * 是否仍在等待对方应答，兼容没有记录状态的旧数据。
+ */
+func (t *Transaction) Pending() bool {
+	return len(t.Status) == 0 || t.Status == TransactionPending
+}
+
+/**
+ * 事务消息状态的存储接口，可自行实现后通过{@link Client#SetTransactionStore}替换默认的内存存储。
+ */
+type TransactionStore interface {
+	/**
+	 * 新增或更新事务记录。
+	 */
+	Save(tx *Transaction) error
+
+	/**
+	 * 根据{@link Transaction#Key}获取事务记录，不存在时返回nil。
+	 */
+	Get(key string) (*Transaction, error)
+
+	/**
+	 * 根据{@link Transaction#Key}删除事务记录。
+	 */
+	Remove(key string) error
+
+	/**
+	 * 获取所有截止时间早于给定时间并且仍在等待应答的事务记录。
+	 */
+	Expired(now time.Time) ([]*Transaction, error)
+
+	/**
+	 * 删除结束时间早于给定时间的已完成或已超时的事务记录。
+	 */
+	Purge(before time.Time) error
+
+	/**
+	 * 关闭存储，释放资源。
+	 */
+	Close() error
+}
+
+/**
+ * 基于内存的事务存储，进程重启后记录丢失。
+ */
+type memoryTransactionStore struct {
+	mu  sync.Mutex
+	txs map[string]*Transaction
+}
+
+func NewMemoryTransactionStore() TransactionStore {
+	return &memoryTransactionStore{txs: make(map[string]*Transaction)}
+}
+
+func (s *memoryTransactionStore) Save(tx *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txs[tx.Key()] = tx
+	return nil
+}
+
+func (s *memoryTransactionStore) Get(key string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txs[key], nil
+}
+
+func (s *memoryTransactionStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.txs, key)
+	return nil
+}
+
+func (s *memoryTransactionStore) Expired(now time.Time) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := now.UnixNano() / int64(time.Millisecond)
+	expired := make([]*Transaction, 0)
+	for _, tx := range s.txs {
+		if tx.Pending() && tx.Deadline <= ms {
+			expired = append(expired, tx)
+		}
+	}
+	return expired, nil
+}
+
+func (s *memoryTransactionStore) Purge(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge(before)
+	return nil
+}
+
+/**
+ * 删除过期的已结束事务记录并返回删除的数量，调用方需持有s.mu。
+ */
+func (s *memoryTransactionStore) purge(before time.Time) int {
+	ms := before.UnixNano() / int64(time.Millisecond)
+	n := 0
+	for key, tx := range s.txs {
+		if !tx.Pending() && tx.Finished < ms {
+			delete(s.txs, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryTransactionStore) Close() error {
+	return nil
+}
+
+/**
+ * 基于本地文件的事务存储，每次变更后将全部事务记录写入文件，进程重启后可继续跟踪超时。
+ */
+type fileTransactionStore struct {
+	memoryTransactionStore
+	path string
+}
+
+/**
+ * 打开指定路径的事务存储文件，文件不存在时自动创建。
+ *
+ * @param path
+ * @return
+ */
+func NewFileTransactionStore(path string) (TransactionStore, error) {
+	s := &fileTransactionStore{
+		memoryTransactionStore: memoryTransactionStore{txs: make(map[string]*Transaction)},
+		path:                   path,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		txs := make([]*Transaction, 0)
+		if err = json.Unmarshal(data, &txs); err != nil {
+			return nil, err
+		}
+		for _, tx := range txs {
+			s.txs[tx.Key()] = tx
+		}
+	}
+	return s, nil
+}
+
+func (s *fileTransactionStore) Save(tx *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txs[tx.Key()] = tx
+	return s.flush()
+}
+
+func (s *fileTransactionStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.txs[key]; !ok {
+		return nil
+	}
+	delete(s.txs, key)
+	return s.flush()
+}
+
+func (s *fileTransactionStore) Purge(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.purge(before) == 0 {
+		return nil
+	}
+	return s.flush()
+}
+
+/**
+ * 将全部事务记录写入临时文件后原子替换，调用方需持有s.mu。
+ */
+func (s *fileTransactionStore) flush() error {
+	txs := make([]*Transaction, 0, len(s.txs))
+	for _, tx := range s.txs {
+		txs = append(txs, tx)
+	}
+	data, err := json.Marshal(txs)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+/**
+ * 可选的处理器接口，消息处理器实现该接口后，在事务消息超过配置的等待时间仍未收到对方应答时会被回调。
+ */
+type TransactionTimeoutProcessor interface {
+	/**
+	 * 事务消息等待应答超时，发送方表示未收到接收方的应答，双向事务的接收方表示未收到发送方的确认应答。
+	 *
+	 * @param msgId 事务消息的唯一ID
+	 */
+	OnTransactionTimeout(msgId string)
+}
+
+// 已结束的事务记录默认保留的时间
+const defaultTransactionRetention = 24 * time.Hour
+
+// 清理已结束事务记录的间隔
+const transactionPurgeInterval = time.Minute
+
+/**
+ * 事务消息的跟踪器，记录每个事务消息的阶段变化，定期检查等待应答超时的事务并清理超过保留时间的记录。
+ */
+type transactionTracker struct {
+	client    *Client
+	store     TransactionStore
+	timeout   time.Duration
+	retention time.Duration
+	lastPurge time.Time
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newTransactionTracker(c *Client, store TransactionStore, timeout, retention time.Duration) *transactionTracker {
+	if retention <= 0 {
+		retention = defaultTransactionRetention
+	}
+	return &transactionTracker{client: c, store: store, timeout: timeout, retention: retention, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+/**
+ * 发送方发出事务消息，开始等待接收方应答，非事务消息直接忽略。
+ */
+func (t *transactionTracker) begin(mpl *message.MsgPayload) error {
+	if t == nil || (mpl.Category != message.SIMPLEX && mpl.Category != message.DUPLEX) {
+		return nil
+	}
+	now := nowMillis()
+	return t.advance(&Transaction{
+		MsgId:    mpl.MsgId,
+		Genre:    mpl.Genre,
+		Category: string(mpl.Category),
+		Expect:   string(message.ReceiverAck),
+		Deadline: now + int64(t.timeout/time.Millisecond),
+		Status:   TransactionPending,
+	}, PhaseChange{Phase: string(message.SenderReq), Time: now})
+}
+
+/**
+ * 双向事务的接收方已应答，开始等待发送方的确认应答。
+ *
+ * @param received 收到新消息的时间(毫秒)
+ */
+func (t *transactionTracker) awaitSenderAck(genre, msgId string, received int64) error {
+	now := nowMillis()
+	return t.advance(&Transaction{
+		MsgId:    msgId,
+		Genre:    genre,
+		Category: string(message.DUPLEX),
+		Expect:   string(message.SenderAck),
+		Deadline: now + int64(t.timeout/time.Millisecond),
+		Status:   TransactionPending,
+	}, PhaseChange{Phase: string(message.SenderReq), Time: received}, PhaseChange{Phase: string(message.ReceiverAck), Time: now})
+}
+
+/**
+ * 保存等待应答的事务记录，已存在相同的记录(如消息被重新发送或重新投递)时在已有的阶段之后追加新的阶段。
+ */
+func (t *transactionTracker) advance(tx *Transaction, phases ...PhaseChange) error {
+	existing, err := t.store.Get(tx.Key())
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		tx.Phases = append(append(make([]PhaseChange, 0, len(existing.Phases)+len(phases)), existing.Phases...), phases...)
+	} else {
+		tx.Phases = phases
+	}
+	return t.store.Save(tx)
+}
+
+/**
+ * 收到了等待中的应答，追加该阶段后将事务标记为已完成，重复收到的应答直接忽略。
+ */
+func (t *transactionTracker) complete(msgId string, phase string) {
+	if t == nil {
+		return
+	}
+	tx, err := t.store.Get(msgId + "@" + phase)
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]查询事务记录失败:msgId=%s", t.client.node.String(), msgId)
+		return
+	}
+	if tx == nil || !tx.Pending() {
+		return
+	}
+	if err = t.finish(tx, TransactionCompleted, PhaseChange{Phase: phase, Time: nowMillis()}); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]保存事务记录失败:msgId=%s", t.client.node.String(), msgId)
+		return
+	}
+	log.Debug().Msgf("[AMQ-Client-%s]事务消息完成:type=%s,msgId=%s,phases=%v", t.client.node.String(), tx.Genre, msgId, tx.Phases)
+}
+
+/**
+ * 以给定的状态结束事务并保存，保存的是记录的副本，避免修改存储中共享的对象。
+ */
+func (t *transactionTracker) finish(tx *Transaction, status string, phases ...PhaseChange) error {
+	finished := *tx
+	finished.Phases = append(append(make([]PhaseChange, 0, len(tx.Phases)+len(phases)), tx.Phases...), phases...)
+	finished.Status = status
+	finished.Finished = nowMillis()
+	if err := t.store.Save(&finished); err != nil {
+		return err
+	}
+	*tx = finished
+	return nil
+}
+
+/**
+ * 事务消息发送失败，删除等待接收方应答的记录。
+ */
+func (t *transactionTracker) cancel(msgId string) {
+	if t == nil {
+		return
+	}
+	if err := t.store.Remove(msgId + "@" + string(message.ReceiverAck)); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]删除事务记录失败:msgId=%s", t.client.node.String(), msgId)
+	}
+}
+
+/**
+ * 启动超时检查。
+ */
+func (t *transactionTracker) start() {
+	interval := t.timeout / 2
+	if interval > time.Second {
+		interval = time.Second
+	}
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case now := <-ticker.C:
+				t.check(now)
+			}
+		}
+	}()
+}
+
+/**
+ * 将等待应答超时的事务标记为已超时并回调处理器，每隔一段时间清理超过保留时间的已结束事务。
+ */
+func (t *transactionTracker) check(now time.Time) {
+	if now.Sub(t.lastPurge) >= transactionPurgeInterval {
+		t.lastPurge = now
+		if err := t.store.Purge(now.Add(-t.retention)); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]清理事务记录失败", t.client.node.String())
+		}
+	}
+	expired, err := t.store.Expired(now)
+	if err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]查询超时事务失败", t.client.node.String())
+		return
+	}
+	for _, tx := range expired {
+		if err = t.finish(tx, TransactionTimedOut); err != nil {
+			log.Error().Err(err).Msgf("[AMQ-Client-%s]保存事务记录失败:msgId=%s", t.client.node.String(), tx.MsgId)
+			continue
+		}
+		log.Warn().Msgf("[AMQ-Client-%s]事务消息等待应答超时:type=%s,msgId=%s,expect=%s", t.client.node.String(), tx.Genre, tx.MsgId, tx.Expect)
+		if p, ok := t.client.processorMap[tx.Genre].(TransactionTimeoutProcessor); ok {
+			p.OnTransactionTimeout(tx.MsgId)
+		}
+	}
+}
+
+/**
+ * 停止超时检查，不关闭事务存储。
+ */
+func (t *transactionTracker) halt() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *transactionTracker) close() {
+	t.halt()
+	if err := t.store.Close(); err != nil {
+		log.Error().Err(err).Msgf("[AMQ-Client-%s]关闭事务存储失败", t.client.node.String())
+	}
+}
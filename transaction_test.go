@@ -0,0 +1,139 @@
+package amq
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+)
+
+/**
+ * 记录事务超时回调的处理器。
+ */
+type timeoutProcessor struct {
+	timeouts []string
+}
+
+func (p *timeoutProcessor) GetType() string {
+	return "tx"
+}
+
+func (p *timeoutProcessor) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (p *timeoutProcessor) OnRecipientAckReceived(msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (p *timeoutProcessor) OnSenderAckReceived(msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+func (p *timeoutProcessor) OnTransactionTimeout(msgId string) {
+	p.timeouts = append(p.timeouts, msgId)
+}
+
+func newTestTracker(store TransactionStore, p Processor) *transactionTracker {
+	c := &Client{node: node.BIZ, processorMap: map[string]Processor{p.GetType(): p}}
+	return newTransactionTracker(c, store, time.Minute, time.Hour)
+}
+
+func simplexPayload(msgId string) *message.MsgPayload {
+	return &message.MsgPayload{MsgId: msgId, Genre: "tx", Category: message.SIMPLEX, Phase: message.SenderReq}
+}
+
+var (
+	sent  = string(message.SenderReq)
+	acked = string(message.ReceiverAck)
+)
+
+func expectTransaction(t *testing.T, store TransactionStore, key, status string, phases ...string) *Transaction {
+	t.Helper()
+	tx, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx == nil {
+		t.Fatalf("事务记录%s不存在", key)
+	}
+	if tx.Status != status {
+		t.Fatalf("事务记录%s的状态为%s，期望为%s", key, tx.Status, status)
+	}
+	if len(tx.Phases) != len(phases) {
+		t.Fatalf("事务记录%s的阶段为%v，期望为%v", key, tx.Phases, phases)
+	}
+	for i, phase := range phases {
+		if tx.Phases[i].Phase != phase {
+			t.Fatalf("事务记录%s的阶段为%v，期望为%v", key, tx.Phases, phases)
+		}
+	}
+	return tx
+}
+
+func TestTransactionCompletedKeepsPhases(t *testing.T) {
+	store := NewMemoryTransactionStore()
+	tracker := newTestTracker(store, &timeoutProcessor{})
+	if err := tracker.begin(simplexPayload("m1")); err != nil {
+		t.Fatal(err)
+	}
+	tracker.complete("m1", string(message.ReceiverAck))
+	tx := expectTransaction(t, store, "m1@2", TransactionCompleted, sent, acked)
+	if tx.Finished == 0 {
+		t.Fatal("已完成的事务没有记录完成时间")
+	}
+	// 重复收到的应答不再追加阶段
+	tracker.complete("m1", string(message.ReceiverAck))
+	expectTransaction(t, store, "m1@2", TransactionCompleted, sent, acked)
+	if expired, err := store.Expired(time.Now().Add(time.Hour)); err != nil || len(expired) != 0 {
+		t.Fatalf("已完成的事务不应超时:%v,%v", expired, err)
+	}
+}
+
+func TestTransactionTimedOut(t *testing.T) {
+	store := NewMemoryTransactionStore()
+	p := &timeoutProcessor{}
+	tracker := newTestTracker(store, p)
+	if err := tracker.begin(simplexPayload("m2")); err != nil {
+		t.Fatal(err)
+	}
+	tracker.check(time.Now().Add(2 * time.Minute))
+	tracker.check(time.Now().Add(3 * time.Minute))
+	if len(p.timeouts) != 1 || p.timeouts[0] != "m2" {
+		t.Fatalf("超时回调错误:%v", p.timeouts)
+	}
+	expectTransaction(t, store, "m2@2", TransactionTimedOut, sent)
+	// 超时后收到的应答不改变事务状态
+	tracker.complete("m2", string(message.ReceiverAck))
+	expectTransaction(t, store, "m2@2", TransactionTimedOut, sent)
+}
+
+func TestTransactionPurgedAfterRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tx.json")
+	store, err := NewFileTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := newTestTracker(store, &timeoutProcessor{})
+	for _, msgId := range []string{"m3", "m4"} {
+		if err = tracker.begin(simplexPayload(msgId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker.complete("m3", string(message.ReceiverAck))
+	// 保留时间内的记录不被清理
+	tracker.check(time.Now())
+	expectTransaction(t, store, "m3@2", TransactionCompleted, sent, acked)
+	tracker.lastPurge = time.Time{}
+	tracker.check(time.Now().Add(2 * time.Hour))
+	if store, err = NewFileTransactionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := store.Get("m3@2"); err != nil || tx != nil {
+		t.Fatalf("超过保留时间的事务记录未被清理:%v,%v", tx, err)
+	}
+	// 等待中的事务不会被清理，超时后才开始计算保留时间
+	expectTransaction(t, store, "m4@2", TransactionTimedOut, sent)
+}
@@ -0,0 +1,177 @@
+package amq
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/aluka-7/amq/message"
+	"github.com/rs/zerolog/log"
+)
+
+/**
+ * 并发处理策略。
+ */
+type ConcurrencyPolicy struct {
+	Workers int `json:"workers"`
+	Buffer  int `json:"buffer"`
+}
+
+/**
+ * 单独配置的消息类型同时处理的消息数量上限，不会为该类型额外启动协程。
+ */
+type GenreLimit struct {
+	Limit int `json:"limit"`
+}
+
+/**
+ * 并发处理配置，和节点的其他配置一起保存在/system/base/amq/{node}中，节点默认的策略之外还可以按照消息类型限制并发数量，格式如下：
+ * <pre>
+ * {
+ *   "workers" : 4,  // 每个监听的队列处理消息的协程数量(默认1)
+ *   "buffer" : 64,  // 每个协程等待处理的消息数量上限(默认64)，达到上限后阻塞provider继续接收消息
+ *   "genres" : {    // 按消息类型限制同时处理的消息数量(可选，默认1)，超过上限时所在的协程等待
+ *     "order" : {"limit" : 1}
+ *   }
+ * }
+ * </pre>
+ * 分区键相同的消息不论类型始终由同一个协程按照收到的顺序处理，分区键不同的消息并发处理；未设置分区键的消息全部由第一个协程按照收到的顺序处理，
+ * 因此只有设置了分区键的消息能够并发处理，处理器需要支持并发调用。
+ * provider在协程处理完成后通过{@link DispatchAsync}确认消息，要求provider实现{@link provider.AsyncDispatcher}(如rabbit和memory)，
+ * sql和filelog逐条同步确认消息，不支持该配置。
+ */
+type ConcurrencyConfig struct {
+	ConcurrencyPolicy
+	Genres map[string]*GenreLimit `json:"genres"`
+}
+
+const (
+	defaultConcurrencyWorkers = 1
+	defaultConcurrencyBuffer  = 64
+	defaultGenreLimit         = 1
+)
+
+/**
+ * 返回填充了默认值的策略副本。
+ */
+func (p ConcurrencyPolicy) normalize() ConcurrencyPolicy {
+	if p.Workers <= 0 {
+		p.Workers = defaultConcurrencyWorkers
+	}
+	if p.Buffer <= 0 {
+		p.Buffer = defaultConcurrencyBuffer
+	}
+	return p
+}
+
+/**
+ * 根据并发处理配置创建各消息类型的策略，节点默认只有一个协程并且没有按消息类型配置时返回nil，由provider直接同步处理。
+ */
+func newConcurrency(cfg *ConcurrencyConfig) *ConcurrencyConfig {
+	if cfg == nil || (cfg.Workers <= 1 && len(cfg.Genres) == 0) {
+		return nil
+	}
+	c := &ConcurrencyConfig{ConcurrencyPolicy: cfg.ConcurrencyPolicy.normalize(), Genres: make(map[string]*GenreLimit, len(cfg.Genres))}
+	for genre, l := range cfg.Genres {
+		if l != nil {
+			limit := l.Limit
+			if limit <= 0 {
+				limit = defaultGenreLimit
+			}
+			c.Genres[genre] = &GenreLimit{Limit: limit}
+		}
+	}
+	return c
+}
+
+/**
+ * 协程池中等待处理的一条消息，处理完成后调用done通知provider。
+ */
+type workerTask struct {
+	mpl  *message.MsgPayload
+	done func(rsp *message.MsgPayload, err error)
+}
+
+var errAbandoned = errors.New("客户端关闭超时，放弃处理消息")
+
+/**
+ * 一个队列的消息处理协程池，所有消息按照分区键分配到同一组协程(未设置分区键的消息分配到第一个协程)，每个协程有一个有界的缓冲队列，
+ * 单独配置的消息类型另外限制同时处理的数量。
+ */
+type workerPool struct {
+	client   *Client
+	queue    string
+	listener *defaultMessageListener
+	lanes    []chan *workerTask       // 按分区键分配消息的协程队列
+	limits   map[string]chan struct{} // 单独配置的消息类型同时处理的消息数量上限
+	wg       sync.WaitGroup
+}
+
+func newWorkerPool(c *Client, queue string, l *defaultMessageListener) *workerPool {
+	p := &workerPool{client: c, queue: queue, limits: make(map[string]chan struct{}, len(c.concurrency.Genres))}
+	pl := *l
+	pl.pool = p
+	p.listener = &pl
+	p.lanes = make([]chan *workerTask, c.concurrency.Workers)
+	for i := range p.lanes {
+		p.lanes[i] = make(chan *workerTask, c.concurrency.Buffer)
+		p.wg.Add(1)
+		go p.work(p.lanes[i])
+	}
+	for genre, l := range c.concurrency.Genres {
+		p.limits[genre] = make(chan struct{}, l.Limit)
+	}
+	return p
+}
+
+/**
+ * 将消息交给分区键对应的协程，未设置分区键的消息交给第一个协程以保持队列的顺序，缓冲已满时阻塞直到协程处理完前面的消息，处理完成后调用done。
+ */
+func (p *workerPool) submit(mpl *message.MsgPayload, done func(rsp *message.MsgPayload, err error)) {
+	ch := p.lanes[0]
+	if len(mpl.PartitionKey) > 0 {
+		ch = p.lanes[hashPartition(mpl.PartitionKey, len(p.lanes))]
+	}
+	t := &workerTask{mpl: mpl, done: done}
+	select {
+	case ch <- t:
+	default:
+		log.Debug().Msgf("[AMQ-Client-%s]消息处理协程繁忙，等待处理:queue=%s,msgId=%s", p.client.node.String(), p.queue, mpl.MsgId)
+		ch <- t
+	}
+}
+
+/**
+ * 按顺序处理分配给当前协程的消息，并将处理结果交给provider确认。
+ */
+func (p *workerPool) work(ch <-chan *workerTask) {
+	defer p.wg.Done()
+	for t := range ch {
+		t.done(p.process(t.mpl))
+		p.client.leave(t.mpl.MsgId)
+	}
+}
+
+/**
+ * 处理一条消息，客户端关闭超时后放弃尚未开始处理的消息，由provider稍后重新投递。
+ */
+func (p *workerPool) process(mpl *message.MsgPayload) (*message.MsgPayload, error) {
+	if p.client.isAbandoned() {
+		log.Warn().Msgf("[AMQ-Client-%s]客户端关闭超时，放弃处理消息:queue=%s,msgId=%s", p.client.node.String(), p.queue, mpl.MsgId)
+		return nil, errAbandoned
+	}
+	if limit, ok := p.limits[mpl.Genre]; ok {
+		limit <- struct{}{}
+		defer func() { <-limit }()
+	}
+	return dispatch(mpl, p.listener)
+}
+
+/**
+ * 等待所有协程处理完缓冲中的消息，调用之前provider必须已经停止投递。
+ */
+func (p *workerPool) close() {
+	for _, ch := range p.lanes {
+		close(ch)
+	}
+	p.wg.Wait()
+}
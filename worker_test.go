@@ -0,0 +1,164 @@
+package amq_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aluka-7/amq"
+	"github.com/aluka-7/amq/message"
+	"github.com/aluka-7/amq/node"
+	"github.com/aluka-7/amq/provider"
+)
+
+/**
+ * 按分区键记录收到的消息序号，同时统计同时处理的最大消息数量。
+ */
+type orderProcessor struct {
+	genre string
+	sleep time.Duration
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	seen  map[string][]int
+	cur   int
+	max   int
+}
+
+func newOrderProcessor(genre string, sleep time.Duration) *orderProcessor {
+	return &orderProcessor{genre: genre, sleep: sleep, seen: make(map[string][]int)}
+}
+
+func (p *orderProcessor) GetType() string {
+	return p.genre
+}
+
+func (p *orderProcessor) OnReceived(msg interface{}) (*message.MsgBody, error) {
+	defer p.wg.Done()
+	nm := msg.(*message.NoticeMessage)
+	p.mu.Lock()
+	if p.cur++; p.cur > p.max {
+		p.max = p.cur
+	}
+	p.mu.Unlock()
+	time.Sleep(p.sleep)
+	p.mu.Lock()
+	p.cur--
+	p.seen[nm.PartitionKey] = append(p.seen[nm.PartitionKey], nm.Body.GetInt("i"))
+	p.mu.Unlock()
+	return nil, nil
+}
+
+func (p *orderProcessor) OnRecipientAckReceived(msgId string, rsp *message.MsgBody) (*message.MsgBody, error) {
+	return nil, nil
+}
+
+func (p *orderProcessor) OnSenderAckReceived(msgId string, rsp *message.MsgBody) error {
+	return nil
+}
+
+/**
+ * 检查每个分区键的消息都按照发送的顺序处理。
+ */
+func (p *orderProcessor) expectOrdered(t *testing.T, each int) {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, seen := range p.seen {
+		if len(seen) != each {
+			t.Fatalf("分区键%q收到%d条消息，期望为%d", key, len(seen), each)
+		}
+		for i, v := range seen {
+			if v != i {
+				t.Fatalf("分区键%q的消息处理顺序错误:%v", key, seen)
+			}
+		}
+	}
+}
+
+func sendOrdered(t *testing.T, c *amq.Client, systemId, genre, key string, i int) {
+	t.Helper()
+	nm := message.NewNoticeMessage(c.NewMsgId())
+	nm.SetType(genre)
+	nm.Destination = c.BuildQueueName(systemId)
+	nm.PartitionKey = key
+	nm.SetBody(message.NewMessageBody().Add("i", i))
+	if err := c.Send(nm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnkeyedMessagesKeepOrder(t *testing.T) {
+	c := newTestClient(t, "1101", `{"provider":"memory","concurrency":{"workers":4}}`)
+	p := newOrderProcessor("order", time.Millisecond)
+	startClient(t, c, p)
+	p.wg.Add(50)
+	for i := 0; i < 50; i++ {
+		sendOrdered(t, c, "1101", "order", "", i)
+	}
+	p.wg.Wait()
+	// 未设置分区键的消息由同一个协程按照队列的顺序处理
+	p.expectOrdered(t, 50)
+	if p.max != 1 {
+		t.Fatalf("未设置分区键的消息不应并发处理:%d", p.max)
+	}
+}
+
+func TestKeyedMessagesConcurrentWithGenreLimit(t *testing.T) {
+	c := newTestClient(t, "1102", `{"provider":"memory","concurrency":{"workers":4,"genres":{"serial":{"limit":1}}}}`)
+	p := newOrderProcessor("parallel", 20*time.Millisecond)
+	s := newOrderProcessor("serial", 20*time.Millisecond)
+	startClient(t, c, p, s)
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	p.wg.Add(5 * len(keys))
+	s.wg.Add(5 * len(keys))
+	for i := 0; i < 5; i++ {
+		for _, key := range keys {
+			sendOrdered(t, c, "1102", "parallel", key, i)
+			sendOrdered(t, c, "1102", "serial", key, i)
+		}
+	}
+	p.wg.Wait()
+	s.wg.Wait()
+	p.expectOrdered(t, 5)
+	s.expectOrdered(t, 5)
+	if p.max < 2 {
+		t.Fatalf("分区键不同的消息应并发处理:%d", p.max)
+	}
+	if s.max != 1 {
+		t.Fatalf("serial类型同时处理的消息数量为%d，超过上限1", s.max)
+	}
+}
+
+/**
+ * 逐条同步确认消息、未实现provider.AsyncDispatcher的provider。
+ */
+type syncProvider struct{}
+
+func (p syncProvider) New(node node.Node, cfg map[string]string) provider.Provider {
+	return p
+}
+
+func (syncProvider) Listen(name string, listener provider.MessageListener) (func(), error) {
+	return func() {}, nil
+}
+
+func (syncProvider) Cancel(name string) {}
+
+func (syncProvider) Send(msg interface{}) error {
+	return nil
+}
+
+func (syncProvider) Close() {}
+
+func init() {
+	provider.Register("sync-test", syncProvider{})
+}
+
+func TestConcurrencyRequiresAsyncProvider(t *testing.T) {
+	c := newTestClient(t, "1103", `{"provider":"sync-test","concurrency":{"workers":4}}`)
+	_, err := c.Start(nil)
+	if err == nil || !strings.Contains(err.Error(), "concurrency") {
+		t.Fatalf("provider不支持并发处理时应启动失败:%v", err)
+	}
+}